@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// aclFinding is a kind of finding that can be turned into an exim ACL: the
+// source IPs it flagged, each with why, and how the ACL denies them.
+type aclFinding struct {
+	enabled func() bool
+	hosts   func() map[string]string
+	message string
+}
+
+// aclFindings are the findings -acl-findings can pick from, by name, which
+// is also the name of the host list file each is written to.
+var aclFindings = map[string]aclFinding{
+	"reputation": {
+		enabled: func() bool { return reputationFile != "" },
+		hosts:   reputationHosts,
+		message: "Rejected for the poor reputation of your IP",
+	},
+	"spoofing": {
+		enabled: func() bool { return spoofingFile != "" },
+		hosts:   spoofingHosts,
+		message: "Rejected for sending as our domains without authenticating",
+	},
+	"harvest": {
+		enabled: func() bool { return recipientFile != "" },
+		hosts:   harvestHosts,
+		message: "Rejected for probing for addresses",
+	},
+}
+
+var (
+	aclDir      = ""
+	aclSelected []string
+	aclExpiry   = 30 * 24 * time.Hour
+
+	aclEntryComment = regexp.MustCompile(`^# (\S+): (.*), added (\d{4}-\d\d-\d\d), expires (\d{4}-\d\d-\d\d)$`)
+)
+
+// enabledACLFindings are the names of the findings whose reports are
+// turned on, in order.
+func enabledACLFindings() []string {
+	var names []string
+	for name, finding := range aclFindings {
+		if finding.enabled() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// aclEntry is a host in a host list file, with why it is there, when it was
+// first added and when it is dropped unless found again.
+type aclEntry struct {
+	reason  string
+	added   string
+	expires string
+}
+
+func reputationHosts() map[string]string {
+	hosts := make(map[string]string)
+	for _, ip := range rankedReputations() {
+		score := reputations[ip].score()
+		if score < reputationThreshold {
+			break
+		}
+		hosts[ip] = "reputation score " + strconv.FormatFloat(score, 'f', -1, 64)
+	}
+	return hosts
+}
+
+func spoofingHosts() map[string]string {
+	counts := make(map[string]int)
+	for key, count := range spoofCounts {
+		counts[key.ip] += count
+	}
+	hosts := make(map[string]string)
+	for ip, count := range counts {
+		hosts[ip] = fmt.Sprintf("sent %d unauthenticated messages as our domains", count)
+	}
+	return hosts
+}
+
+func harvestHosts() map[string]string {
+	counts := make(map[string]int)
+	for key, addresses := range probedRecipients {
+		if key.ip != "" {
+			counts[key.ip] += len(addresses)
+		}
+	}
+	hosts := make(map[string]string)
+	for ip, count := range counts {
+		if count >= probeThreshold {
+			hosts[ip] = fmt.Sprintf("probed %d unknown recipients", count)
+		}
+	}
+	return hosts
+}
+
+// writeACL writes a host list file into -acl-dir for each finding, and
+// acl.conf with a deny statement for each to include in the RCPT ACL. Hosts
+// already in a host list stay until they expire, and those found again have
+// their expiry put back, so running it regularly keeps the lists current.
+func writeACL(now time.Time) (int, error) {
+	dir, err := filepath.Abs(aclDir)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	today := now.UTC().Format(dateLayout)
+	expires := now.UTC().Add(aclExpiry).Format(dateLayout)
+
+	var acl strings.Builder
+	fmt.Fprintf(&acl, "# Generated on %s from the findings of crunching the mainlogs. Include\n", today)
+	fmt.Fprintf(&acl, "# it at the start of the RCPT ACL with:\n#   .include %s\n", filepath.Join(dir, "acl.conf"))
+	total := 0
+	for _, name := range aclSelected {
+		finding := aclFindings[name]
+		fileName := filepath.Join(dir, name+".hosts")
+		entries, err := readHostList(fileName)
+		if err != nil {
+			return total, err
+		}
+		for ip, entry := range entries {
+			if entry.expires < today {
+				delete(entries, ip)
+			}
+		}
+		for ip, reason := range finding.hosts() {
+			entry, ok := entries[ip]
+			if ok && entry.reason == "" {
+				continue
+			}
+			if !ok {
+				entry.added = today
+			}
+			entry.reason = reason
+			entry.expires = expires
+			entries[ip] = entry
+		}
+		if err := writeHostList(fileName, name, entries); err != nil {
+			return total, err
+		}
+		total += len(entries)
+
+		fmt.Fprintf(&acl, "\n# %d hosts flagged by %s.\n", len(entries), name)
+		fmt.Fprintf(&acl, "deny    hosts       = %s\n", fileName)
+		fmt.Fprintf(&acl, "        message     = %s\n", finding.message)
+		fmt.Fprintf(&acl, "        log_message = in the %s findings\n", name)
+	}
+	return total, os.WriteFile(filepath.Join(dir, "acl.conf"), []byte(acl.String()), 0644)
+}
+
+// readHostList reads back the entries of a host list file writeHostList
+// wrote, if there is one.
+func readHostList(fileName string) (map[string]aclEntry, error) {
+	entries := make(map[string]aclEntry)
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	var last []string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if matches := aclEntryComment.FindStringSubmatch(line); matches != nil {
+			last = matches
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// A host added by hand, without a comment saying when it expires,
+		// is kept as it is.
+		entry := aclEntry{expires: "9999-12-31"}
+		if last != nil && last[1] == line {
+			entry = aclEntry{reason: last[2], added: last[3], expires: last[4]}
+		}
+		entries[line] = entry
+		last = nil
+	}
+	return entries, scanner.Err()
+}
+
+// writeHostList writes entries as an exim host list file, an IP a line, each
+// after a comment with why it is there and when it expires.
+func writeHostList(fileName, name string, entries map[string]aclEntry) error {
+	ips := make([]string, 0, len(entries))
+	for ip := range entries {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := bufio.NewWriter(outFile)
+	fmt.Fprintf(writer, "# Source IPs flagged by %s, each dropped once it expires unless flagged again.\n", name)
+	for _, ip := range ips {
+		entry := entries[ip]
+		if entry.reason == "" {
+			fmt.Fprintln(writer, ip)
+			continue
+		}
+		fmt.Fprintf(writer, "# %s: %s, added %s, expires %s\n%s\n", ip, entry.reason, entry.added, entry.expires, ip)
+	}
+	return writer.Flush()
+}
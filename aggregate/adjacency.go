@@ -0,0 +1,66 @@
+package aggregate
+
+import "sort"
+
+// adjacency is who each sender has mailed, as a slice of recipient ids per
+// sender id. Recipients are appended as they are seen and only sorted and
+// deduplicated once a sender's slice has doubled since it was last tidied,
+// which keeps repeats cheap without a map entry per pair. It is not safe for
+// concurrent use.
+type adjacency struct {
+	edges [][]uint32
+	tidy  []int
+}
+
+// add records that from mailed to, returning true if from had not sent
+// anything before.
+func (a *adjacency) add(from, to uint32) bool {
+	for int(from) >= len(a.edges) {
+		a.edges = append(a.edges, nil)
+		a.tidy = append(a.tidy, 0)
+	}
+
+	first := len(a.edges[from]) == 0
+	a.edges[from] = append(a.edges[from], to)
+	if len(a.edges[from]) >= 2*a.tidy[from]+8 {
+		a.compact(from)
+	}
+	return first
+}
+
+// compact sorts and deduplicates from's recipients.
+func (a *adjacency) compact(from uint32) {
+	recipients := a.edges[from]
+	sort.Slice(recipients, func(i, j int) bool { return recipients[i] < recipients[j] })
+	unique := 0
+	for i, to := range recipients {
+		if i == 0 || to != recipients[unique-1] {
+			recipients[unique] = to
+			unique++
+		}
+	}
+	a.edges[from] = recipients[:unique]
+	a.tidy[from] = unique
+}
+
+// recipients returns the distinct ids from has mailed.
+func (a *adjacency) recipients(from uint32) []uint32 {
+	if int(from) >= len(a.edges) {
+		return nil
+	}
+	if len(a.edges[from]) != a.tidy[from] {
+		a.compact(from)
+	}
+	return a.edges[from]
+}
+
+// senders returns the ids of everyone who has mailed someone.
+func (a *adjacency) senders() []uint32 {
+	var senders []uint32
+	for from, recipients := range a.edges {
+		if len(recipients) > 0 {
+			senders = append(senders, uint32(from))
+		}
+	}
+	return senders
+}
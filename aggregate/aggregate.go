@@ -0,0 +1,116 @@
+// Package aggregate groups who mailed whom, the engine behind the exim
+// cruncher, for embedding in other programs.
+package aggregate
+
+import (
+	"context"
+	"sync"
+)
+
+// Record is a sender mailing a recipient. The addresses are bytes so lines
+// can be added without copying them, and are compared exactly, so callers
+// wanting case-insensitive grouping should lowercase them first.
+type Record struct {
+	From []byte
+	To   []byte
+}
+
+// Group is a sender and everyone they mailed.
+type Group struct {
+	From string
+	To   []string
+}
+
+// Aggregator collects the distinct recipients of each sender. Addresses are
+// kept once each and given small integer ids, in the order they were first
+// seen. It is safe for concurrent use.
+type Aggregator struct {
+	lock      sync.Mutex
+	addresses *interner
+	edges     adjacency
+	metrics   Metrics
+}
+
+// New makes an empty Aggregator.
+func New() *Aggregator {
+	return &Aggregator{addresses: newInterner()}
+}
+
+// NewWithMetrics makes an empty Aggregator that reports to metrics as
+// records are added.
+func NewWithMetrics(metrics Metrics) *Aggregator {
+	return &Aggregator{addresses: newInterner(), metrics: metrics}
+}
+
+// Add records that r.From mailed r.To, returning the ids of both and
+// whether it is the first mail r.From has sent.
+func (a *Aggregator) Add(r Record) (from, to uint32, first bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	from, to = a.addresses.id(r.From), a.addresses.id(r.To)
+	first = a.edges.add(from, to)
+	a.report(first)
+	return from, to, first
+}
+
+// AddAll adds records until the channel is closed, or returns the context's
+// error if it is done first.
+func (a *Aggregator) AddAll(ctx context.Context, records <-chan Record) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r, ok := <-records:
+			if !ok {
+				return nil
+			}
+			a.Add(r)
+		}
+	}
+}
+
+// MergeFrom adds everything other has collected.
+func (a *Aggregator) MergeFrom(other *Aggregator) {
+	for _, group := range other.Snapshot() {
+		from := []byte(group.From)
+		for _, to := range group.To {
+			a.Add(Record{From: from, To: []byte(to)})
+		}
+	}
+}
+
+// Snapshot copies out every sender, in the order they were first seen, with
+// the distinct recipients they mailed.
+func (a *Aggregator) Snapshot() []Group {
+	var groups []Group
+	a.Each(func(from uint32, to []uint32) bool {
+		group := Group{From: a.addresses.name(from), To: make([]string, len(to))}
+		for i, id := range to {
+			group.To[i] = a.addresses.name(id)
+		}
+		groups = append(groups, group)
+		return true
+	})
+	return groups
+}
+
+// Each calls fn with the id of each sender, in the order they were first
+// seen, and the ids of the distinct recipients they mailed, until fn returns
+// false. The recipients are only valid until fn returns, and fn must not
+// call the Aggregator's other methods bar Name.
+func (a *Aggregator) Each(fn func(from uint32, to []uint32) bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, from := range a.edges.senders() {
+		if !fn(from, a.edges.recipients(from)) {
+			return
+		}
+	}
+}
+
+// Name is the address with id. Unlike the other methods it takes no lock,
+// so it can be called from within Each, but outside of Each it must not be
+// called while records are being added.
+func (a *Aggregator) Name(id uint32) string {
+	return a.addresses.name(id)
+}
@@ -0,0 +1,264 @@
+package aggregate
+
+import (
+	"context"
+	"expvar"
+	"reflect"
+	"testing"
+)
+
+func records(pairs ...string) []Record {
+	var rs []Record
+	for i := 0; i+1 < len(pairs); i += 2 {
+		rs = append(rs, Record{From: []byte(pairs[i]), To: []byte(pairs[i+1])})
+	}
+	return rs
+}
+
+func TestSnapshotGroupsInFirstSeenOrder(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		records []Record
+		want    []Group
+	}{
+		{"empty", nil, nil},
+		{"one pair", records("a", "b"), []Group{{From: "a", To: []string{"b"}}}},
+		{
+			"repeats kept once",
+			records("a", "b", "a", "b", "a", "c", "a", "b"),
+			[]Group{{From: "a", To: []string{"b", "c"}}},
+		},
+		{
+			"senders first seen first",
+			records("z", "y", "a", "b", "z", "x"),
+			[]Group{{From: "z", To: []string{"y", "x"}}, {From: "a", To: []string{"b"}}},
+		},
+		{
+			// Senders and recipients both come out by id, the order their
+			// addresses were first seen as either.
+			"by first seen address",
+			records("c", "a", "b", "c", "a", "b", "a", "c"),
+			[]Group{{From: "c", To: []string{"a"}}, {From: "a", To: []string{"c", "b"}}, {From: "b", To: []string{"c"}}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a := New()
+			for _, r := range test.records {
+				a.Add(r)
+			}
+			if got := a.Snapshot(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("snapshot is %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAddReportsIDsAndFirstSends(t *testing.T) {
+	a := New()
+	for _, test := range []struct {
+		from, to         string
+		wantFrom, wantTo uint32
+		wantFirst        bool
+	}{
+		{"a", "b", 0, 1, true},
+		{"a", "c", 0, 2, false},
+		{"b", "a", 1, 0, true},
+		{"a", "b", 0, 1, false},
+	} {
+		from, to, first := a.Add(Record{From: []byte(test.from), To: []byte(test.to)})
+		if from != test.wantFrom || to != test.wantTo || first != test.wantFirst {
+			t.Errorf("adding %s to %s gave %d, %d, %v, want %d, %d, %v", test.from, test.to, from, to, first, test.wantFrom, test.wantTo, test.wantFirst)
+		}
+	}
+}
+
+func TestEachStopsWhenFnReturnsFalse(t *testing.T) {
+	a := New()
+	for _, r := range records("a", "b", "c", "d", "e", "f") {
+		a.Add(r)
+	}
+	var seen []string
+	a.Each(func(from uint32, to []uint32) bool {
+		seen = append(seen, a.Name(from))
+		return len(seen) < 2
+	})
+	if want := []string{"a", "c"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("saw senders %v, want %v", seen, want)
+	}
+}
+
+func TestMergeFromAddsTheOthersGroups(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		into, other []Record
+		want        []Group
+	}{
+		{"into empty", nil, records("a", "b"), []Group{{From: "a", To: []string{"b"}}}},
+		{"from empty", records("a", "b"), nil, []Group{{From: "a", To: []string{"b"}}}},
+		{
+			"overlapping",
+			records("a", "b", "c", "d"),
+			records("a", "b", "a", "e", "f", "g"),
+			[]Group{{From: "a", To: []string{"b", "e"}}, {From: "c", To: []string{"d"}}, {From: "f", To: []string{"g"}}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			into, other := New(), New()
+			for _, r := range test.into {
+				into.Add(r)
+			}
+			for _, r := range test.other {
+				other.Add(r)
+			}
+			into.MergeFrom(other)
+			if got := into.Snapshot(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("merged snapshot is %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAddAllStopsAtTheEndOrWhenCancelled(t *testing.T) {
+	t.Run("closed", func(t *testing.T) {
+		a := New()
+		in := make(chan Record, 2)
+		in <- Record{From: []byte("a"), To: []byte("b")}
+		in <- Record{From: []byte("a"), To: []byte("c")}
+		close(in)
+		if err := a.AddAll(context.Background(), in); err != nil {
+			t.Fatal(err)
+		}
+		if got := a.Snapshot(); len(got) != 1 || len(got[0].To) != 2 {
+			t.Errorf("added %v, want both records", got)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		// Nothing is ever sent or closed, so only the cancel can end it.
+		if err := New().AddAll(ctx, make(chan Record)); err != context.Canceled {
+			t.Errorf("AddAll returned %v, want it cancelled", err)
+		}
+	})
+}
+
+func TestInternerGivesEachAddressOneID(t *testing.T) {
+	in := newInterner()
+	for _, test := range []struct {
+		name string
+		want uint32
+	}{
+		{"a@x.com", 0},
+		{"b@x.com", 1},
+		{"a@x.com", 0},
+		{"A@x.com", 2},
+	} {
+		if got := in.id([]byte(test.name)); got != test.want {
+			t.Errorf("%s has id %d, want %d", test.name, got, test.want)
+		}
+	}
+	if got := in.name(1); got != "b@x.com" {
+		t.Errorf("id 1 is %s, want b@x.com", got)
+	}
+}
+
+func TestAdjacencyCompactsRepeats(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		to   []uint32
+		want []uint32
+	}{
+		{"none", nil, nil},
+		{"below the first tidy", []uint32{3, 1, 3}, []uint32{1, 3}},
+		{"many repeats", repeat([]uint32{5, 2, 9}, 100), []uint32{2, 5, 9}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var a adjacency
+			for _, to := range test.to {
+				a.add(0, to)
+				// However many repeats come in, only a few untidied ones are
+				// held at once.
+				if len(a.edges[0]) >= 2*a.tidy[0]+8 {
+					t.Fatalf("holding %d recipients with %d tidy", len(a.edges[0]), a.tidy[0])
+				}
+			}
+			if got := a.recipients(0); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("recipients are %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	var a adjacency
+	a.add(2, 0)
+	if got := a.senders(); !reflect.DeepEqual(got, []uint32{2}) {
+		t.Errorf("senders are %v, want only 2", got)
+	}
+	if got := a.recipients(7); got != nil {
+		t.Errorf("an unseen sender has recipients %v", got)
+	}
+}
+
+func repeat(ids []uint32, times int) []uint32 {
+	var repeated []uint32
+	for i := 0; i < times; i++ {
+		repeated = append(repeated, ids...)
+	}
+	return repeated
+}
+
+// count is a Counter and Gauge that keeps what it was told.
+type count struct {
+	value int64
+}
+
+func (c *count) Add(delta int64) { c.value += delta }
+func (c *count) Set(value int64) { c.value = value }
+
+func TestMetricsCountRecordsSendersAndAddresses(t *testing.T) {
+	for _, test := range []struct {
+		name                                    string
+		records                                 []Record
+		wantRecords, wantSenders, wantAddresses int64
+	}{
+		{"none", nil, 0, 0, 0},
+		{"one", records("a", "b"), 1, 1, 2},
+		{"repeats", records("a", "b", "a", "b", "b", "a", "c", "a"), 4, 3, 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var records, senders, addresses count
+			a := NewWithMetrics(Metrics{Records: &records, Senders: &senders, Addresses: &addresses})
+			for _, r := range test.records {
+				a.Add(r)
+			}
+			if records.value != test.wantRecords || senders.value != test.wantSenders || addresses.value != test.wantAddresses {
+				t.Errorf("counted %d records, %d senders and %d addresses, want %d, %d and %d",
+					records.value, senders.value, addresses.value, test.wantRecords, test.wantSenders, test.wantAddresses)
+			}
+		})
+	}
+
+	// Metrics left nil are skipped.
+	NewWithMetrics(Metrics{}).Add(Record{From: []byte("a"), To: []byte("b")})
+}
+
+func TestExpvarMetricsArePublished(t *testing.T) {
+	a := NewWithMetrics(ExpvarMetrics("aggregate_test_"))
+	for _, r := range records("a", "b", "a", "c", "d", "a") {
+		a.Add(r)
+	}
+	for name, want := range map[string]string{
+		"aggregate_test_records":   "3",
+		"aggregate_test_senders":   "2",
+		"aggregate_test_addresses": "4",
+	} {
+		v := expvar.Get(name)
+		if v == nil {
+			t.Errorf("%s isn't published", name)
+			continue
+		}
+		if got := v.String(); got != want {
+			t.Errorf("%s is %s, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package aggregate
+
+// interner hands out a small integer id for each distinct address so results
+// can be kept as integers instead of strings. It is not safe for concurrent
+// use.
+type interner struct {
+	ids   map[string]uint32
+	names []string
+}
+
+func newInterner() *interner {
+	return &interner{ids: make(map[string]uint32)}
+}
+
+// id returns name's id, allocating a new one the first time name is seen.
+func (in *interner) id(name []byte) uint32 {
+	if id, ok := in.ids[string(name)]; ok {
+		return id
+	}
+	id := uint32(len(in.names))
+	in.names = append(in.names, string(name))
+	in.ids[in.names[id]] = id
+	return id
+}
+
+func (in *interner) name(id uint32) string {
+	return in.names[id]
+}
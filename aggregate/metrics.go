@@ -0,0 +1,50 @@
+package aggregate
+
+import "expvar"
+
+// Counter is a count an Aggregator adds to as it works. *expvar.Int is one,
+// and the counters of most metrics libraries can be wrapped to be one.
+type Counter interface {
+	Add(delta int64)
+}
+
+// Gauge is a level an Aggregator sets as it works. *expvar.Int is one too.
+type Gauge interface {
+	Set(value int64)
+}
+
+// Metrics are where an Aggregator reports what it is doing, for a program
+// embedding it to wire into its own metrics. Any left nil aren't reported.
+type Metrics struct {
+	// Records counts every record added.
+	Records Counter
+	// Senders counts the distinct senders seen.
+	Senders Counter
+	// Addresses is how many distinct addresses are held.
+	Addresses Gauge
+}
+
+// ExpvarMetrics publishes Metrics with expvar as prefix followed by records,
+// senders and addresses, which net/http serves on /debug/vars. Like
+// expvar.NewInt it panics if called twice with the same prefix.
+func ExpvarMetrics(prefix string) Metrics {
+	return Metrics{
+		Records:   expvar.NewInt(prefix + "records"),
+		Senders:   expvar.NewInt(prefix + "senders"),
+		Addresses: expvar.NewInt(prefix + "addresses"),
+	}
+}
+
+// report tells the metrics about a record added. It must be called with the
+// lock held.
+func (a *Aggregator) report(first bool) {
+	if a.metrics.Records != nil {
+		a.metrics.Records.Add(1)
+	}
+	if first && a.metrics.Senders != nil {
+		a.metrics.Senders.Add(1)
+	}
+	if a.metrics.Addresses != nil {
+		a.metrics.Addresses.Set(int64(len(a.addresses.names)))
+	}
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Apache Arrow IPC streaming format, written by hand as just the parts the
+// results need: a schema message, record batches of utf8 and int64 columns
+// without nulls, and the end of stream marker. See
+// https://arrow.apache.org/docs/format/Columnar.html#ipc-streaming-format
+
+const (
+	arrowVersion    = 4 // MetadataVersion V5
+	arrowSchema     = 1 // MessageHeader Schema
+	arrowBatch      = 3 // MessageHeader RecordBatch
+	arrowInt        = 2 // Type Int
+	arrowUtf8       = 5 // Type Utf8
+	arrowBatchRows  = 65536
+	arrowContinuing = 0xFFFFFFFF
+)
+
+// arrowPairs writes a from, to row per pair, with count, last_seen and
+// expires columns as needed.
+type arrowPairs struct {
+	writer  *arrowWriter
+	counted bool
+	stamped bool
+	row     []interface{}
+}
+
+func newArrowPairWriter(w io.Writer, counted, stamped bool) (pairWriter, error) {
+	columns := []*arrowColumn{{name: "from", kind: arrowUtf8}, {name: "to", kind: arrowUtf8}}
+	if counted {
+		columns = append(columns, &arrowColumn{name: "count", kind: arrowInt})
+	}
+	if stamped {
+		columns = append(columns, &arrowColumn{name: "last_seen", kind: arrowUtf8}, &arrowColumn{name: "expires", kind: arrowUtf8})
+	}
+	writer, err := newArrowWriter(w, columns...)
+	if err != nil {
+		return nil, err
+	}
+	return &arrowPairs{writer: writer, counted: counted, stamped: stamped}, nil
+}
+
+func (a *arrowPairs) write(p pair) error {
+	a.row = append(a.row[:0], p.from, p.to)
+	if a.counted {
+		a.row = append(a.row, p.count)
+	}
+	if a.stamped {
+		a.row = append(a.row, p.lastSeen, p.expires)
+	}
+	return a.writer.add(a.row...)
+}
+
+func (a *arrowPairs) close() error {
+	return a.writer.close()
+}
+
+// readArrowPairs reads back what arrowPairs wrote.
+func readArrowPairs(r *bufio.Reader, fn func(p pair) error) (string, error) {
+	a, err := newArrowReader(r)
+	if err != nil {
+		return "", err
+	}
+	version := a.metadata[outputSchemaKey]
+
+	columns := make(map[string]int)
+	for i, name := range a.names {
+		wanted := arrowUtf8
+		if name == "count" {
+			wanted = arrowInt
+		}
+		if a.kinds[i] != wanted {
+			return version, fmt.Errorf("arrow column %s has the wrong type", name)
+		}
+		columns[name] = i
+	}
+	from, hasFrom := columns["from"]
+	to, hasTo := columns["to"]
+	if !hasFrom || !hasTo {
+		return version, errors.New("arrow stream has no from and to columns")
+	}
+	count, counted := columns["count"]
+	lastSeen, hasLastSeen := columns["last_seen"]
+	expires, stamped := columns["expires"]
+
+	return version, a.each(func(row []interface{}) error {
+		p := pair{from: row[from].(string), to: row[to].(string)}
+		if counted {
+			p.count = row[count].(int64)
+		}
+		if hasLastSeen {
+			p.lastSeen = row[lastSeen].(string)
+		}
+		if stamped {
+			p.expires = row[expires].(string)
+		}
+		return fn(p)
+	})
+}
+
+type arrowColumn struct {
+	name    string
+	kind    int
+	offsets []int32
+	data    []byte
+	ints    []int64
+}
+
+// arrowWriter streams rows to w as Arrow record batches.
+type arrowWriter struct {
+	w       io.Writer
+	columns []*arrowColumn
+	rows    int
+}
+
+func newArrowWriter(w io.Writer, columns ...*arrowColumn) (*arrowWriter, error) {
+	a := &arrowWriter{w: w, columns: columns}
+	a.reset()
+	return a, a.message(a.schema(), nil)
+}
+
+// add appends a row, one value per column: a string for utf8 columns and an
+// int64 for int columns.
+func (a *arrowWriter) add(values ...interface{}) error {
+	for i, column := range a.columns {
+		switch value := values[i].(type) {
+		case string:
+			column.data = append(column.data, value...)
+			column.offsets = append(column.offsets, int32(len(column.data)))
+		case int64:
+			column.ints = append(column.ints, value)
+		}
+	}
+	a.rows++
+	if a.rows < arrowBatchRows {
+		return nil
+	}
+	return a.flush()
+}
+
+// close writes out the last batch and ends the stream.
+func (a *arrowWriter) close() error {
+	if err := a.flush(); err != nil {
+		return err
+	}
+	var end [8]byte
+	binary.LittleEndian.PutUint32(end[:], arrowContinuing)
+	_, err := a.w.Write(end[:])
+	return err
+}
+
+func (a *arrowWriter) reset() {
+	a.rows = 0
+	for _, column := range a.columns {
+		column.offsets = append(column.offsets[:0], 0)
+		column.data = column.data[:0]
+		column.ints = column.ints[:0]
+	}
+}
+
+// flush writes the rows added so far as a record batch.
+func (a *arrowWriter) flush() error {
+	if a.rows == 0 {
+		return nil
+	}
+
+	var body []byte
+	var buffers [][2]int64
+	addBuffer := func(data []byte) {
+		buffers = append(buffers, [2]int64{int64(len(body)), int64(len(data))})
+		body = append(body, data...)
+		for len(body)%8 != 0 {
+			body = append(body, 0)
+		}
+	}
+	for _, column := range a.columns {
+		addBuffer(nil)
+		if column.kind == arrowUtf8 {
+			offsets := make([]byte, 4*len(column.offsets))
+			for i, offset := range column.offsets {
+				binary.LittleEndian.PutUint32(offsets[4*i:], uint32(offset))
+			}
+			addBuffer(offsets)
+			addBuffer(column.data)
+		} else {
+			ints := make([]byte, 8*len(column.ints))
+			for i, value := range column.ints {
+				binary.LittleEndian.PutUint64(ints[8*i:], uint64(value))
+			}
+			addBuffer(ints)
+		}
+	}
+
+	rows := uint64(a.rows)
+	b := &fbBuilder{}
+	b.put(4, 0)
+	root := b.table(
+		fbScalar(2, arrowVersion),
+		fbScalar(1, arrowBatch),
+		fbRef(func(b *fbBuilder) int {
+			return b.table(
+				fbScalar(8, rows),
+				fbRef(func(b *fbBuilder) int {
+					return b.structs(len(a.columns), func() {
+						for range a.columns {
+							b.put(8, rows)
+							b.put(8, 0)
+						}
+					})
+				}),
+				fbRef(func(b *fbBuilder) int {
+					return b.structs(len(buffers), func() {
+						for _, buffer := range buffers {
+							b.put(8, uint64(buffer[0]))
+							b.put(8, uint64(buffer[1]))
+						}
+					})
+				}),
+			)
+		}),
+		fbScalar(8, uint64(len(body))),
+	)
+	b.patch(0, root)
+
+	a.reset()
+	return a.message(b.buf, body)
+}
+
+// schema is the flatbuffer Message describing the columns, with the version
+// of the output schema in its metadata.
+func (a *arrowWriter) schema() []byte {
+	b := &fbBuilder{}
+	b.put(4, 0)
+	root := b.table(
+		fbScalar(2, arrowVersion),
+		fbScalar(1, arrowSchema),
+		fbRef(func(b *fbBuilder) int {
+			return b.table(
+				fbScalar(2, 0),
+				fbRef(func(b *fbBuilder) int {
+					fields := make([]func(*fbBuilder) int, len(a.columns))
+					for i, column := range a.columns {
+						column := column
+						fields[i] = func(b *fbBuilder) int {
+							return b.table(
+								fbRef(func(b *fbBuilder) int { return b.str(column.name) }),
+								fbScalar(1, 0),
+								fbScalar(1, uint64(column.kind)),
+								fbRef(func(b *fbBuilder) int {
+									if column.kind == arrowInt {
+										return b.table(fbScalar(4, 64), fbScalar(1, 1))
+									}
+									return b.table()
+								}),
+								nil,
+								fbRef(func(b *fbBuilder) int { return b.tables(nil) }),
+							)
+						}
+					}
+					return b.tables(fields)
+				}),
+				fbRef(func(b *fbBuilder) int {
+					return b.tables([]func(*fbBuilder) int{func(b *fbBuilder) int {
+						return b.table(
+							fbRef(func(b *fbBuilder) int { return b.str(outputSchemaKey) }),
+							fbRef(func(b *fbBuilder) int { return b.str(strconv.Itoa(outputSchemaVersion)) }),
+						)
+					}})
+				}),
+			)
+		}),
+		fbScalar(8, 0),
+	)
+	b.patch(0, root)
+	return b.buf
+}
+
+// message frames a flatbuffer Message and its body: the continuation marker,
+// the padded metadata length, the metadata and then the body.
+func (a *arrowWriter) message(metadata, body []byte) error {
+	for len(metadata)%8 != 0 {
+		metadata = append(metadata, 0)
+	}
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[:], arrowContinuing)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(metadata)))
+	for _, part := range [][]byte{prefix[:], metadata, body} {
+		if _, err := a.w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fbBuilder lays out a flatbuffer front to back. Whatever a table or vector
+// refers to is written after it, so the unsigned offsets all point forward,
+// and each reference is patched once its target's position is known. Every
+// table starts 8 byte aligned and its fields are aligned to their size.
+type fbBuilder struct {
+	buf []byte
+}
+
+// fbField is a table field: an inline scalar of size bytes, or a reference
+// to an object written by ref.
+type fbField struct {
+	size  int
+	value uint64
+	ref   func(b *fbBuilder) int
+}
+
+func fbScalar(size int, value uint64) *fbField {
+	return &fbField{size: size, value: value}
+}
+
+func fbRef(ref func(b *fbBuilder) int) *fbField {
+	return &fbField{size: 4, ref: ref}
+}
+
+func (b *fbBuilder) pad(align int) {
+	for len(b.buf)%align != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+func (b *fbBuilder) put(size int, value uint64) {
+	for i := 0; i < size; i++ {
+		b.buf = append(b.buf, byte(value>>(8*uint(i))))
+	}
+}
+
+// patch points the offset at at to target.
+func (b *fbBuilder) patch(at, target int) {
+	binary.LittleEndian.PutUint32(b.buf[at:], uint32(target-at))
+}
+
+// table writes a vtable and a table with fields in field id order, nil for
+// those left out, then whatever the fields refer to. It returns the table's
+// position.
+func (b *fbBuilder) table(fields ...*fbField) int {
+	offsets := make([]int, len(fields))
+	size := 4
+	for _, width := range []int{8, 4, 2, 1} {
+		for i, field := range fields {
+			if field == nil || field.size != width {
+				continue
+			}
+			for size%width != 0 {
+				size++
+			}
+			offsets[i] = size
+			size += width
+		}
+	}
+
+	b.pad(2)
+	vtable := len(b.buf)
+	b.put(2, uint64(4+2*len(fields)))
+	b.put(2, uint64(size))
+	for _, offset := range offsets {
+		b.put(2, uint64(offset))
+	}
+
+	b.pad(8)
+	table := len(b.buf)
+	b.put(4, uint64(table-vtable))
+	b.buf = append(b.buf, make([]byte, size-4)...)
+	for i, field := range fields {
+		if field != nil && field.ref == nil {
+			for j := 0; j < field.size; j++ {
+				b.buf[table+offsets[i]+j] = byte(field.value >> (8 * uint(j)))
+			}
+		}
+	}
+	for i, field := range fields {
+		if field != nil && field.ref != nil {
+			b.patch(table+offsets[i], field.ref(b))
+		}
+	}
+	return table
+}
+
+// tables writes a vector of tables, each written by one of tables.
+func (b *fbBuilder) tables(tables []func(*fbBuilder) int) int {
+	b.pad(4)
+	vector := len(b.buf)
+	b.put(4, uint64(len(tables)))
+	b.buf = append(b.buf, make([]byte, 4*len(tables))...)
+	for i, table := range tables {
+		b.patch(vector+4+4*i, table(b))
+	}
+	return vector
+}
+
+// structs writes a vector of count 8 byte aligned structs, which write puts
+// in place.
+func (b *fbBuilder) structs(count int, write func()) int {
+	b.pad(8)
+	b.put(4, 0)
+	vector := len(b.buf)
+	b.put(4, uint64(count))
+	write()
+	return vector
+}
+
+func (b *fbBuilder) str(s string) int {
+	b.pad(4)
+	at := len(b.buf)
+	b.put(4, uint64(len(s)))
+	b.buf = append(b.buf, s...)
+	b.buf = append(b.buf, 0)
+	return at
+}
+
+var errFlatbuffer = errors.New("arrow metadata is not a valid flatbuffer")
+
+// arrowReader reads back the streams arrowWriter writes, utf8 and int64
+// columns without nulls, checking everything it follows so a damaged stream
+// is an error.
+type arrowReader struct {
+	r        io.Reader
+	names    []string
+	kinds    []int
+	metadata map[string]string
+}
+
+// newArrowReader reads the schema at the start of the stream in r.
+func newArrowReader(r io.Reader) (*arrowReader, error) {
+	a := &arrowReader{r: r, metadata: make(map[string]string)}
+	message, _, err := a.message()
+	if err != nil {
+		return nil, err
+	}
+	if message == nil {
+		return nil, errors.New("arrow stream ends before its schema")
+	}
+	if kind, err := message.uint(1, 1); err != nil || kind != arrowSchema {
+		return nil, errors.New("arrow stream does not start with a schema")
+	}
+	schema, err := message.child(2)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := schema.tables(1)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		name, err := field.str(0)
+		if err != nil {
+			return nil, err
+		}
+		kind, err := field.uint(2, 1)
+		if err != nil {
+			return nil, err
+		}
+		if kind != arrowUtf8 && kind != arrowInt {
+			return nil, fmt.Errorf("arrow column %s has unsupported type %d", name, kind)
+		}
+		a.names = append(a.names, name)
+		a.kinds = append(a.kinds, int(kind))
+	}
+
+	pairs, err := schema.tables(2)
+	if err != nil {
+		return nil, err
+	}
+	for _, pair := range pairs {
+		key, err := pair.str(0)
+		if err != nil {
+			return nil, err
+		}
+		if a.metadata[key], err = pair.str(1); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// each calls fn with every row through to the end of the stream, a string
+// for each utf8 column and an int64 for each int one.
+func (a *arrowReader) each(fn func(row []interface{}) error) error {
+	row := make([]interface{}, len(a.names))
+	for {
+		message, body, err := a.message()
+		if err != nil || message == nil {
+			return err
+		}
+		if kind, err := message.uint(1, 1); err != nil || kind != arrowBatch {
+			return errors.New("arrow stream has a message other than a record batch after its schema")
+		}
+		batch, err := message.child(2)
+		if err != nil {
+			return err
+		}
+		length, err := batch.uint(0, 8)
+		if err != nil {
+			return err
+		}
+		start, count, err := batch.vector(2, 16)
+		if err != nil {
+			return err
+		}
+		buffers := make([][]byte, count)
+		for i := range buffers {
+			offset := binary.LittleEndian.Uint64(batch.buf[start+16*i:])
+			size := binary.LittleEndian.Uint64(batch.buf[start+16*i+8:])
+			if offset > uint64(len(body)) || size > uint64(len(body))-offset {
+				return errors.New("arrow buffer runs past the end of its batch")
+			}
+			buffers[i] = body[offset : offset+size]
+		}
+
+		columns := make([][]byte, 0, 2*len(a.kinds))
+		next := 0
+		for _, kind := range a.kinds {
+			// Each column has a validity bitmap, unused without nulls, then
+			// utf8 offsets and data or int values.
+			if kind == arrowUtf8 {
+				if next+3 > len(buffers) {
+					return errors.New("arrow batch has too few buffers for its columns")
+				}
+				columns = append(columns, buffers[next+1], buffers[next+2])
+				next += 3
+				continue
+			}
+			if next+2 > len(buffers) {
+				return errors.New("arrow batch has too few buffers for its columns")
+			}
+			columns = append(columns, nil, buffers[next+1])
+			next += 2
+		}
+
+		for i := 0; uint64(i) < length; i++ {
+			for c, kind := range a.kinds {
+				values, data := columns[2*c], columns[2*c+1]
+				if kind == arrowInt {
+					if len(data) < 8*(i+1) {
+						return errors.New("arrow int column is shorter than its batch")
+					}
+					row[c] = int64(binary.LittleEndian.Uint64(data[8*i:]))
+					continue
+				}
+				if len(values) < 4*(i+2) {
+					return errors.New("arrow utf8 offsets are shorter than their batch")
+				}
+				from := binary.LittleEndian.Uint32(values[4*i:])
+				to := binary.LittleEndian.Uint32(values[4*i+4:])
+				if from > to || uint64(to) > uint64(len(data)) {
+					return errors.New("arrow utf8 offsets are out of range")
+				}
+				row[c] = string(data[from:to])
+			}
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// message reads the next message and its body, or nil at the end of the
+// stream.
+func (a *arrowReader) message() (*fbTable, []byte, error) {
+	var prefix [8]byte
+	if _, err := io.ReadFull(a.r, prefix[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+	if binary.LittleEndian.Uint32(prefix[:]) != arrowContinuing {
+		return nil, nil, errors.New("arrow message does not start with a continuation marker")
+	}
+	size := binary.LittleEndian.Uint32(prefix[4:])
+	if size == 0 {
+		return nil, nil, nil
+	}
+	if size > 1<<30 {
+		return nil, nil, errors.New("arrow message metadata is too big")
+	}
+	metadata := make([]byte, size)
+	if _, err := io.ReadFull(a.r, metadata); err != nil {
+		return nil, nil, err
+	}
+	if len(metadata) < 4 {
+		return nil, nil, errFlatbuffer
+	}
+	message, err := fbTableAt(metadata, int(binary.LittleEndian.Uint32(metadata)))
+	if err != nil {
+		return nil, nil, err
+	}
+	bodyLength, err := message.uint(3, 8)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bodyLength > 1<<34 {
+		return nil, nil, errors.New("arrow message body is too big")
+	}
+	body := make([]byte, bodyLength)
+	if _, err := io.ReadFull(a.r, body); err != nil {
+		return nil, nil, err
+	}
+	return message, body, nil
+}
+
+// fbTable is a table in a flatbuffer being read.
+type fbTable struct {
+	buf    []byte
+	pos    int
+	vtable int
+	vsize  int
+}
+
+func fbTableAt(buf []byte, pos int) (*fbTable, error) {
+	if pos < 0 || pos+4 > len(buf) {
+		return nil, errFlatbuffer
+	}
+	vtable := pos - int(int32(binary.LittleEndian.Uint32(buf[pos:])))
+	if vtable < 0 || vtable+4 > len(buf) {
+		return nil, errFlatbuffer
+	}
+	vsize := int(binary.LittleEndian.Uint16(buf[vtable:]))
+	if vsize < 4 || vtable+vsize > len(buf) {
+		return nil, errFlatbuffer
+	}
+	return &fbTable{buf: buf, pos: pos, vtable: vtable, vsize: vsize}, nil
+}
+
+// field is where field id is in the buffer, or 0 when it is left out.
+func (t *fbTable) field(id int) int {
+	if 4+2*id+2 > t.vsize {
+		return 0
+	}
+	offset := int(binary.LittleEndian.Uint16(t.buf[t.vtable+4+2*id:]))
+	if offset == 0 {
+		return 0
+	}
+	return t.pos + offset
+}
+
+// uint reads field id as an unsigned scalar of size bytes, 0 if left out.
+func (t *fbTable) uint(id, size int) (uint64, error) {
+	at := t.field(id)
+	if at == 0 {
+		return 0, nil
+	}
+	if at+size > len(t.buf) {
+		return 0, errFlatbuffer
+	}
+	var value uint64
+	for i := 0; i < size; i++ {
+		value |= uint64(t.buf[at+i]) << (8 * uint(i))
+	}
+	return value, nil
+}
+
+// ref follows the offset in field id, or returns 0 when it is left out.
+func (t *fbTable) ref(id int) (int, error) {
+	at := t.field(id)
+	if at == 0 {
+		return 0, nil
+	}
+	if at+4 > len(t.buf) {
+		return 0, errFlatbuffer
+	}
+	target := at + int(binary.LittleEndian.Uint32(t.buf[at:]))
+	if target >= len(t.buf) {
+		return 0, errFlatbuffer
+	}
+	return target, nil
+}
+
+func (t *fbTable) child(id int) (*fbTable, error) {
+	at, err := t.ref(id)
+	if err != nil {
+		return nil, err
+	}
+	if at == 0 {
+		return nil, errFlatbuffer
+	}
+	return fbTableAt(t.buf, at)
+}
+
+// vector is where the elements of the vector in field id start and how many
+// of size bytes there are, none when it is left out.
+func (t *fbTable) vector(id, size int) (int, int, error) {
+	at, err := t.ref(id)
+	if err != nil || at == 0 {
+		return 0, 0, err
+	}
+	if at+4 > len(t.buf) {
+		return 0, 0, errFlatbuffer
+	}
+	count := int(binary.LittleEndian.Uint32(t.buf[at:]))
+	if count < 0 || count > (len(t.buf)-at-4)/size {
+		return 0, 0, errFlatbuffer
+	}
+	return at + 4, count, nil
+}
+
+func (t *fbTable) tables(id int) ([]*fbTable, error) {
+	start, count, err := t.vector(id, 4)
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]*fbTable, count)
+	for i := range tables {
+		at := start + 4*i
+		if tables[i], err = fbTableAt(t.buf, at+int(binary.LittleEndian.Uint32(t.buf[at:]))); err != nil {
+			return nil, err
+		}
+	}
+	return tables, nil
+}
+
+func (t *fbTable) str(id int) (string, error) {
+	start, count, err := t.vector(id, 1)
+	if err != nil {
+		return "", err
+	}
+	return string(t.buf[start : start+count]), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// authUser is what an authenticated user sent: how many messages, to whom,
+// from which IPs and countries, and in which hours of the day.
+type authUser struct {
+	messages   int
+	recipients map[string]bool
+	ips        map[string]bool
+	countries  map[string]bool
+	hours      [24]int
+}
+
+var (
+	authFile  = ""
+	authUsers = make(map[string]*authUser)
+	authLock  = sync.Mutex{}
+
+	authMarker = []byte(" A=")
+)
+
+// isAuthLine is a quick check for lines that may be authenticated arrivals,
+// before going to the trouble of parsing them.
+func isAuthLine(line []byte) bool {
+	return isArrivalLine(line) && bytes.Contains(line, authMarker)
+}
+
+// authName is the user an A= field authenticated as, without the name of
+// the authenticator, so one user logging in through several of them is
+// counted once.
+func authName(field string) string {
+	if colon := strings.IndexByte(field, ':'); colon >= 0 {
+		field = field[colon+1:]
+	}
+	return strings.ToLower(field)
+}
+
+// checkAuth counts each authenticated <= record under the user it was
+// authenticated as, leaving every other record alone. Countries are looked
+// up in -ip2asn when it is given.
+func checkAuth(r record) {
+	if r.flag != "<=" || r.fields["A"] == "" {
+		return
+	}
+	name := authName(r.fields["A"])
+	if name == "" {
+		return
+	}
+
+	authLock.Lock()
+	defer authLock.Unlock()
+	u := authUsers[name]
+	if u == nil {
+		u = &authUser{recipients: make(map[string]bool), ips: make(map[string]bool), countries: make(map[string]bool)}
+		authUsers[name] = u
+	}
+	u.messages++
+	for _, to := range strings.Fields(r.fields["for"]) {
+		u.recipients[strings.ToLower(to)] = true
+	}
+	if ip := r.ip(); ip != "" {
+		u.ips[ip] = true
+		if found, ok := lookupASN(ip); ok {
+			u.countries[found.country] = true
+		}
+	}
+	u.hours[r.time.In(bucketZone()).Hour()]++
+}
+
+// writeAuth writes a line per authenticated user with their messages,
+// distinct recipients, the IPs and countries they sent from and how many
+// messages they sent in each hour of the day, busiest first.
+func writeAuth(fileName string) error {
+	names := make([]string, 0, len(authUsers))
+	for name := range authUsers {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if authUsers[names[i]].messages != authUsers[names[j]].messages {
+			return authUsers[names[i]].messages > authUsers[names[j]].messages
+		}
+		return names[i] < names[j]
+	})
+
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := csv.NewWriter(outFile)
+	header := []string{"user", "messages", "recipients", "ip_count", "ips", "countries"}
+	for hour := 0; hour < 24; hour++ {
+		header = append(header, fmt.Sprintf("h%02d", hour))
+	}
+	writer.Write(header)
+	for _, name := range names {
+		u := authUsers[name]
+		line := []string{name, strconv.Itoa(u.messages), strconv.Itoa(len(u.recipients)), strconv.Itoa(len(u.ips)), joinSet(u.ips), joinSet(u.countries)}
+		for _, count := range u.hours {
+			line = append(line, strconv.Itoa(count))
+		}
+		writer.Write(line)
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// joinSet is the members of set, sorted and space separated.
+func joinSet(set map[string]bool) string {
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return strings.Join(members, " ")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var autocompleteDir = ""
+
+// weighted is a recipient a user sent to, weighted by how many messages
+// they sent them.
+type weighted struct {
+	address string
+	weight  int
+}
+
+// writeAutocomplete writes a file per user into dir, named by their address,
+// of each address they sent mail to and how many messages they sent it, tab
+// separated and most sent first, the way address book and autocomplete
+// stores import them. Users are the senders at -internal-domains when it is
+// set and every sender otherwise.
+func writeAutocomplete(dir string, r *Runner) error {
+	emails := r.emails
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var err error
+	emails.Each(func(from uint32, recipients []uint32) bool {
+		user := emails.Name(from)
+		if len(internalDomains) > 0 && !isInternal(user) {
+			return true
+		}
+		addresses := make([]weighted, 0, len(recipients))
+		for _, to := range recipients {
+			addresses = append(addresses, weighted{address: emails.Name(to), weight: r.pairCounts[pairID(from, to)]})
+		}
+		sort.Slice(addresses, func(i, j int) bool {
+			if addresses[i].weight != addresses[j].weight {
+				return addresses[i].weight > addresses[j].weight
+			}
+			return addresses[i].address < addresses[j].address
+		})
+		// Escaping keeps an address with a slash in it from naming a file
+		// somewhere else.
+		if err = writeWeighted(filepath.Join(dir, url.PathEscape(user)+".tsv"), addresses); err != nil {
+			return false
+		}
+		return true
+	})
+	return err
+}
+
+func writeWeighted(fileName string, addresses []weighted) error {
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := bufio.NewWriter(outFile)
+	for _, a := range addresses {
+		fmt.Fprintf(writer, "%s\t%d\n", a.address, a.weight)
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// backfill crunches the rotated logs first and only then follows the
+	// live ones, so the sinks see the history before what is new.
+	backfill    = false
+	rotatedName = regexp.MustCompile(`[.-]\d+(?:\.gz)?$`)
+	// liveIdentities are what the live logs were when the run started, so a
+	// rotation while backfilling is caught up on rather than skipped.
+	liveIdentities = make(map[string]fileID)
+)
+
+// isRotated reports whether name has a logrotate count or dateext suffix.
+func isRotated(name string) bool {
+	return rotatedName.MatchString(filepath.Base(name))
+}
+
+// splitBackfill splits files into those to backfill, oldest first, and the
+// live logs to follow once they are done, noting what the live ones are now.
+func splitBackfill(files []inputFile) (rotated, live []inputFile) {
+	modified := make(map[string]int64)
+	for _, file := range files {
+		if !canFollow(file) {
+			rotated = append(rotated, file)
+			if info, err := os.Stat(file.name); err == nil {
+				modified[file.name] = info.ModTime().UnixNano()
+			}
+			continue
+		}
+		if info, err := os.Stat(file.name); err == nil {
+			if id, ok := identify(info); ok {
+				liveIdentities[file.name] = id
+			}
+		}
+		live = append(live, file)
+	}
+	sort.SliceStable(rotated, func(i, j int) bool { return modified[rotated[i].name] < modified[rotated[j].name] })
+	return rotated, live
+}
+
+// finishRotated reads the rest of file, from offset, after it was rotated
+// away from its name as id, so what exim wrote to it between its last read
+// and the rotation isn't lost. The rotated file is found by its identity
+// among the files beside it, which only works while it's uncompressed, as
+// it is with delaycompress.
+func (r *Runner) finishRotated(file inputFile, id fileID, offset int64, times *fileTimes, lines *int, w *worker) {
+	dir := filepath.Dir(file.name)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		w.log.Warn().Err(err).Msg("Failed to look for where the file was rotated to")
+		return
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasSuffix(entry.Name(), ".gz") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if current, ok := identify(info); ok && current == id {
+			rotated := inputFile{name: filepath.Join(dir, entry.Name()), kind: file.kind, domain: file.domain}
+			w.log.Info().Str("rotated", rotated.name).Int64("offset", offset).Msg("Finishing the rotated file before following the new one")
+			// Its lines are logged as the rotated file's, not the new one's.
+			following := w.identity
+			w.identity = id
+			r.crunchFile(rotated, offset, times, lines, w)
+			w.identity = following
+			return
+		}
+	}
+	w.log.Warn().Int64("offset", offset).Msg("Could not find where the file was rotated to, anything written to it after it was last read is lost")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scatterSource is where a message we didn't originate came in from.
+type scatterSource struct {
+	ip   string
+	host string
+}
+
+// scatter is the bounces sent out to outside addresses for the mail one
+// source sent us.
+type scatter struct {
+	bounces    int
+	first      time.Time
+	last       time.Time
+	recipients map[string]bool
+}
+
+var (
+	backscatterFile string
+	scatters        = make(map[scatterSource]*scatter)
+	// scatterArrivals are where each message in flight that came in from
+	// outside came from.
+	scatterArrivals = newInFlight()
+	scatterLock     = sync.Mutex{}
+)
+
+// isBackscatterLine is a quick check for lines that may be arrivals,
+// bounces among them, or completions, before going to the trouble of
+// parsing them.
+func isBackscatterLine(line []byte) bool {
+	return isArrivalLine(line) || bytes.Contains(line, completedMarker)
+}
+
+// checkBackscatter notes where each message arrived from when it wasn't one
+// of ours, being neither authenticated nor from a trusted network, and counts
+// the bounces of those messages sent to outside addresses against the source.
+// Those bounces mostly go to forged senders, which is what gets a server
+// blocklisted.
+func checkBackscatter(r record) {
+	if r.id == "" {
+		return
+	}
+
+	scatterLock.Lock()
+	defer scatterLock.Unlock()
+	switch {
+	case r.flag == "" && r.message == "Completed":
+		scatterArrivals.complete(r.id)
+	case r.flag == "<=" && r.address == "<>":
+		tracked, ok := scatterArrivals.get(r.fields["R"])
+		if !ok {
+			return
+		}
+		source := tracked.(scatterSource)
+		for _, to := range strings.Fields(r.fields["for"]) {
+			to = strings.ToLower(strings.Trim(to, "<>"))
+			if isInternal(to) {
+				continue
+			}
+			s := scatters[source]
+			if s == nil {
+				s = &scatter{first: r.time, recipients: make(map[string]bool)}
+				scatters[source] = s
+			}
+			s.bounces++
+			s.last = r.time
+			s.recipients[to] = true
+		}
+	case r.flag == "<=":
+		if r.fields["A"] != "" {
+			return
+		}
+		ip := net.ParseIP(r.ip())
+		if ip == nil || isTrusted(ip) {
+			return
+		}
+		scatterArrivals.track(r.id, scatterSource{ip: ip.String(), host: r.host()})
+	}
+}
+
+// writeBackscatter writes a line per source whose mail we bounced to outside
+// addresses, with the number of bounces and who they went to, most bounces
+// first.
+func writeBackscatter(fileName string) error {
+	sources := make([]scatterSource, 0, len(scatters))
+	for source := range scatters {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		if scatters[sources[i]].bounces != scatters[sources[j]].bounces {
+			return scatters[sources[i]].bounces > scatters[sources[j]].bounces
+		}
+		return sources[i].ip+sources[i].host < sources[j].ip+sources[j].host
+	})
+
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := csv.NewWriter(outFile)
+	writer.Write([]string{"ip", "host", "bounces", "first", "last", "recipients"})
+	for _, source := range sources {
+		s := scatters[source]
+		recipients := make([]string, 0, len(s.recipients))
+		for recipient := range s.recipients {
+			recipients = append(recipients, recipient)
+		}
+		sort.Strings(recipients)
+		writer.Write([]string{source.ip, source.host, strconv.Itoa(s.bounces), s.first.Format(time.RFC3339), s.last.Format(time.RFC3339), strings.Join(recipients, " ")})
+	}
+	writer.Flush()
+	return writer.Error()
+}
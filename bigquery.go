@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bigQuerySink streams events into a BigQuery table with insertAll. The
+// table must have a STRING column for each of eventColumns, bar time which
+// is a TIMESTAMP. A table day partitioned by ingestion time has each event
+// put in the partition of its log date through the table$YYYYMMDD
+// decorator, but BigQuery only streams into partitions from 31 days before
+// today to 16 days after it, so older logs can't be backfilled that way. A
+// table partitioned on the time column takes events of any date into the
+// table itself, and is what columnPartitioned is for.
+type bigQuerySink struct {
+	endpoint          string
+	host              string
+	batch             int
+	columnPartitioned bool
+	lock              sync.Mutex
+	rows              map[string][]map[string]interface{}
+	pending           int
+	// kept is how many rows the last flush kept to try again, which the
+	// next waits for a whole batch beyond.
+	kept int
+}
+
+// bigQueryBacklog is how many batches of rows that couldn't be sent are kept
+// to try again, beyond which the oldest partition's rows are dropped.
+const bigQueryBacklog = 10
+
+// bigQueryPast and bigQueryFuture are how far either side of now BigQuery
+// streams into a partition decorator.
+const (
+	bigQueryPast   = 31 * 24 * time.Hour
+	bigQueryFuture = 16 * 24 * time.Hour
+)
+
+// newBigQuerySink inserts into project.dataset.table in batches of batch
+// rows, into the table itself when it is partitioned by the time column and
+// into day partitions when by ingestion time.
+func newBigQuerySink(table, host string, batch int, columnPartitioned bool) (*bigQuerySink, error) {
+	parts := strings.SplitN(table, ".", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("BigQuery table %q is not project.dataset.table", table)
+	}
+	return &bigQuerySink{
+		endpoint:          "https://bigquery.googleapis.com/bigquery/v2/projects/" + url.PathEscape(parts[0]) + "/datasets/" + url.PathEscape(parts[1]) + "/tables/" + url.PathEscape(parts[2]),
+		host:              host,
+		batch:             batch,
+		columnPartitioned: columnPartitioned,
+		rows:              make(map[string][]map[string]interface{}),
+	}, nil
+}
+
+func (b *bigQuerySink) send(e event) error {
+	row := make(map[string]interface{}, len(eventColumns))
+	for i, value := range eventValues(e, b.host) {
+		if value != "" {
+			row[eventColumns[i]] = value
+		}
+	}
+	partition := ""
+	if !b.columnPartitioned {
+		day := reportTime(e.record.time)
+		if age := time.Since(day); age > bigQueryPast || age < -bigQueryFuture {
+			return fmt.Errorf("BigQuery can't stream into the partition for %s, outside 31 days before and 16 after today; backfill into a table partitioned on time with -bigquery-column-partitioned", day.Format(dateLayout))
+		}
+		partition = "$" + day.Format("20060102")
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	// The record id lets BigQuery drop a row sent again, by a retried flush
+	// or a rerun over the same logs, on a best effort basis.
+	b.rows[partition] = append(b.rows[partition], map[string]interface{}{"insertId": e.id, "json": row})
+	b.pending++
+	if b.pending-b.kept < b.batch {
+		return nil
+	}
+	return b.flush()
+}
+
+// flush inserts everything batched so far, a partition at a time, each
+// dropped once it is in. BigQuery is told to insert the good rows of a batch
+// around any it rejects, which are dropped and reported, as sending them
+// again would only have them rejected again, while those
+// that couldn't be sent at all are kept to try again on the next flush, up
+// to bigQueryBacklog batches of them. It must be called with the lock held.
+func (b *bigQuerySink) flush() error {
+	partitions := make([]string, 0, len(b.rows))
+	for partition := range b.rows {
+		partitions = append(partitions, partition)
+	}
+	sort.Strings(partitions)
+
+	var failed []error
+	for i, partition := range partitions {
+		batch := b.rows[partition]
+		err := b.insert(partition, batch)
+		if _, rejected := err.(bigQueryRejection); err == nil || rejected {
+			delete(b.rows, partition)
+			b.pending -= len(batch)
+		}
+		if err != nil {
+			failed = append(failed, err)
+			if _, rejected := err.(bigQueryRejection); !rejected {
+				failed = append(failed, b.trimBacklog(partitions[i:])...)
+				break
+			}
+		}
+	}
+	b.kept = b.pending
+	return errors.Join(failed...)
+}
+
+// trimBacklog drops the oldest of the unsent partitions until no more than
+// bigQueryBacklog batches of rows are kept.
+func (b *bigQuerySink) trimBacklog(unsent []string) []error {
+	var dropped []error
+	for _, partition := range unsent {
+		if b.pending <= bigQueryBacklog*b.batch {
+			break
+		}
+		count := len(b.rows[partition])
+		delete(b.rows, partition)
+		b.pending -= count
+		dropped = append(dropped, fmt.Errorf("dropped %d rows for BigQuery partition %q after failing to send them", count, partition))
+	}
+	return dropped
+}
+
+// bigQueryRejection is BigQuery refusing rows it was sent.
+type bigQueryRejection string
+
+func (r bigQueryRejection) Error() string {
+	return string(r)
+}
+
+// insert sends the rows of a partition, "" being the table itself, all but
+// those BigQuery rejects going in.
+func (b *bigQuerySink) insert(partition string, batch []map[string]interface{}) error {
+	token, err := googleToken()
+	if err != nil {
+		return err
+	}
+	var result struct {
+		InsertErrors []struct {
+			Index  int `json:"index"`
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	insert := map[string]interface{}{"rows": batch, "skipInvalidRows": true}
+	if err := sendJSON(http.MethodPost, b.endpoint+url.PathEscape(partition)+"/insertAll", token, insert, &result); err != nil {
+		return err
+	}
+	if len(result.InsertErrors) > 0 {
+		first := result.InsertErrors[0]
+		message := ""
+		if len(first.Errors) > 0 {
+			message = first.Errors[0].Message
+		}
+		return bigQueryRejection(fmt.Sprintf("BigQuery rejected %d of %d rows for %q and inserted the rest, first at %d: %s", len(result.InsertErrors), len(batch), partition, first.Index, message))
+	}
+	return nil
+}
+
+func (b *bigQuerySink) close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.flush()
+}
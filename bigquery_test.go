@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBigQuery answers insertAll with whatever respond says for the
+// partition, noting the partitions that got their rows in.
+type fakeBigQuery struct {
+	lock     sync.Mutex
+	inserted []string
+	respond  func(partition string) (int, string)
+}
+
+func (f *fakeBigQuery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	partition := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/tables/events"), "/insertAll")
+	status, body := f.respond(partition)
+	if status == http.StatusOK && body == "{}" {
+		f.lock.Lock()
+		f.inserted = append(f.inserted, partition)
+		f.lock.Unlock()
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+func newTestBigQuery(t *testing.T, fake *fakeBigQuery) *bigQuerySink {
+	t.Helper()
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "token")
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	b, err := newBigQuerySink("project.dataset.events", "host", 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.endpoint = server.URL + "/tables/events"
+	return b
+}
+
+func batchRows(b *bigQuerySink, partition string, count int) {
+	for i := 0; i < count; i++ {
+		b.rows[partition] = append(b.rows[partition], map[string]interface{}{"json": map[string]interface{}{"line": "x"}})
+		b.pending++
+	}
+}
+
+func TestBigQueryKeepsUnsentRowsForTheNextFlush(t *testing.T) {
+	up := false
+	fake := &fakeBigQuery{respond: func(string) (int, string) {
+		if !up {
+			return http.StatusServiceUnavailable, `{"error":{"message":"down"}}`
+		}
+		return http.StatusOK, "{}"
+	}}
+	b := newTestBigQuery(t, fake)
+	batchRows(b, "$20240310", 1)
+	batchRows(b, "$20240311", 2)
+
+	if err := b.flush(); err == nil {
+		t.Fatal("flush to a BigQuery that is down succeeded")
+	}
+	if b.pending != 3 || len(b.rows) != 2 {
+		t.Fatalf("after failing kept %d rows in %d partitions, want 3 in 2", b.pending, len(b.rows))
+	}
+
+	up = true
+	if err := b.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if b.pending != 0 || len(b.rows) != 0 {
+		t.Errorf("after sending kept %d rows in %d partitions, want none", b.pending, len(b.rows))
+	}
+	if got := strings.Join(fake.inserted, " "); got != "$20240310 $20240311" {
+		t.Errorf("inserted into %q, want both partitions", got)
+	}
+}
+
+func TestBigQueryDropsRejectedRowsAndSendsTheRest(t *testing.T) {
+	fake := &fakeBigQuery{respond: func(partition string) (int, string) {
+		if partition == "$20240310" {
+			return http.StatusOK, `{"insertErrors":[{"index":0,"errors":[{"message":"no such field"}]}]}`
+		}
+		return http.StatusOK, "{}"
+	}}
+	b := newTestBigQuery(t, fake)
+	batchRows(b, "$20240310", 1)
+	batchRows(b, "$20240311", 1)
+
+	err := b.flush()
+	if err == nil || !strings.Contains(err.Error(), "no such field") {
+		t.Fatalf("flush returned %v, want the rejection", err)
+	}
+	if b.pending != 0 || len(b.rows) != 0 {
+		t.Errorf("kept %d rejected rows, want them dropped", b.pending)
+	}
+	if got := strings.Join(fake.inserted, " "); got != "$20240311" {
+		t.Errorf("inserted into %q, want the partition after the rejected one", got)
+	}
+}
+
+func TestBigQueryBacklogIsBounded(t *testing.T) {
+	fake := &fakeBigQuery{respond: func(string) (int, string) {
+		return http.StatusServiceUnavailable, `{"error":{"message":"down"}}`
+	}}
+	b := newTestBigQuery(t, fake)
+	batchRows(b, "$20240310", bigQueryBacklog*b.batch)
+	batchRows(b, "$20240311", 1)
+
+	err := b.flush()
+	if err == nil || !strings.Contains(err.Error(), "dropped") {
+		t.Fatalf("flush returned %v, want rows dropped", err)
+	}
+	if b.pending > bigQueryBacklog*b.batch {
+		t.Errorf("kept %d rows, more than the backlog of %d", b.pending, bigQueryBacklog*b.batch)
+	}
+}
+
+func TestBigQueryInsertsGoodRowsAroundRejectedOnesByRecordID(t *testing.T) {
+	var sent struct {
+		SkipInvalidRows bool `json:"skipInvalidRows"`
+		Rows            []struct {
+			InsertID string `json:"insertId"`
+		} `json:"rows"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&sent); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "token")
+	b, err := newBigQuerySink("project.dataset.events", "host", 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.endpoint = server.URL + "/tables/events"
+
+	if err := b.send(event{id: "0123abcd", record: record{time: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	if !sent.SkipInvalidRows {
+		t.Error("insert didn't skip invalid rows, so one bad row fails its whole batch")
+	}
+	if len(sent.Rows) != 1 || sent.Rows[0].InsertID != "0123abcd" {
+		t.Errorf("sent rows %+v, want one with the record id as its insertId", sent.Rows)
+	}
+}
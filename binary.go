@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// The compact binary formats write a record per pair, each prefixed with its
+// length as a varint the way protobuf's writeDelimitedTo frames messages, so
+// a reader can skip or hand off records without decoding them.
+
+// framedWriter writes the record encode makes of each pair after its length.
+type framedWriter struct {
+	buffered *bufio.Writer
+	encode   func(record []byte, p pair) []byte
+	record   []byte
+	length   []byte
+}
+
+func (f *framedWriter) write(p pair) error {
+	f.record = f.encode(f.record[:0], p)
+	return f.frame(f.record)
+}
+
+// frame writes record after its length.
+func (f *framedWriter) frame(record []byte) error {
+	f.length = binary.AppendUvarint(f.length[:0], uint64(len(record)))
+	f.buffered.Write(f.length)
+	_, err := f.buffered.Write(record)
+	return err
+}
+
+func (f *framedWriter) close() error {
+	return f.buffered.Flush()
+}
+
+// newMessagePackWriter writes each pair as a MessagePack array of from, to,
+// then count when counted and last_seen and expires when stamped. The arrays
+// have no room for the schema version, so the stream starts with a map of
+// it, schema_version, instead.
+func newMessagePackWriter(w io.Writer, counted, stamped bool) (pairWriter, error) {
+	fields := byte(2)
+	if counted {
+		fields++
+	}
+	if stamped {
+		fields += 2
+	}
+	f := &framedWriter{buffered: bufio.NewWriter(w), encode: func(record []byte, p pair) []byte {
+		record = append(record, 0x90|fields)
+		record = msgpackString(record, p.from)
+		record = msgpackString(record, p.to)
+		if counted {
+			record = append(record, 0xcf)
+			record = binary.BigEndian.AppendUint64(record, uint64(p.count))
+		}
+		if stamped {
+			record = msgpackString(record, p.lastSeen)
+			record = msgpackString(record, p.expires)
+		}
+		return record
+	}}
+	header := msgpackString([]byte{0x81}, "schema_version")
+	header = append(header, 0xcf)
+	header = binary.BigEndian.AppendUint64(header, outputSchemaVersion)
+	return f, f.frame(header)
+}
+
+// newProtobufWriter writes each pair as the Pair message in pair.proto,
+// leaving out the fields that aren't set, and the schema version on the
+// first.
+func newProtobufWriter(w io.Writer, counted, stamped bool) (pairWriter, error) {
+	versioned := false
+	return &framedWriter{buffered: bufio.NewWriter(w), encode: func(record []byte, p pair) []byte {
+		record = protobufString(record, 1, p.from)
+		record = protobufString(record, 2, p.to)
+		if p.count > 0 {
+			record = binary.AppendUvarint(record, 3<<3)
+			record = binary.AppendUvarint(record, uint64(p.count))
+		}
+		if p.lastSeen != "" {
+			record = protobufString(record, 4, p.lastSeen)
+		}
+		if p.expires != "" {
+			record = protobufString(record, 5, p.expires)
+		}
+		if !versioned {
+			record = binary.AppendUvarint(record, 6<<3)
+			record = binary.AppendUvarint(record, outputSchemaVersion)
+			versioned = true
+		}
+		return record
+	}}, nil
+}
+
+func msgpackString(b []byte, s string) []byte {
+	switch {
+	case len(s) < 32:
+		b = append(b, 0xa0|byte(len(s)))
+	case len(s) <= math.MaxUint8:
+		b = append(b, 0xd9, byte(len(s)))
+	case len(s) <= math.MaxUint16:
+		b = append(b, 0xda)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	default:
+		b = append(b, 0xdb)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	}
+	return append(b, s...)
+}
+
+func protobufString(b []byte, field uint64, s string) []byte {
+	b = binary.AppendUvarint(b, field<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readMessagePack(r *bufio.Reader, fn func(p pair) error) (string, error) {
+	return readFramed(r, decodeMessagePack, fn)
+}
+
+func readProtobuf(r *bufio.Reader, fn func(p pair) error) (string, error) {
+	return readFramed(r, decodeProtobuf, fn)
+}
+
+// readFramed reads back length prefixed records, calling fn with the pair
+// decode finds in each, and returns the schema version the first to have
+// one had. A record with a version and no pair only heads the stream.
+func readFramed(r *bufio.Reader, decode func(record []byte) (pair, string, error), fn func(p pair) error) (string, error) {
+	var version string
+	var record []byte
+	for {
+		length, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return version, nil
+		}
+		if err != nil {
+			return version, err
+		}
+		if length > 1<<24 {
+			return version, fmt.Errorf("record of %d bytes is too big", length)
+		}
+		if uint64(cap(record)) < length {
+			record = make([]byte, length)
+		}
+		record = record[:length]
+		if _, err := io.ReadFull(r, record); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return version, err
+		}
+		p, recordVersion, err := decode(record)
+		if err != nil {
+			return version, err
+		}
+		if recordVersion != "" && version == "" {
+			version = recordVersion
+		}
+		if recordVersion != "" && p.from == "" {
+			continue
+		}
+		if err := fn(p); err != nil {
+			return version, err
+		}
+	}
+}
+
+// decodeMessagePack decodes a record newMessagePackWriter wrote: the map
+// heading the stream, or from and to, then a count if the next item is an
+// integer, then last_seen and expires if there are two more.
+func decodeMessagePack(record []byte) (pair, string, error) {
+	if len(record) > 0 && record[0]&0xf0 == 0x80 {
+		version, err := decodeMessagePackHeader(record)
+		return pair{}, version, err
+	}
+	if len(record) == 0 || record[0]&0xf0 != 0x90 || record[0]&0x0f < 2 {
+		return pair{}, "", errors.New("msgpack record is not an array of at least two")
+	}
+	items := int(record[0] & 0x0f)
+	rest := record[1:]
+	var strs []string
+	var p pair
+	for i := 0; i < items; i++ {
+		if len(rest) == 0 {
+			return pair{}, "", io.ErrUnexpectedEOF
+		}
+		if count, after, ok := msgpackReadUint(rest); ok && i == 2 {
+			p.count = int64(count)
+			rest = after
+			continue
+		}
+		s, after, err := msgpackReadString(rest)
+		if err != nil {
+			return pair{}, "", err
+		}
+		strs = append(strs, s)
+		rest = after
+	}
+	if len(rest) > 0 {
+		return pair{}, "", errors.New("msgpack record has bytes after its array")
+	}
+	switch len(strs) {
+	case 4:
+		p.lastSeen, p.expires = strs[2], strs[3]
+	case 2:
+	default:
+		return pair{}, "", errors.New("msgpack record has the wrong number of strings")
+	}
+	p.from, p.to = strs[0], strs[1]
+	return p, "", nil
+}
+
+// decodeMessagePackHeader finds the schema version in the map heading a
+// msgpack stream.
+func decodeMessagePackHeader(record []byte) (string, error) {
+	items := int(record[0] & 0x0f)
+	rest := record[1:]
+	var version string
+	for i := 0; i < items; i++ {
+		key, after, err := msgpackReadString(rest)
+		if err != nil {
+			return "", err
+		}
+		if len(after) == 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		value, after, ok := msgpackReadUint(after)
+		if !ok {
+			return "", fmt.Errorf("msgpack header %s is not an integer", key)
+		}
+		if key == "schema_version" {
+			version = strconv.FormatUint(value, 10)
+		}
+		rest = after
+	}
+	return version, nil
+}
+
+func msgpackReadUint(b []byte) (uint64, []byte, bool) {
+	switch {
+	case b[0] < 0x80:
+		return uint64(b[0]), b[1:], true
+	case b[0] == 0xcc && len(b) >= 2:
+		return uint64(b[1]), b[2:], true
+	case b[0] == 0xcd && len(b) >= 3:
+		return uint64(binary.BigEndian.Uint16(b[1:])), b[3:], true
+	case b[0] == 0xce && len(b) >= 5:
+		return uint64(binary.BigEndian.Uint32(b[1:])), b[5:], true
+	case b[0] == 0xcf && len(b) >= 9:
+		return binary.BigEndian.Uint64(b[1:]), b[9:], true
+	}
+	return 0, b, false
+}
+
+func msgpackReadString(b []byte) (string, []byte, error) {
+	if len(b) == 0 {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	var length, header int
+	switch {
+	case b[0]&0xe0 == 0xa0:
+		length, header = int(b[0]&0x1f), 1
+	case b[0] == 0xd9 && len(b) >= 2:
+		length, header = int(b[1]), 2
+	case b[0] == 0xda && len(b) >= 3:
+		length, header = int(binary.BigEndian.Uint16(b[1:])), 3
+	case b[0] == 0xdb && len(b) >= 5:
+		length, header = int(binary.BigEndian.Uint32(b[1:])), 5
+	default:
+		return "", nil, errors.New("msgpack record holds something other than a string")
+	}
+	if len(b)-header < length {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	return string(b[header : header+length]), b[header+length:], nil
+}
+
+// decodeProtobuf decodes a Pair message, and the schema version the first
+// has, skipping fields it doesn't know.
+func decodeProtobuf(record []byte) (pair, string, error) {
+	var p pair
+	var version string
+	for len(record) > 0 {
+		key, n := binary.Uvarint(record)
+		if n <= 0 {
+			return pair{}, "", errors.New("protobuf record has a bad field key")
+		}
+		record = record[n:]
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(record)
+			if n <= 0 {
+				return pair{}, "", errors.New("protobuf record has a bad varint")
+			}
+			record = record[n:]
+			switch key >> 3 {
+			case 3:
+				p.count = int64(value)
+			case 6:
+				version = strconv.FormatUint(value, 10)
+			}
+		case 2:
+			length, n := binary.Uvarint(record)
+			if n <= 0 || uint64(len(record)-n) < length {
+				return pair{}, "", errors.New("protobuf record has a bad length")
+			}
+			value := string(record[n : n+int(length)])
+			record = record[n+int(length):]
+			switch key >> 3 {
+			case 1:
+				p.from = value
+			case 2:
+				p.to = value
+			case 4:
+				p.lastSeen = value
+			case 5:
+				p.expires = value
+			}
+		default:
+			return pair{}, "", fmt.Errorf("protobuf record has unexpected wire type %d", key&7)
+		}
+	}
+	return p, version, nil
+}
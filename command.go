@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// commands are run instead of crunching logs when named by the first
+// argument, each with its own flags after the name.
+var commands = map[string]func(args []string) error{
+	"defaults":        runDefaults,
+	"parse-line":      runParseLine,
+	"prune":           runPrune,
+	"schema":          runSchema,
+	"shell":           runShell,
+	"trends":          runTrends,
+	"validate-output": runValidateOutput,
+}
+
+// runCommand runs the command named by the first argument, if there is one,
+// and reports whether it did.
+func runCommand() bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		return false
+	}
+	if err := command(os.Args[2:]); err != nil {
+		log.Fatal().Str("command", os.Args[1]).Err(err).Msg("Command failed")
+	}
+	return true
+}
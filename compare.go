@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// The -compare filters are a second -email and -ignore configuration run
+// over the same lines as the first, to see what changing them would gain or
+// lose before doing it.
+var (
+	compareFile        string
+	compareEmailRegex  *regexp.Regexp
+	compareIgnoreRegex *regexp.Regexp
+	// compareOnly is the configuration each differing pair is only kept by,
+	// keyed by pair.
+	compareOnly = make(map[string]string)
+	compareLock = sync.Mutex{}
+)
+
+// compareFilters notes the pair if one configuration keeps it and the other
+// doesn't, base being whether the run's own configuration keeps it.
+func compareFilters(from, to []byte, base bool) {
+	other := compareEmailRegex.Match(from) && !compareIgnoreRegex.Match(to)
+	if base == other {
+		return
+	}
+	only := "base"
+	if other {
+		only = "compare"
+	}
+	key := string(bytes.Map(toLower, from)) + pairSeparator + string(bytes.Map(toLower, to))
+	compareLock.Lock()
+	compareOnly[key] = only
+	compareLock.Unlock()
+}
+
+// writeCompare writes a from, to line for each pair only one configuration
+// keeps, saying which.
+func writeCompare(fileName string) error {
+	keys := make([]string, 0, len(compareOnly))
+	for key := range compareOnly {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := csv.NewWriter(outFile)
+	writer.Write([]string{"from", "to", "only"})
+	for _, key := range keys {
+		from, to := splitPair(key)
+		writer.Write([]string{from, to, compareOnly[key]})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	dockerScheme = "docker://"
+	podmanScheme = "podman://"
+)
+
+// containerLogs streams what a container has written to stdout and stderr so
+// far from the docker (or podman's docker compatible) engine API at host,
+// which is a unix:// socket or tcp:// address.
+func containerLogs(host, container string) (io.ReadCloser, error) {
+	client := http.DefaultClient
+	base := "http://engine"
+	switch {
+	case strings.HasPrefix(host, "unix://"):
+		socket := strings.TrimPrefix(host, "unix://")
+		client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}}
+	case strings.HasPrefix(host, "tcp://"):
+		base = "http://" + strings.TrimPrefix(host, "tcp://")
+	default:
+		return nil, fmt.Errorf("unsupported container engine host %q", host)
+	}
+
+	response, err := client.Get(base + "/containers/" + url.PathEscape(container) + "/logs?stdout=1&stderr=1")
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, fmt.Errorf("container engine returned %s: %s", response.Status, bytes.TrimSpace(message))
+	}
+	if response.Header.Get("Content-Type") == "application/vnd.docker.raw-stream" {
+		return response.Body, nil
+	}
+	return &demuxReader{reader: bufio.NewReader(response.Body), closer: response.Body}, nil
+}
+
+// engineHost is where to find the engine for a docker:// or podman:// input,
+// going by the same environment variables as their own command line tools.
+func engineHost(scheme string) string {
+	if scheme == podmanScheme {
+		if host := os.Getenv("CONTAINER_HOST"); host != "" {
+			return host
+		}
+		if runtime := os.Getenv("XDG_RUNTIME_DIR"); runtime != "" && os.Getuid() != 0 {
+			return "unix://" + runtime + "/podman/podman.sock"
+		}
+		return "unix:///run/podman/podman.sock"
+	}
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		return host
+	}
+	return "unix:///var/run/docker.sock"
+}
+
+// demuxReader strips the 8 byte stream headers the engine puts in front of
+// each chunk of output from a container without a TTY. A stream that doesn't
+// start with a header is passed through as it is.
+type demuxReader struct {
+	reader    *bufio.Reader
+	closer    io.Closer
+	remaining uint32
+	raw       bool
+	started   bool
+}
+
+func (d *demuxReader) Read(p []byte) (int, error) {
+	if !d.started {
+		d.started = true
+		header, err := d.reader.Peek(8)
+		d.raw = err != nil || header[0] > 2 || header[1] != 0 || header[2] != 0 || header[3] != 0
+	}
+	if d.raw {
+		return d.reader.Read(p)
+	}
+
+	for d.remaining == 0 {
+		var header [8]byte
+		if _, err := io.ReadFull(d.reader, header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		d.remaining = binary.BigEndian.Uint32(header[4:])
+	}
+	if uint32(len(p)) > d.remaining {
+		p = p[:d.remaining]
+	}
+	n, err := d.reader.Read(p)
+	d.remaining -= uint32(n)
+	return n, err
+}
+
+func (d *demuxReader) Close() error {
+	return d.closer.Close()
+}
+
+// unframer takes the line framing container runtimes add off log lines: the
+// JSON objects of docker's json-file driver and the timestamp, stream and
+// tag prefix of CRI logs. Both can split a long line over several frames,
+// which are joined back together.
+type unframer struct {
+	partial []byte
+	line    []byte
+}
+
+// unframe returns line without its framing, or nil if it is only part of a
+// line whose rest is still to come. Lines without framing are returned as
+// they are.
+func (u *unframer) unframe(line []byte) []byte {
+	switch {
+	case len(line) > 0 && line[0] == '{':
+		var frame struct {
+			Log string `json:"log"`
+		}
+		if json.Unmarshal(line, &frame) != nil {
+			return line
+		}
+		u.partial = append(u.partial, frame.Log...)
+		if !strings.HasSuffix(frame.Log, "\n") {
+			return nil
+		}
+	case len(line) > 30 && line[10] == 'T':
+		fields := bytes.SplitN(line, []byte(" "), 4)
+		if len(fields) < 4 || (string(fields[2]) != "P" && string(fields[2]) != "F") {
+			return line
+		}
+		u.partial = append(u.partial, fields[3]...)
+		if string(fields[2]) == "P" {
+			u.partial = bytes.TrimSuffix(u.partial, []byte("\n"))
+			return nil
+		}
+	default:
+		return line
+	}
+
+	u.line = append(u.line[:0], u.partial...)
+	u.partial = u.partial[:0]
+	return u.line
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// dedupeKey is what -dedupe makes a row of the output unique by: the pair,
+// today's default, the pair and the day or hour, or the pair and the
+// message, which keeps a row per message.
+var dedupeKey = "pair"
+
+// dedupeRow is a pair on a day, in an hour or in a message, for the finer
+// -dedupe keys.
+type dedupeRow struct {
+	from uint32
+	to   uint32
+	day  int32
+	// start is when the row's hour, or its day in -timezone, began, as unix
+	// seconds, for rows with explicit bucket bounds.
+	start int64
+	id    string
+	seq   int
+}
+
+// dedupe keeps a row for from mailing to in line unless -dedupe day or hour
+// already has one for the day or hour.
+func (r *Runner) dedupe(from, to uint32, line []byte, w *worker) {
+	row := dedupeRow{from: from, to: to, seq: len(r.dedupeRows)}
+	switch dedupeKey {
+	case "day":
+		row.day = w.lineDay(line)
+		if t, ok := w.lineTime(line); ok && reportZone != nil {
+			row.start = dayOf(t).start.Unix()
+		}
+	case "hour":
+		if t, ok := w.lineTime(line); ok {
+			hour := hourOf(t)
+			row.day = hour.dayNumber()
+			row.start = hour.start.Unix()
+		}
+	default:
+		row.day = lineDay(line)
+		row.id = lineID(line)
+	}
+	if dedupeKey == "day" || dedupeKey == "hour" {
+		slot := row.start
+		if slot == 0 {
+			slot = int64(row.day)
+		}
+		slots := r.dedupeSlots[pairID(from, to)]
+		if slots == nil {
+			slots = make(map[int64]bool)
+			r.dedupeSlots[pairID(from, to)] = slots
+		}
+		if slots[slot] {
+			return
+		}
+		slots[slot] = true
+	}
+	r.dedupeRows = append(r.dedupeRows, row)
+}
+
+// eachDedupeRow calls fn with a pair for every row, a sender at a time in
+// the order senders were first seen, and stops at the first error.
+func (r *Runner) eachDedupeRow(fn func(p pair) error) error {
+	order := make(map[uint32]int)
+	r.emails.Each(func(from uint32, recipients []uint32) bool {
+		order[from] = len(order)
+		return true
+	})
+	sort.Slice(r.dedupeRows, func(i, j int) bool {
+		a, b := r.dedupeRows[i], r.dedupeRows[j]
+		if a.from != b.from {
+			return order[a.from] < order[b.from]
+		}
+		if a.day != b.day {
+			return a.day < b.day
+		}
+		if a.start != b.start {
+			return a.start < b.start
+		}
+		return a.seq < b.seq
+	})
+	for _, row := range r.dedupeRows {
+		if !r.frequent(row.from, row.to) {
+			continue
+		}
+		p := pair{from: r.emails.Name(row.from), to: r.emails.Name(row.to), message: row.id}
+		if row.day != 0 {
+			p.day = time.Unix(int64(row.day)*86400, 0).UTC().Format(dateLayout)
+		}
+		if row.start != 0 {
+			b := dayOf(time.Unix(row.start, 0))
+			if dedupeKey == "hour" {
+				b = hourOf(time.Unix(row.start, 0))
+			}
+			p.start = b.start.Format(time.RFC3339)
+			p.end = b.end.Format(time.RFC3339)
+		}
+		if retentionDays > 0 {
+			p.stamp(r.lastSeen[pairID(row.from, row.to)])
+		}
+		if examplesPerPair > 0 {
+			p.examples = r.pairExamples[pairID(row.from, row.to)].lines()
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lineDay is the day line was logged on, as days since the epoch, or 0 if
+// it doesn't start with a date.
+func lineDay(line []byte) int32 {
+	if len(line) < len(dateLayout) {
+		return 0
+	}
+	day, err := time.Parse(dateLayout, string(line[:len(dateLayout)]))
+	if err != nil {
+		return 0
+	}
+	return int32(day.Unix() / 86400)
+}
+
+// lineDay is the day line was logged on: its date as written or, with
+// -timezone, the date it was in that zone.
+func (w *worker) lineDay(line []byte) int32 {
+	if reportZone == nil {
+		return lineDay(line)
+	}
+	t, ok := w.lineTime(line)
+	if !ok {
+		return 0
+	}
+	return dayOf(t).dayNumber()
+}
+
+// lineID is the exim message id in line, which comes within the first few
+// words after the timestamp.
+func lineID(line []byte) string {
+	if len(line) < len(timestampLayout) {
+		return ""
+	}
+	rest := string(line[len(timestampLayout):])
+	for i := 0; i < 4; i++ {
+		var word string
+		word, rest = nextWord(rest)
+		if profile.messageID.MatchString(word) {
+			return word
+		}
+	}
+	return ""
+}
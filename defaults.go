@@ -0,0 +1,52 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// defaults are the files built into the binary, so it runs with nothing
+// beside it, that exim defaults export writes out to be customised.
+//
+//go:embed defaults
+var defaults embed.FS
+
+// runDefaults runs the defaults subcommand named by the first of args.
+// Export writes each of the built in files into a directory, leaving any
+// already there alone unless -force is given.
+func runDefaults(args []string) error {
+	if len(args) == 0 || args[0] != "export" {
+		return errors.New("defaults needs the export subcommand")
+	}
+	flags := flag.NewFlagSet("defaults export", flag.ExitOnError)
+	dir := flags.String("dir", ".", "The directory to write the defaults into")
+	force := flags.Bool("force", false, "Overwrite files already in the directory")
+	flags.Parse(args[1:])
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+	return fs.WalkDir(defaults, "defaults", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		fileName := filepath.Join(*dir, filepath.Base(name))
+		if _, err := os.Stat(fileName); err == nil && !*force {
+			return fmt.Errorf("%s already exists, pass -force to overwrite it", fileName)
+		}
+		content, err := defaults.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(fileName, content, 0644); err != nil {
+			return err
+		}
+		fmt.Println(fileName)
+		return nil
+	})
+}
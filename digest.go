@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// contact is an external address an internal user corresponded with, when
+// first in the window and which way.
+type contact struct {
+	address string
+	first   string
+	sent    bool
+}
+
+var (
+	digestFile = ""
+	// knownPairs are the pairs of a previous output, from\x00to, which the
+	// digest doesn't count as new.
+	knownPairs = make(map[string]bool)
+)
+
+// loadKnownPairs reads the pairs of a previous output, in any format, as the
+// correspondence the digest already knew about.
+func loadKnownPairs(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	format := detectFormat(reader)
+	if format == "grouped" {
+		return readGrouped(reader, func(from string, to []string) {
+			if len(to) == 2 && !strings.Contains(to[1], "@") {
+				if _, err := strconv.ParseInt(to[1], 10, 64); err == nil {
+					to = to[:1]
+				}
+			}
+			for _, address := range to {
+				knownPairs[from+pairSeparator+address] = true
+			}
+		})
+	}
+	_, err = pairReaders[format](reader, func(p pair) error {
+		knownPairs[p.from+pairSeparator+p.to] = true
+		return nil
+	})
+	return err
+}
+
+// firstContact notes when from first mailed to in line, if one of them is
+// ours and the other isn't.
+func (r *Runner) firstContact(fromID, toID uint32, from, to []byte, line []byte) {
+	if isInternal(string(from)) == isInternal(string(to)) {
+		return
+	}
+	id := pairID(fromID, toID)
+	if _, ok := r.firstContacts[id]; ok {
+		return
+	}
+	first := ""
+	if len(line) >= len(timestampLayout) {
+		first = string(line[:len(timestampLayout)])
+	}
+	r.firstContacts[id] = first
+}
+
+// writeDigest writes, for each internal user, the external addresses they
+// mailed or were mailed by for the first time, leaving out any pair either
+// way round in the -digest-known output.
+func writeDigest(fileName string, r *Runner) error {
+	emails := r.emails
+	users := make(map[string][]contact)
+	emails.Each(func(from uint32, recipients []uint32) bool {
+		for _, to := range recipients {
+			first, ok := r.firstContacts[pairID(from, to)]
+			if !ok {
+				continue
+			}
+			fromName, toName := emails.Name(from), emails.Name(to)
+			if knownPairs[fromName+pairSeparator+toName] || knownPairs[toName+pairSeparator+fromName] {
+				continue
+			}
+			if isInternal(fromName) {
+				users[fromName] = append(users[fromName], contact{address: toName, first: first, sent: true})
+			} else {
+				users[toName] = append(users[toName], contact{address: fromName, first: first})
+			}
+		}
+		return true
+	})
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := bufio.NewWriter(outFile)
+	for i, name := range names {
+		contacts := mergeContacts(users[name])
+		if i > 0 {
+			fmt.Fprintln(writer)
+		}
+		fmt.Fprintf(writer, "%s, new correspondents: %d\n", name, len(contacts))
+		for _, c := range contacts {
+			way := "from"
+			if c.sent {
+				way = "to"
+			}
+			fmt.Fprintf(writer, "  %s %s, first %s\n", way, c.address, c.first)
+		}
+	}
+	return writer.Flush()
+}
+
+// mergeContacts keeps the first contact with each address, whichever way it
+// went, in the order they were first made.
+func mergeContacts(contacts []contact) []contact {
+	sort.SliceStable(contacts, func(i, j int) bool {
+		if contacts[i].address != contacts[j].address {
+			return contacts[i].address < contacts[j].address
+		}
+		return contacts[i].first < contacts[j].first
+	})
+	merged := contacts[:0]
+	for _, c := range contacts {
+		if len(merged) == 0 || merged[len(merged)-1].address != c.address {
+			merged = append(merged, c)
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].first < merged[j].first })
+	return merged
+}
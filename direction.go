@@ -0,0 +1,49 @@
+package main
+
+import "strings"
+
+var (
+	internalDomains = make(map[string]bool)
+	// directionFilter is the only direction of mail grouped, if set.
+	directionFilter string
+)
+
+// setInternalDomains takes a comma separated list of the domains that are
+// ours, which decides what counts as inbound or outbound mail.
+func setInternalDomains(list string) {
+	for _, domain := range strings.Split(list, ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			internalDomains[domain] = true
+		}
+	}
+}
+
+// isInternal reports whether address is at one of our domains or one of
+// their subdomains.
+func isInternal(address string) bool {
+	domain := domainOf(address)
+	for {
+		if internalDomains[domain] {
+			return true
+		}
+		dot := strings.IndexByte(domain, '.')
+		if dot < 0 {
+			return false
+		}
+		domain = domain[dot+1:]
+	}
+}
+
+// direction is which way mail from one address to another is going:
+// inbound, outbound, internal, or relay when neither end is ours.
+func direction(from, to string) string {
+	switch fromUs, toUs := isInternal(from), isInternal(to); {
+	case fromUs && toUs:
+		return "internal"
+	case fromUs:
+		return "outbound"
+	case toUs:
+		return "inbound"
+	}
+	return "relay"
+}
@@ -0,0 +1,53 @@
+#!/bin/sh
+# Sends e2e/messages through exim over SMTP, crunches the mainlog it wrote
+# as the release of exim that wrote it and checks the senders and recipients
+# crunched are those of e2e/expected, without any warnings.
+set -eu
+
+# The release, e.g. 4.97 from "Exim version 4.97 #2 built ...", to crunch
+# the mainlog as.
+version=$(exim -bV | sed -n 's/^Exim version \([0-9]*\.[0-9]*\).*/\1/p')
+echo "Exim $version"
+exim -bd -q30m
+
+tries=0
+until swaks --server 127.0.0.1 --quit-after EHLO >/dev/null 2>&1; do
+	tries=$((tries + 1))
+	if [ "$tries" -ge 30 ]; then
+		echo "exim never started listening" >&2
+		exit 1
+	fi
+	sleep 1
+done
+
+grep -v '^#' /e2e/messages | while read -r from to; do
+	swaks --server 127.0.0.1 --from "$from" --to "$to" --header "Subject: e2e" >/dev/null
+done
+sent=$(grep -vc '^#' /e2e/messages)
+
+# Wait for exim to log every arrival before crunching.
+tries=0
+until [ "$(grep -c ' <= ' /var/log/exim4/mainlog || true)" -ge "$sent" ]; do
+	tries=$((tries + 1))
+	if [ "$tries" -ge 30 ]; then
+		echo "exim logged fewer than $sent arrivals" >&2
+		cat /var/log/exim4/mainlog >&2
+		exit 1
+	fi
+	sleep 1
+done
+
+cd /tmp
+exim-crunch -files /var/log/exim4/mainlog -out /tmp/crunched.csv -exim-version "$version" -level warn 2> /tmp/crunch.log
+if [ -s /tmp/crunch.log ]; then
+	echo "Crunching as exim $version warned:" >&2
+	cat /tmp/crunch.log >&2
+	exit 1
+fi
+awk -F, '{ for (i = 2; i <= NF; i++) print $1 "," $i }' /tmp/crunched.csv | sort > /tmp/crunched
+if ! sort /e2e/expected | diff -u - /tmp/crunched; then
+	echo "Crunched relationships differ from e2e/expected, the mainlog was:" >&2
+	cat /var/log/exim4/mainlog >&2
+	exit 1
+fi
+echo "Crunched the expected $(wc -l < /tmp/crunched) relationships from $sent messages"
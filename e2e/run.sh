@@ -0,0 +1,15 @@
+#!/bin/sh
+# Builds the e2e image and runs it, failing unless the cruncher gets back the
+# relationships of the messages sent through exim. It checks each image in
+# e2e/versions, or just those passed, e.g. e2e/run.sh debian:trixie-slim.
+set -eu
+
+cd "$(dirname "$0")/.."
+engine=${ENGINE:-docker}
+images=${*:-$(grep -v '^#' e2e/versions)}
+
+for image in $images; do
+	echo "Checking $image"
+	$engine build -f e2e/Dockerfile --build-arg EXIM_IMAGE="$image" -t exim-e2e .
+	$engine run --rm exim-e2e
+done
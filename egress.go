@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// asnRange is a line of an ip2asn TSV file: the addresses from start to end
+// are announced by asn, registered in country.
+type asnRange struct {
+	start   netip.Addr
+	end     netip.Addr
+	asn     string
+	country string
+	name    string
+}
+
+// egress is where the mail of a sender domain went, by country and ASN.
+type egress struct {
+	domain  string
+	country string
+	asn     string
+}
+
+var (
+	egressFile = ""
+	asnRanges  []asnRange
+	// egressSenders is the sender domain of each message in flight.
+	egressSenders = newInFlight()
+	egressCounts  = make(map[egress]int)
+	asnNames      = make(map[string]string)
+	egressLock    = sync.Mutex{}
+)
+
+// loadASNRanges reads an ip2asn TSV file, as iptoasn.com publishes,
+// optionally gzipped. Each line is range_start, range_end, AS_number,
+// country_code and AS_description, and ranges announced by no one have AS
+// number 0.
+func loadASNRanges(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if filepath.Ext(fileName) == ".gz" {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	scanner := bufio.NewScanner(reader)
+	for number := 1; scanner.Scan(); number++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 4 {
+			continue
+		}
+		start, startErr := netip.ParseAddr(fields[0])
+		end, endErr := netip.ParseAddr(fields[1])
+		if startErr != nil || endErr != nil || end.Less(start) {
+			return fmt.Errorf("line %d of %s is not a range of addresses", number, fileName)
+		}
+		if fields[2] == "0" {
+			continue
+		}
+		r := asnRange{start: start, end: end, asn: fields[2], country: fields[3]}
+		if len(fields) > 4 {
+			r.name = fields[4]
+		}
+		asnRanges = append(asnRanges, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	sort.Slice(asnRanges, func(i, j int) bool { return asnRanges[i].start.Less(asnRanges[j].start) })
+	return nil
+}
+
+// lookupASN finds the range holding ip, if any.
+func lookupASN(ip string) (asnRange, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return asnRange{}, false
+	}
+	addr = addr.Unmap()
+	i := sort.Search(len(asnRanges), func(i int) bool { return addr.Less(asnRanges[i].start) })
+	if i == 0 || asnRanges[i-1].end.Less(addr) {
+		return asnRange{}, false
+	}
+	return asnRanges[i-1], true
+}
+
+// checkEgress notes the sender domain of each message as it arrives and
+// counts each of its deliveries to a remote host under the country and ASN
+// of the host's IP.
+func checkEgress(r record) {
+	if r.id == "" {
+		return
+	}
+
+	egressLock.Lock()
+	defer egressLock.Unlock()
+	switch {
+	case r.flag == "<=":
+		egressSenders.track(r.id, domainOf(r.address))
+	case r.flag == "=>" || r.flag == "->":
+		domain, ok := egressSenders.get(r.id)
+		ip := r.ip()
+		if !ok || ip == "" || isInternal(r.address) {
+			return
+		}
+		key := egress{domain: domain.(string), country: "unknown", asn: "unknown"}
+		if found, ok := lookupASN(ip); ok {
+			key.country = found.country
+			key.asn = found.asn
+			asnNames[found.asn] = found.name
+		}
+		egressCounts[key]++
+	case r.flag == "" && r.message == "Completed":
+		egressSenders.complete(r.id)
+	}
+}
+
+// writeEgress writes how many deliveries of each sender domain went to each
+// country and ASN as CSV, busiest first within each domain.
+func writeEgress(fileName string) error {
+	keys := make([]egress, 0, len(egressCounts))
+	for key := range egressCounts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].domain != keys[j].domain {
+			return keys[i].domain < keys[j].domain
+		}
+		return egressCounts[keys[i]] > egressCounts[keys[j]]
+	})
+
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := csv.NewWriter(outFile)
+	writer.Write([]string{"sender_domain", "country", "asn", "as_name", "deliveries"})
+	for _, key := range keys {
+		writer.Write([]string{key.domain, key.country, key.asn, asnNames[key.asn], strconv.Itoa(egressCounts[key])})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// enricher adds to an event before it goes to the sinks, such as where the
+// SMTP transcript of its message is kept. Enrichers are used from every
+// worker at once so must be safe for concurrent use.
+type enricher interface {
+	enrich(e *event) error
+}
+
+// transcriptLookup asks a transcript or pcap index service where the SMTP
+// transcript of each message is, by its exim queue id and, on the lines
+// that have it, its Message-ID. The service answers a GET of the -transcripts
+// URL, with {queue} and {message} replaced, with a JSON object whose url is
+// the reference to attach, or 404 when it has no transcript.
+type transcriptLookup struct {
+	template string
+	client   *http.Client
+	lock     sync.Mutex
+	// found are the answers for each message in flight, so each message is
+	// looked up once.
+	found *inFlight
+}
+
+func newTranscriptLookup(template string, timeout time.Duration) (*transcriptLookup, error) {
+	if !strings.Contains(template, "{queue}") && !strings.Contains(template, "{message}") {
+		return nil, fmt.Errorf("transcript URL %q has neither {queue} nor {message} in it", template)
+	}
+	if _, err := url.Parse(strings.NewReplacer("{queue}", "", "{message}", "").Replace(template)); err != nil {
+		return nil, err
+	}
+	return &transcriptLookup{
+		template: template,
+		client:   &http.Client{Timeout: timeout},
+		found:    newInFlight(),
+	}, nil
+}
+
+func (t *transcriptLookup) enrich(e *event) error {
+	queue := e.record.id
+	if queue == "" {
+		return nil
+	}
+	completed := e.record.flag == "" && e.record.message == "Completed"
+	t.lock.Lock()
+	found, ok := t.found.get(queue)
+	if completed {
+		t.found.complete(queue)
+	}
+	t.lock.Unlock()
+	if ok {
+		e.transcript = found.(string)
+		return nil
+	}
+	// A failed lookup is remembered as no transcript too, so a service that
+	// is down costs a message one timeout rather than one a line.
+	reference, err := t.lookup(queue, strings.Trim(e.record.fields["id"], "<>"))
+	if !completed {
+		t.lock.Lock()
+		t.found.track(queue, reference)
+		t.lock.Unlock()
+	}
+	e.transcript = reference
+	return err
+}
+
+func (t *transcriptLookup) lookup(queue, message string) (string, error) {
+	address := strings.NewReplacer("{queue}", url.QueryEscape(queue), "{message}", url.QueryEscape(message)).Replace(t.template)
+	response, err := t.client.Get(address)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return "", fmt.Errorf("transcript lookup returned %s: %s", response.Status, bytes.TrimSpace(message))
+	}
+	var found struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<16)).Decode(&found); err != nil {
+		return "", fmt.Errorf("transcript lookup answer did not parse: %s", err)
+	}
+	return found.URL, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"syscall"
+)
+
+// errorClass splits input errors into those worth retrying, those that
+// will fail the same way every time and those whose content so far is good.
+type errorClass string
+
+const (
+	transientError errorClass = "transient"
+	permanentError errorClass = "permanent"
+	// salvageableError is a gzip file cut short, which reads the same every
+	// time but is kept up to the cut rather than retried.
+	salvageableError errorClass = "salvageable"
+)
+
+var transientErrnos = []syscall.Errno{
+	syscall.EAGAIN,
+	syscall.EINTR,
+	syscall.EIO,
+	syscall.ESTALE,
+	syscall.ETIMEDOUT,
+	syscall.EBUSY,
+}
+
+// classifyError decides whether err reading fileName is a blip (NFS hiccups,
+// a stream cut short), a truncated gzip file to salvage or something
+// retrying will not fix.
+func classifyError(fileName string, err error) errorClass {
+	if isTruncated(fileName, err) {
+		return salvageableError
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return transientError
+	}
+	if errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) {
+		return permanentError
+	}
+
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return transientError
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return transientError
+	}
+	return permanentError
+}
+
+// isTruncated reports whether err is a gzip file ending mid-stream, whose
+// content up to that point is still good.
+func isTruncated(fileName string, err error) bool {
+	return filepath.Ext(fileName) == ".gz" && errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (r *Runner) recordError(class errorClass) {
+	r.statsLock.Lock()
+	r.errorCounts[class]++
+	r.statsLock.Unlock()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+)
+
+// examplesPerPair is how many of the lines each pair was seen on to keep as
+// evidence for it, 0 to keep none.
+var examplesPerPair = 0
+
+// examples keeps the first and last lines a pair was seen on and a uniform
+// random sample of those in between, up to examplesPerPair in all.
+type examples struct {
+	first  string
+	last   string
+	middle []string
+	// between is how many lines there have been between the first and last.
+	between int
+	seen    int
+}
+
+// example keeps line as evidence for the pair from mailing to, if there's
+// room for it.
+func (r *Runner) example(from, to uint32, line []byte) {
+	id := pairID(from, to)
+	e := r.pairExamples[id]
+	if e == nil {
+		e = &examples{}
+		r.pairExamples[id] = e
+	}
+	e.add(strings.TrimRight(string(line), "\r\n"))
+}
+
+func (e *examples) add(line string) {
+	e.seen++
+	switch {
+	case e.seen == 1:
+		e.first = line
+		return
+	case examplesPerPair < 2:
+		return
+	case e.seen > 2:
+		// The line that was last is now one of those in between, so gets its
+		// chance at the reservoir.
+		e.between++
+		if len(e.middle) < examplesPerPair-2 {
+			e.middle = append(e.middle, e.last)
+		} else if i := rand.Intn(e.between); i < len(e.middle) {
+			e.middle[i] = e.last
+		}
+	}
+	e.last = line
+}
+
+// lines are the lines kept, first, then those in between, then last.
+func (e *examples) lines() []string {
+	lines := append([]string{e.first}, e.middle...)
+	if e.seen > 1 && e.last != "" {
+		lines = append(lines, e.last)
+	}
+	return lines
+}
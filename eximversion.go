@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// eximProfile is what the mainlog lines of a range of exim releases look
+// like, where that changed between them.
+type eximProfile struct {
+	// since is the first release, as major and minor, the profile is for.
+	since [2]int
+	// messageID matches the exim ids the releases give messages.
+	messageID *regexp.Regexp
+	// taint matches the errors deliveries fail or defer with for using
+	// tainted data, when the releases check taint.
+	taint *regexp.Regexp
+}
+
+var (
+	// anyMessageID matches the exim ids of every release, the six character
+	// ids of 4.96 and before as well as the longer ones of 4.97 on.
+	anyMessageID = regexp.MustCompile(`^[0-9A-Za-z]{6}-[0-9A-Za-z]{6,11}-[0-9A-Za-z]{2,4}$`)
+	// taintError matches the ways releases have put failing on tainted data:
+	// "Tainted filename for search", "Tainted '/var/mail/x' (file or
+	// directory name for ...) not permitted", "tainted search query is not
+	// properly quoted" and the like.
+	taintError = regexp.MustCompile(`(?i)\btainted\b`)
+
+	// eximProfiles are the releases that changed the mainlog, oldest first.
+	// 4.94 started checking taint and 4.97 lengthened message ids from
+	// 6-6-2 characters to 6-11-4.
+	eximProfiles = []eximProfile{
+		{since: [2]int{4, 0}, messageID: regexp.MustCompile(`^[0-9A-Za-z]{6}-[0-9A-Za-z]{6}-[0-9A-Za-z]{2}$`)},
+		{since: [2]int{4, 94}, messageID: regexp.MustCompile(`^[0-9A-Za-z]{6}-[0-9A-Za-z]{6}-[0-9A-Za-z]{2}$`), taint: taintError},
+		{since: [2]int{4, 97}, messageID: regexp.MustCompile(`^[0-9A-Za-z]{6}-[0-9A-Za-z]{11}-[0-9A-Za-z]{4}$`), taint: taintError},
+	}
+
+	// profile is the one -exim-version picked, or without it one taking the
+	// lines of any release.
+	profile = eximProfile{messageID: anyMessageID, taint: taintError}
+
+	// otherVersionIDs counts the lines whose exim id is one of another
+	// release than -exim-version's, so were crunched as if about no message.
+	otherVersionIDs atomic.Int64
+)
+
+// setEximVersion picks the profile of the release version, given as
+// major.minor with any patch level after it, from those of the releases at
+// or before it, comparing the minor numbers as numbers so 4.100 comes after
+// 4.97.
+func setEximVersion(version string) error {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return fmt.Errorf("%q is not a major.minor exim release", version)
+	}
+	var release [2]int
+	for i := range release {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return fmt.Errorf("%q is not a major.minor exim release", version)
+		}
+		release[i] = n
+	}
+	if release[0] < 4 {
+		return fmt.Errorf("%q is older than exim 4", version)
+	}
+	for _, p := range eximProfiles {
+		if p.since[0] < release[0] || (p.since[0] == release[0] && p.since[1] <= release[1]) {
+			profile = p
+		}
+	}
+	return nil
+}
+
+// isMessageID reports whether word is an exim id of -exim-version's release,
+// counting those that are of another release instead.
+func isMessageID(word string) bool {
+	if profile.messageID.MatchString(word) {
+		return true
+	}
+	if profile.messageID != anyMessageID && anyMessageID.MatchString(word) {
+		otherVersionIDs.Add(1)
+	}
+	return false
+}
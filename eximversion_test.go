@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+)
+
+const (
+	shortID = "1rA001-0001aB-Cd"
+	longID  = "1rA001-0001aBcDeFg-HiJk"
+	// taintText is how releases from 4.94 on fail a delivery to a tainted path.
+	taintText = "Tainted '/var/mail/x' (file or directory name for appendfile) not permitted"
+)
+
+func TestEximVersionProfiles(t *testing.T) {
+	defer func(saved eximProfile) { profile = saved }(profile)
+
+	tests := []struct {
+		version string
+		line    string
+		id      string
+		other   int64
+	}{
+		{"4.93", "2024-03-10 10:00:00 " + shortID + " <= a@corp.com H=h [10.0.0.5] P=esmtp S=1", shortID, 0},
+		{"4.93", "2024-03-10 10:00:00 " + longID + " <= a@corp.com H=h [10.0.0.5] P=esmtp S=1", "", 1},
+		{"4.94", "2024-03-10 10:00:00 " + shortID + " ** x@corp.com R=local T=mailbox: " + taintText, shortID, 0},
+		{"4.94", "2024-03-10 10:00:00 " + longID + " ** x@corp.com R=local T=mailbox: " + taintText, "", 1},
+		{"4.97", "2024-03-10 10:00:00 " + shortID + " => b@ext.com R=dnslookup T=remote_smtp H=mx.ext.com [192.0.2.1]", "", 1},
+		{"4.97", "2024-03-10 10:00:00 " + longID + " => b@ext.com R=dnslookup T=remote_smtp H=mx.ext.com [192.0.2.1]", longID, 0},
+		{"", "2024-03-10 10:00:00 " + shortID + " Completed", shortID, 0},
+		{"", "2024-03-10 10:00:00 " + longID + " Completed", longID, 0},
+	}
+	for _, test := range tests {
+		profile = eximProfile{messageID: anyMessageID, taint: taintError}
+		if test.version != "" {
+			if err := setEximVersion(test.version); err != nil {
+				t.Fatal(err)
+			}
+		}
+		before := otherVersionIDs.Load()
+		r, err := parseLine(test.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.id != test.id {
+			t.Errorf("%s parsed %q with id %q, want %q", test.version, test.line, r.id, test.id)
+		}
+		if other := otherVersionIDs.Load() - before; other != test.other {
+			t.Errorf("%s counted %d ids of another release in %q, want %d", test.version, other, test.line, test.other)
+		}
+	}
+}
+
+func TestEximVersionTaintErrors(t *testing.T) {
+	defer func(saved eximProfile) { profile = saved }(profile)
+
+	tests := []struct {
+		version string
+		taint   bool
+	}{
+		{"4.93", false},
+		{"4.94", true},
+		{"4.97", true},
+	}
+	for _, test := range tests {
+		if err := setEximVersion(test.version); err != nil {
+			t.Fatal(err)
+		}
+		category := categoriseResponse("", "", taintText)
+		if (category == "taint") != test.taint {
+			t.Errorf("%s put %q down to %s", test.version, taintText, category)
+		}
+	}
+}
+
+func TestSetEximVersion(t *testing.T) {
+	defer func(saved eximProfile) { profile = saved }(profile)
+
+	tests := []struct {
+		version string
+		since   [2]int
+		fails   bool
+	}{
+		{version: "4.93", since: [2]int{4, 0}},
+		{version: "4.94.2", since: [2]int{4, 94}},
+		{version: "4.97", since: [2]int{4, 97}},
+		{version: "4.100", since: [2]int{4, 97}},
+		{version: "5.0", since: [2]int{4, 97}},
+		{version: "3.36", fails: true},
+		{version: "4", fails: true},
+		{version: "4.x", fails: true},
+	}
+	for _, test := range tests {
+		err := setEximVersion(test.version)
+		if (err != nil) != test.fails {
+			t.Errorf("setting %q returned %v", test.version, err)
+			continue
+		}
+		if !test.fails && profile.since != test.since {
+			t.Errorf("%q picked the profile since %d.%d, want %d.%d", test.version, profile.since[0], profile.since[1], test.since[0], test.since[1])
+		}
+	}
+}
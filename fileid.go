@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// fileID is the device and inode of a local file, which stays the same
+// whichever hardlink or glob it is reached by and changes when logrotate
+// moves a new file into its place.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// dedupeFiles drops local files that are the same file as one earlier in
+// files, so hardlinks and overlapping globs are only crunched once.
+func dedupeFiles(files []inputFile) []inputFile {
+	seen := make(map[fileID]string)
+	kept := files[:0]
+	for _, file := range files {
+		if !strings.Contains(file.name, "://") {
+			if info, err := os.Stat(file.name); err == nil {
+				if id, ok := identify(info); ok {
+					if first, dupe := seen[id]; dupe {
+						log.Info().Str("name", file.name).Str("same", first).Msg("Skipping file already matched by another name")
+						continue
+					}
+					seen[id] = file.name
+				}
+			}
+		}
+		kept = append(kept, file)
+	}
+	return kept
+}
+
+// refollow works out where to carry on following file from, given it has
+// been read to offset and was id when it was, and reports whether there is
+// a file there to read at all. A file of the same name but a different inode
+// was rotated and a shorter one of the same inode was truncated in place, by
+// copytruncate, and either way it is read again from the start.
+func refollow(file inputFile, offset int64, id *fileID, w *worker) (int64, bool) {
+	info, err := os.Stat(file.name)
+	if err != nil {
+		// Between logrotate moving the old file away and exim creating the
+		// new one there is nothing there, so wait for it to turn up.
+		return offset, false
+	}
+	if current, ok := identify(info); ok && current != *id {
+		w.log.Info().Msg("File was rotated, following the new one")
+		*id = current
+		return 0, true
+	}
+	if info.Size() < offset {
+		w.log.Info().Int64("size", info.Size()).Msg("File was truncated, following it from the start")
+		return 0, true
+	}
+	return offset, true
+}
@@ -0,0 +1,18 @@
+//go:build unix
+// +build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// identify is the device and inode info is for.
+func identify(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// following keeps reading local logs as exim appends to them, and pods'
+	// logs as they are written, until interrupted, instead of stopping at
+	// their ends.
+	following      = false
+	followInterval = time.Second
+)
+
+// canFollow reports whether file is one that grows in place, a local log
+// that isn't compressed, nor rotated when backfilling.
+func canFollow(file inputFile) bool {
+	return following && !strings.Contains(file.name, "://") && filepath.Ext(file.name) != ".gz" &&
+		!(backfill && isRotated(file.name))
+}
+
+// waitToFollow waits a -follow-interval before reading on, and reports
+// false once ctx is done and crunching has been stopped.
+func waitToFollow(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(followInterval):
+		return true
+	}
+}
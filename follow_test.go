@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func appendTo(t *testing.T, name, text string) {
+	t.Helper()
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tail crunches file from offset as a poll while following does, returning
+// the offset it got to.
+func tail(t *testing.T, r *Runner, file inputFile, offset int64) int64 {
+	t.Helper()
+	var times fileTimes
+	var lines int
+	offset, ok := r.crunchFile(file, offset, &times, &lines, newWorker(1, file))
+	if !ok {
+		t.Fatalf("failed to read %s", file.name)
+	}
+	return offset
+}
+
+func TestFollowWaitsForTheRestOfAHalfWrittenLine(t *testing.T) {
+	defer func(saved bool) { following = saved }(following)
+	following = true
+
+	file := inputFile{name: filepath.Join(t.TempDir(), "mainlog"), kind: mainLog}
+	first := "2024-03-10 10:00:00 1rA001-0001aB-Cd <= a@corp.com H=h [10.0.0.5] P=esmtp S=1 for b@ext.com\n"
+	second := "2024-03-10 10:00:01 1rA002-0001aB-Cd <= c@corp.com H=h [10.0.0.5] P=esmtp S=1 for d@ext.com\n"
+	r := NewRunner(context.Background(), Config{Email: regexp.MustCompile(".*"), Ignore: regexp.MustCompile("^$"), Threads: 1})
+
+	// exim has got as far as the sender of the second line.
+	appendTo(t, file.name, first+second[:50])
+	offset := tail(t, r, file, 0)
+	if lines := r.lines.Load(); lines != 1 {
+		t.Fatalf("crunched %d lines of one and a half, want the whole one", lines)
+	}
+	if offset != int64(len(first)) {
+		t.Errorf("got to offset %d, want the start of the half written line at %d", offset, len(first))
+	}
+
+	appendTo(t, file.name, second[50:])
+	offset = tail(t, r, file, offset)
+	if lines := r.lines.Load(); lines != 2 {
+		t.Errorf("crunched %d lines once the second was whole, want 2", lines)
+	}
+	if offset != int64(len(first+second)) {
+		t.Errorf("got to offset %d, want the end at %d", offset, len(first+second))
+	}
+	if got, want := grouped(t, r), "a@corp.com,b@ext.com\nc@corp.com,d@ext.com\n"; got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
+
+func TestUnterminatedLastLineIsCrunchedWhenNotFollowing(t *testing.T) {
+	file := inputFile{name: filepath.Join(t.TempDir(), "mainlog"), kind: mainLog}
+	appendTo(t, file.name, "2024-03-10 10:00:00 1rA001-0001aB-Cd <= a@corp.com H=h [10.0.0.5] P=esmtp S=1 for b@ext.com")
+	r := NewRunner(context.Background(), Config{Email: regexp.MustCompile(".*"), Ignore: regexp.MustCompile("^$"), Threads: 1})
+
+	tail(t, r, file, 0)
+	if lines := r.lines.Load(); lines != 1 {
+		t.Errorf("crunched %d lines, want the one without a newline", lines)
+	}
+	if got, want := grouped(t, r), "a@corp.com,b@ext.com\n"; got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import "syscall"
+
+// freeSpace is how many bytes are free to unprivileged users on the
+// filesystem dir is on.
+func freeSpace(dir string) (uint64, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, false
+	}
+	return stat.Bavail * uint64(stat.Bsize), true
+}
@@ -0,0 +1,69 @@
+//go:build gofuzz
+// +build gofuzz
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// The fuzz targets run the parts of crunching that see what senders control,
+// addresses and HELO names among them, over whatever go-fuzz makes up. Build
+// and run one with the seed corpus in testdata/fuzz:
+//
+//	go-fuzz-build -func FuzzParseLine
+//	go-fuzz -workdir testdata/fuzz
+//
+// They return 1 for input worth keeping in the corpus, and panic on anything
+// the crunch would get wrong rather than only on what crashes it.
+
+// FuzzParseLine parses data as a mainlog line and reads every part of the
+// record the sinks and reports go on to use.
+func FuzzParseLine(data []byte) int {
+	r, err := parseLine(string(data))
+	if err != nil {
+		return 0
+	}
+	if r.fields == nil {
+		panic("parsed record has no fields")
+	}
+	if r.id != "" && !profile.messageID.MatchString(r.id) {
+		panic(fmt.Sprintf("parsed exim id %q doesn't look like one", r.id))
+	}
+	r.host()
+	r.ip()
+	eventDirection(r)
+	isMessageLine(data)
+	isResponseLine(data)
+	isArrivalLine(data)
+	if matches := lineMatch.FindSubmatch(data); matches != nil {
+		fuzzAddress(matches[1])
+		fuzzAddress(matches[2])
+	}
+	return 1
+}
+
+// FuzzAddress unwraps and normalizes data as an address the way the sender
+// and recipient of a matched line are.
+func FuzzAddress(data []byte) int {
+	if bytes.IndexByte(data, '@') < 0 {
+		return 0
+	}
+	fuzzAddress(data)
+	return 1
+}
+
+func fuzzAddress(address []byte) {
+	for _, unwrap := range []func(string) (string, bool){unSRS, unVERP} {
+		if original, ok := unwrap(string(address)); ok && bytes.IndexByte([]byte(original), '@') < 0 {
+			panic(fmt.Sprintf("%q unwrapped to %q, which isn't an address", address, original))
+		}
+	}
+	normalized := normalizeAddress(address)
+	if again := normalizeAddress(normalized); !bytes.Equal(again, normalized) {
+		panic(fmt.Sprintf("normalizing %q again gave %q", normalized, again))
+	}
+	domainOf(string(normalized))
+	direction(string(normalized), string(normalized))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const metadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+var (
+	googleTokenLock    = sync.Mutex{}
+	googleTokenValue   string
+	googleTokenExpires time.Time
+)
+
+// googleToken is an OAuth token for Google Cloud APIs, from
+// GOOGLE_OAUTH_ACCESS_TOKEN (as printed by gcloud auth print-access-token) or
+// else the service account of the GCE or GKE machine this runs on, refreshed
+// before it expires.
+func googleToken() (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+	googleTokenLock.Lock()
+	defer googleTokenLock.Unlock()
+	if googleTokenValue != "" && time.Now().Before(googleTokenExpires) {
+		return googleTokenValue, nil
+	}
+
+	request, err := http.NewRequest(http.MethodGet, metadataToken, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Metadata-Flavor", "Google")
+	response, err := queryClient.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("no GOOGLE_OAUTH_ACCESS_TOKEN and no metadata server: %v", err)
+	}
+	defer response.Body.Close()
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := decodeResponse(response, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("metadata server gave no access token")
+	}
+	googleTokenValue = token.AccessToken
+	googleTokenExpires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return googleTokenValue, nil
+}
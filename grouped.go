@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// outputSchemaVersion is bumped whenever the columns or records of an output
+// format change, and is written where a format has room for it.
+const (
+	outputSchemaVersion = 1
+	outputSchemaKey     = "exim.schema_version"
+)
+
+// outputFormats are the ways -format can write the results.
+var outputFormats = map[string]func(*Runner, io.Writer) error{
+	"grouped":  (*Runner).writeGrouped,
+	"arrow":    writePairs("arrow"),
+	"json":     writePairs("json"),
+	"msgpack":  writePairs("msgpack"),
+	"protobuf": writePairs("protobuf"),
+}
+
+// separator splits the addresses on each line of the grouped output. Any
+// address holding it, a double quote or a line break is quoted CSV style,
+// with quotes inside doubled, so the output reads back losslessly.
+var separator = ','
+
+// writeGrouped writes a line per sender of them followed by everyone they
+// mailed, or with -approximate a from, to and count line per top pair,
+// leaving out pairs seen fewer than -min-count times.
+func (r *Runner) writeGrouped(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Comma = separator
+
+	if r.pairSketch != nil {
+		for _, pair := range r.topPairs.top() {
+			if int(pair.count) < minCount {
+				continue
+			}
+			from, to := splitPair(pair.key)
+			writer.Write([]string{from, to, strconv.FormatUint(uint64(pair.count), 10)})
+		}
+	}
+
+	var line []string
+	r.emails.Each(func(from uint32, recipients []uint32) bool {
+		line = append(line[:0], r.emails.Name(from))
+		for _, to := range recipients {
+			if r.frequent(from, to) {
+				line = append(line, r.emails.Name(to))
+			}
+		}
+		if len(line) == 1 {
+			return true
+		}
+		writer.Write(line)
+		log.Debug().Str("for", line[0]).Msg("Finished emails")
+		return true
+	})
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// readGrouped reads back grouped output, calling fn with each sender and
+// the addresses they mailed.
+func readGrouped(r io.Reader, fn func(from string, to []string)) error {
+	reader := csv.NewReader(r)
+	reader.Comma = separator
+	reader.FieldsPerRecord = -1
+	for {
+		line, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(line[0], line[1:])
+	}
+}
+
+func splitPair(key string) (string, string) {
+	split := strings.Index(key, pairSeparator)
+	return key[:split], key[split+len(pairSeparator):]
+}
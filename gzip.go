@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+)
+
+// gzipMembers reads every member of a gzip file one after another. Some
+// rotation schemes (pigz, appending dateext rotations) concatenate members
+// and some leave zero padding after the last one, which the stdlib reader
+// would otherwise report as a corrupt header once the real data is done.
+type gzipMembers struct {
+	source  *bufio.Reader
+	reader  *gzip.Reader
+	members int
+}
+
+func newGzipMembers(r io.Reader) (*gzipMembers, error) {
+	source := bufio.NewReader(r)
+	reader, err := gzip.NewReader(source)
+	if err != nil {
+		return nil, err
+	}
+	reader.Multistream(false)
+	return &gzipMembers{source: source, reader: reader, members: 1}, nil
+}
+
+func (g *gzipMembers) Read(p []byte) (int, error) {
+	for {
+		n, err := g.reader.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if err := g.next(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// next moves on to the following member, returning io.EOF when nothing but
+// padding is left.
+func (g *gzipMembers) next() error {
+	for {
+		b, err := g.source.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0 {
+			g.source.UnreadByte()
+			break
+		}
+	}
+
+	if err := g.reader.Reset(g.source); err != nil {
+		return err
+	}
+	g.reader.Multistream(false)
+	g.members++
+	return nil
+}
+
+func (g *gzipMembers) Close() error {
+	return g.reader.Close()
+}
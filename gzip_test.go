@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func gzipMember(t *testing.T, text string) []byte {
+	t.Helper()
+	var member bytes.Buffer
+	writer := gzip.NewWriter(&member)
+	if _, err := writer.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return member.Bytes()
+}
+
+const (
+	firstMember  = "2024-03-10 10:00:00 1rA001-0001aB-Cd <= a@corp.com H=h [10.0.0.5] P=esmtp S=1 for b@ext.com\n"
+	secondMember = "2024-03-11 10:00:00 1rA002-0001aB-Cd <= c@corp.com H=h [10.0.0.5] P=esmtp S=1 for d@ext.com\n"
+)
+
+func readMembers(t *testing.T, file []byte) (string, int, error) {
+	t.Helper()
+	g, err := newGzipMembers(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	content, err := ioutil.ReadAll(g)
+	return string(content), g.members, err
+}
+
+func TestGzipReadsEveryMember(t *testing.T) {
+	file := append(gzipMember(t, firstMember), gzipMember(t, secondMember)...)
+	content, members, err := readMembers(t, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != firstMember+secondMember {
+		t.Errorf("read %q, want both members", content)
+	}
+	if members != 2 {
+		t.Errorf("counted %d members, want 2", members)
+	}
+}
+
+func TestGzipSkipsZeroPaddingAfterTheMembers(t *testing.T) {
+	file := append(gzipMember(t, firstMember), gzipMember(t, secondMember)...)
+	file = append(file, make([]byte, 512)...)
+	content, members, err := readMembers(t, file)
+	if err != nil {
+		t.Fatalf("padding was read as %v", err)
+	}
+	if content != firstMember+secondMember || members != 2 {
+		t.Errorf("read %q in %d members, want both members", content, members)
+	}
+}
+
+func TestGzipTruncatedLastMemberKeepsWhatCameBefore(t *testing.T) {
+	file := append(gzipMember(t, firstMember), gzipMember(t, secondMember)...)
+	// Cut off the last member's trailer, as a rotation copied mid-write is.
+	file = file[:len(file)-8]
+	content, _, err := readMembers(t, file)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("read the truncated file with %v, want an unexpected EOF", err)
+	}
+	if class := classifyError("mainlog.1.gz", err); class != salvageableError {
+		t.Errorf("%v is classed %s, want it salvaged rather than retried", err, class)
+	}
+	if !strings.HasPrefix(content, firstMember) {
+		t.Errorf("read %q, want the whole first member before the cut", content)
+	}
+}
+
+func TestClassifyErrorRetriesOnlyRealIOErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  error
+		want errorClass
+	}{
+		{"mainlog.1.gz", io.ErrUnexpectedEOF, salvageableError},
+		{"mainlog.1.gz", gzip.ErrChecksum, permanentError},
+		{"mainlog.1.gz", syscall.EIO, transientError},
+		{"mainlog", io.ErrUnexpectedEOF, transientError},
+		{"mainlog", syscall.ESTALE, transientError},
+		{"mainlog", syscall.ENOENT, permanentError},
+	} {
+		if got := classifyError(test.name, test.err); got != test.want {
+			t.Errorf("%v reading %s is classed %s, want %s", test.err, test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Records exported to a SIEM, as CEF lines or as JSON lines of the
+// eventColumns the tabular sinks write, are read back in by these schemes
+// followed by the export's path, turned back into mainlog lines.
+const (
+	cefScheme   = "cef://"
+	jsonlScheme = "jsonl://"
+)
+
+var cefKey = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// cefTimeLayouts are the forms CEF's rt and end times come in, besides
+// milliseconds since the epoch.
+var cefTimeLayouts = []string{time.RFC3339Nano, "Jan 02 2006 15:04:05.000", "Jan 02 2006 15:04:05", "Jan 02 2006 15:04:05 MST"}
+
+// isImportInput reports whether input is a cef:// or jsonl:// export.
+func isImportInput(input string) bool {
+	return strings.HasPrefix(input, cefScheme) || strings.HasPrefix(input, jsonlScheme)
+}
+
+// importLines streams the records of a cef:// or jsonl:// export as mainlog
+// lines. Records that kept the line they came from give it back as it was,
+// and the rest have one put together from their fields.
+func importLines(input string) (io.ReadCloser, error) {
+	convert := jsonlLine
+	name := strings.TrimPrefix(input, jsonlScheme)
+	if strings.HasPrefix(input, cefScheme) {
+		convert = cefLine
+		name = strings.TrimPrefix(input, cefScheme)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, maxLineLength)
+		for number := 1; scanner.Scan(); number++ {
+			if len(strings.TrimSpace(scanner.Text())) == 0 {
+				continue
+			}
+			line, err := convert(scanner.Text())
+			if err != nil {
+				writer.CloseWithError(fmt.Errorf("record %d: %s", number, err))
+				return
+			}
+			if line == "" {
+				continue
+			}
+			if _, err := io.WriteString(writer, line+"\n"); err != nil {
+				return
+			}
+		}
+		writer.CloseWithError(scanner.Err())
+	}()
+	return reader, nil
+}
+
+// jsonlLine turns a JSON record of eventColumns back into a mainlog line.
+// Arrivals need a for field with their recipients to group unless the line
+// was kept.
+func jsonlLine(text string) (string, error) {
+	var row map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &row); err != nil {
+		return "", err
+	}
+	// BigQuery exports can leave each row wrapped as it was inserted.
+	if wrapped, ok := row["json"].(map[string]interface{}); ok {
+		row = wrapped
+	}
+	field := func(name string) string {
+		value, _ := row[name].(string)
+		return value
+	}
+	if line := field("line"); line != "" {
+		return line, nil
+	}
+	at, err := time.Parse(time.RFC3339Nano, field("time"))
+	if err != nil {
+		return "", fmt.Errorf("time %q is not an RFC 3339 time", field("time"))
+	}
+	recipients := field("for")
+	if recipients == "" {
+		recipients = field("recipients")
+	}
+	return buildLine(at, field("id"), eventFlag(field("event")), field("address"), recipients, field("message")), nil
+}
+
+// cefLine turns a CEF record back into a mainlog line, from its rawEvent if
+// it has one and otherwise from rt, externalId, act, suser, duser and msg.
+// Anything before CEF: is a syslog header and is skipped, and records
+// without a time are dropped.
+func cefLine(text string) (string, error) {
+	start := strings.Index(text, "CEF:")
+	if start < 0 {
+		return "", fmt.Errorf("no CEF header")
+	}
+	header := splitCEFHeader(text[start:])
+	if len(header) < 8 {
+		return "", fmt.Errorf("CEF header has %d of its 8 parts", len(header))
+	}
+	extension := parseCEFExtension(header[7])
+	if raw := extension["rawEvent"]; raw != "" {
+		return raw, nil
+	}
+
+	at, ok := cefTime(extension["rt"])
+	if !ok {
+		if at, ok = cefTime(extension["end"]); !ok {
+			return "", nil
+		}
+	}
+	flag := eventFlag(extension["act"])
+	address := extension["duser"]
+	if extension["suser"] != "" && (flag == "<=" || flag == "" && extension["duser"] != "") {
+		flag = "<="
+		address = extension["suser"]
+	}
+	recipients := ""
+	if flag == "<=" {
+		recipients = extension["duser"]
+	}
+	message := extension["msg"]
+	if message == "" {
+		message = header[5]
+	}
+	return buildLine(at, extension["externalId"], flag, address, recipients, message), nil
+}
+
+// buildLine puts a mainlog line together from the parts of a record,
+// leaving out those that are empty. Arrivals without a message are given
+// P=import so their recipients are where a real arrival's would be.
+func buildLine(at time.Time, id, flag, address, recipients, message string) string {
+	if message == "" && flag == "<=" {
+		message = "P=import"
+	}
+	parts := []string{at.UTC().Format(timestampLayout + " -0700")}
+	for _, part := range []string{id, flag, address} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if message != "" {
+		parts = append(parts, message)
+	}
+	if recipients != "" && flag == "<=" {
+		parts = append(parts, "for", recipients)
+	}
+	return strings.Join(parts, " ")
+}
+
+// eventFlag is the mainlog flag of an event name, or of a flag itself.
+func eventFlag(name string) string {
+	if lineFlags[name] {
+		return name
+	}
+	for flag, event := range eventNames {
+		if event == name && flag != "->" {
+			return flag
+		}
+	}
+	return ""
+}
+
+func cefTime(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, millis*int64(time.Millisecond)), true
+	}
+	for _, layout := range cefTimeLayouts {
+		if at, err := time.Parse(layout, value); err == nil {
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// splitCEFHeader splits a CEF record on the unescaped pipes of its header,
+// leaving the extension whole as the last part.
+func splitCEFHeader(text string) []string {
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(text); i++ {
+		switch {
+		case len(parts) == 7:
+			return append(parts, text[i:])
+		case text[i] == '\\' && i+1 < len(text):
+			i++
+			part.WriteByte(text[i])
+		case text[i] == '|':
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(text[i])
+		}
+	}
+	return append(parts, part.String())
+}
+
+// parseCEFExtension splits a CEF extension into its key=value pairs. Values
+// run up to the space before the next key and may hold escaped equals signs,
+// backslashes and line breaks.
+func parseCEFExtension(extension string) map[string]string {
+	fields := make(map[string]string)
+	key := ""
+	var value strings.Builder
+	for i := 0; i < len(extension); i++ {
+		c := extension[i]
+		switch {
+		case c == '\\' && i+1 < len(extension):
+			i++
+			switch extension[i] {
+			case 'n', 'r':
+				value.WriteByte(' ')
+			default:
+				value.WriteByte(extension[i])
+			}
+		case c == '=':
+			// The word just before an unescaped equals sign is the next key,
+			// and what came before it belongs to the last. Exporters that
+			// don't escape the equals signs in values, as in <=, leave words
+			// that can't be keys, which are kept as part of the value.
+			text := value.String()
+			split := strings.LastIndexByte(text, ' ')
+			if !cefKey.MatchString(text[split+1:]) {
+				value.WriteByte(c)
+				continue
+			}
+			if key != "" {
+				fields[key] = strings.TrimSpace(text[:split+1])
+			}
+			key = text[split+1:]
+			value.Reset()
+		default:
+			value.WriteByte(c)
+		}
+	}
+	if key != "" {
+		fields[key] = strings.TrimSpace(value.String())
+	}
+	return fields
+}
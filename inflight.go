@@ -0,0 +1,68 @@
+package main
+
+import (
+	"time"
+)
+
+var (
+	// inFlightAge is how long a message is tracked for without its Completed
+	// line turning up, longer than exim's default retry rules keep a message
+	// queued before giving up on it. Messages frozen and removed by hand, or
+	// whose Completed line was in a log that wasn't crunched, never complete
+	// and would otherwise be tracked for as long as a -follow runs.
+	inFlightAge = 7 * 24 * time.Hour
+	// inFlightSweep is how often the messages tracked for too long are looked
+	// for.
+	inFlightSweep = time.Hour
+)
+
+// inFlight tracks something about each message in flight, by exim id, from
+// when it arrives until its Completed line. It isn't safe for concurrent use,
+// being used under the lock of whatever else the report it is for counts.
+type inFlight struct {
+	messages map[string]flight
+	now      func() time.Time
+	swept    time.Time
+}
+
+// flight is what is tracked about a message and when it started being.
+type flight struct {
+	value interface{}
+	since time.Time
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{messages: make(map[string]flight), now: time.Now}
+}
+
+// track notes value for the message id, first dropping every message
+// tracked for longer than inFlightAge if it has been an inFlightSweep since
+// they were last looked for.
+func (f *inFlight) track(id string, value interface{}) {
+	now := f.now()
+	if now.Sub(f.swept) >= inFlightSweep {
+		for tracked, message := range f.messages {
+			if now.Sub(message.since) > inFlightAge {
+				delete(f.messages, tracked)
+			}
+		}
+		f.swept = now
+	}
+	f.messages[id] = flight{value: value, since: now}
+}
+
+// get returns what is tracked for the message id, if it is in flight.
+func (f *inFlight) get(id string) (interface{}, bool) {
+	message, ok := f.messages[id]
+	return message.value, ok
+}
+
+// complete stops tracking the message id.
+func (f *inFlight) complete(id string) {
+	delete(f.messages, id)
+}
+
+// len is how many messages are in flight.
+func (f *inFlight) len() int {
+	return len(f.messages)
+}
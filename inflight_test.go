@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInFlightDropsMessagesThatNeverComplete(t *testing.T) {
+	now := time.Date(2024, 3, 10, 10, 0, 0, 0, time.UTC)
+	f := newInFlight()
+	f.now = func() time.Time { return now }
+
+	f.track("1rA001-0001aB-Cd", "frozen")
+	f.track("1rA002-0001aB-Cd", "completed")
+	f.complete("1rA002-0001aB-Cd")
+	if _, ok := f.get("1rA002-0001aB-Cd"); ok {
+		t.Error("still tracking a completed message")
+	}
+
+	now = now.Add(inFlightAge - inFlightSweep)
+	f.track("1rA003-0001aB-Cd", "queued")
+	if value, ok := f.get("1rA001-0001aB-Cd"); !ok || value != "frozen" {
+		t.Errorf("got %v, %v for a message not yet in flight for too long", value, ok)
+	}
+
+	now = now.Add(2 * inFlightSweep)
+	f.track("1rA004-0001aB-Cd", "new")
+	if _, ok := f.get("1rA001-0001aB-Cd"); ok {
+		t.Error("still tracking a message in flight for longer than inFlightAge")
+	}
+	if f.len() != 2 {
+		t.Errorf("tracking %d messages, want the 2 still young enough", f.len())
+	}
+}
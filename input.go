@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+)
+
+// stringList is a flag that can be given more than once.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// openInput opens file for reading, whether it is on disk or streamed from
+// somewhere else. Streams stop when ctx is done.
+func openInput(ctx context.Context, file inputFile) (io.ReadCloser, error) {
+	for _, scheme := range []string{dockerScheme, podmanScheme} {
+		if strings.HasPrefix(file.name, scheme) {
+			return containerLogs(engineHost(scheme), strings.TrimPrefix(file.name, scheme))
+		}
+	}
+	if isQueryInput(file.name) {
+		return queryLines(file.name)
+	}
+	if isImportInput(file.name) {
+		return importLines(file.name)
+	}
+	if strings.HasPrefix(file.name, kubernetesPodScheme) {
+		return kube.logs(ctx, file.name)
+	}
+	return os.Open(file.name)
+}
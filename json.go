@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// jsonPair is a line of the json format. Fields that aren't set for a run
+// are left out.
+type jsonPair struct {
+	// SchemaVersion is only set on the first line.
+	SchemaVersion int      `json:"schema_version,omitempty"`
+	From          string   `json:"from"`
+	To            string   `json:"to"`
+	Day           string   `json:"day,omitempty"`
+	Start         string   `json:"start,omitempty"`
+	End           string   `json:"end,omitempty"`
+	ID            string   `json:"id,omitempty"`
+	Count         int64    `json:"count,omitempty"`
+	LastSeen      string   `json:"last_seen,omitempty"`
+	Expires       string   `json:"expires,omitempty"`
+	Examples      []string `json:"examples,omitempty"`
+}
+
+type jsonWriter struct {
+	buffered  *bufio.Writer
+	encoder   *json.Encoder
+	versioned bool
+}
+
+// newJSONPairWriter writes each pair as a line of JSON, with whichever of
+// count, retention dates and example lines it has.
+func newJSONPairWriter(w io.Writer, counted, stamped bool) (pairWriter, error) {
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	encoder.SetEscapeHTML(false)
+	return &jsonWriter{buffered: buffered, encoder: encoder}, nil
+}
+
+func (j *jsonWriter) write(p pair) error {
+	version := 0
+	if !j.versioned {
+		version = outputSchemaVersion
+		j.versioned = true
+	}
+	return j.encoder.Encode(jsonPair{SchemaVersion: version, From: p.from, To: p.to, Day: p.day, Start: p.start, End: p.end, ID: p.message, Count: p.count, LastSeen: p.lastSeen, Expires: p.expires, Examples: p.examples})
+}
+
+func (j *jsonWriter) close() error {
+	return j.buffered.Flush()
+}
+
+func readJSON(r *bufio.Reader, fn func(p pair) error) (string, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	var version string
+	for {
+		var line jsonPair
+		if err := decoder.Decode(&line); err == io.EOF {
+			return version, nil
+		} else if err != nil {
+			return version, err
+		}
+		if line.SchemaVersion != 0 && version == "" {
+			version = strconv.Itoa(line.SchemaVersion)
+		}
+		if err := fn(pair{from: line.From, to: line.To, day: line.Day, start: line.Start, end: line.End, message: line.ID, count: line.Count, lastSeen: line.LastSeen, expires: line.Expires, examples: line.Examples}); err != nil {
+			return version, err
+		}
+	}
+}
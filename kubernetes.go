@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kubernetesScheme    = "k8s://"
+	kubernetesPodScheme = "k8s-pod://"
+	serviceAccountDir   = "/var/run/secrets/kubernetes.io/serviceaccount/"
+)
+
+var kube *kubernetesClient
+
+// kubernetesClient talks to just enough of the Kubernetes API to find pods
+// and read their logs.
+type kubernetesClient struct {
+	api    string
+	token  string
+	client *http.Client
+
+	lock sync.Mutex
+	// cursors are how far the logs of each followed container have been
+	// read, by its k8s-pod:// input.
+	cursors map[string]podCursor
+}
+
+// podCursor is where a followed container's logs were read up to: the
+// timestamp of the last line and how many lines there were at it, so that a
+// stream restarted from that time can skip those already read.
+type podCursor struct {
+	at   time.Time
+	seen int
+}
+
+// newKubernetesClient connects to api, or from inside a cluster to the API
+// server its service environment variables point at. The token and CA files
+// default to the pod's service account, and are skipped if they don't exist
+// so an api from kubectl proxy works too.
+func newKubernetesClient(api, tokenFile, caFile string) (*kubernetesClient, error) {
+	if api == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return nil, errors.New("no -kube-api given and not running inside a cluster")
+		}
+		api = "https://" + host + ":" + port
+	}
+	if tokenFile == "" {
+		tokenFile = serviceAccountDir + "token"
+	}
+	if caFile == "" {
+		caFile = serviceAccountDir + "ca.crt"
+	}
+
+	k := &kubernetesClient{api: strings.TrimSuffix(api, "/"), client: http.DefaultClient, cursors: make(map[string]podCursor)}
+	if token, err := ioutil.ReadFile(tokenFile); err == nil {
+		k.token = string(bytes.TrimSpace(token))
+	}
+	if ca, err := ioutil.ReadFile(caFile); err == nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		k.client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	}
+	return k, nil
+}
+
+func (k *kubernetesClient) get(ctx context.Context, path string, query url.Values) (io.ReadCloser, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, k.api+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.token != "" {
+		request.Header.Set("Authorization", "Bearer "+k.token)
+	}
+
+	response, err := k.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, fmt.Errorf("kubernetes API returned %s: %s", response.Status, bytes.TrimSpace(message))
+	}
+	return response.Body, nil
+}
+
+// pods expands a k8s://namespace/labelSelector input into an input per
+// container of every matching pod, so each replica is read, plus one for the
+// previous instance of any container that has restarted so its logs up to
+// the restart aren't lost.
+func (k *kubernetesClient) pods(ctx context.Context, input string) ([]inputFile, error) {
+	split := strings.IndexByte(strings.TrimPrefix(input, kubernetesScheme), '/')
+	if split < 0 {
+		return nil, fmt.Errorf("%s is not k8s://namespace/labelSelector", input)
+	}
+	namespace, selector := input[len(kubernetesScheme):][:split], input[len(kubernetesScheme):][split+1:]
+
+	body, err := k.get(ctx, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods", url.Values{"labelSelector": {selector}})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Status struct {
+				Phase             string `json:"phase"`
+				ContainerStatuses []struct {
+					Name         string `json:"name"`
+					RestartCount int    `json:"restartCount"`
+				} `json:"containerStatuses"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	var files []inputFile
+	for _, pod := range list.Items {
+		if pod.Status.Phase == "Pending" {
+			continue
+		}
+		for _, container := range pod.Status.ContainerStatuses {
+			name := kubernetesPodScheme + namespace + "/" + pod.Metadata.Name + "/" + container.Name
+			if container.RestartCount > 0 {
+				files = append(files, inputFile{name: name + "/previous", kind: mainLog})
+			}
+			files = append(files, inputFile{name: name, kind: mainLog})
+		}
+	}
+	return files, nil
+}
+
+// logs streams the logs of a k8s-pod://namespace/pod/container[/previous]
+// input from pods. A followed container's logs stream on as they are written,
+// from the last line an earlier stream of them read.
+func (k *kubernetesClient) logs(ctx context.Context, input string) (io.ReadCloser, error) {
+	parts := strings.Split(strings.TrimPrefix(input, kubernetesPodScheme), "/")
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("%s is not a pod container", input)
+	}
+	path := "/api/v1/namespaces/" + url.PathEscape(parts[0]) + "/pods/" + url.PathEscape(parts[1]) + "/log"
+	query := url.Values{"container": {parts[2]}}
+	if len(parts) > 3 && parts[3] == "previous" {
+		query.Set("previous", "true")
+	}
+	if !isFollowedPod(inputFile{name: input}) {
+		return k.get(ctx, path, query)
+	}
+
+	// The lines are asked for with their timestamps so that when the stream
+	// ends, as it does when the API server times it out or the container
+	// restarts, the next can start from the last line read.
+	query.Set("follow", "true")
+	query.Set("timestamps", "true")
+	k.lock.Lock()
+	cursor, ok := k.cursors[input]
+	k.lock.Unlock()
+	if ok {
+		// sinceTime is only to the second, so the lines from the start of
+		// that second to the cursor come again and are dropped.
+		query.Set("sinceTime", cursor.at.UTC().Format(time.RFC3339))
+	}
+	body, err := k.get(ctx, path, query)
+	if err != nil {
+		return nil, err
+	}
+	return &podLogReader{ctx: ctx, k: k, input: input, body: body, lines: bufio.NewReader(body), cursor: cursor, repeated: cursor.seen}, nil
+}
+
+// podLogReader reads the lines of a followed container's log stream without
+// their timestamps, dropping those an earlier stream already read and moving
+// the container's cursor on past the rest.
+type podLogReader struct {
+	ctx    context.Context
+	k      *kubernetesClient
+	input  string
+	body   io.ReadCloser
+	lines  *bufio.Reader
+	cursor podCursor
+	// repeated is how many more lines at the cursor's timestamp were read
+	// before.
+	repeated int
+	line     []byte
+}
+
+func (p *podLogReader) Read(b []byte) (int, error) {
+	for len(p.line) == 0 {
+		line, err := p.lines.ReadBytes('\n')
+		if len(line) == 0 {
+			if err != nil && p.ctx.Err() != nil {
+				return 0, p.ctx.Err()
+			}
+			return 0, err
+		}
+		stamp, rest, _ := bytes.Cut(line, []byte(" "))
+		at, parseErr := time.Parse(time.RFC3339Nano, string(stamp))
+		if parseErr != nil {
+			p.line = line
+			break
+		}
+		switch {
+		case at.Before(p.cursor.at):
+			continue
+		case at.Equal(p.cursor.at) && p.repeated > 0:
+			p.repeated--
+			continue
+		case at.Equal(p.cursor.at):
+			p.cursor.seen++
+		default:
+			p.cursor = podCursor{at: at, seen: 1}
+			p.repeated = 0
+		}
+		p.k.lock.Lock()
+		p.k.cursors[p.input] = p.cursor
+		p.k.lock.Unlock()
+		p.line = rest
+	}
+	n := copy(b, p.line)
+	p.line = p.line[n:]
+	return n, nil
+}
+
+// Seek is how readFile skips the lines an earlier stream read, which this
+// one has already dropped, so it starts at offset as it is.
+func (p *podLogReader) Seek(offset int64, whence int) (int64, error) {
+	return offset, nil
+}
+
+func (p *podLogReader) Close() error {
+	return p.body.Close()
+}
+
+// isFollowedPod reports whether file is a container whose logs are streamed
+// as they are written rather than read up to now, which with -follow is every
+// one but the previous instances of restarted containers.
+func isFollowedPod(file inputFile) bool {
+	return following && strings.HasPrefix(file.name, kubernetesPodScheme) && !strings.HasSuffix(file.name, "/previous")
+}
+
+// followPods crunches the containers of the pods a k8s://namespace/labelSelector
+// input matches, listing them again every -follow-interval so those of
+// replicas started since are followed too, until the Runner is stopped.
+func (r *Runner) followPods(file inputFile, w *worker) {
+	var lock sync.Mutex
+	var containers sync.WaitGroup
+	followed := make(map[string]bool)
+	for {
+		pods, err := kube.pods(r.ctx, file.name)
+		if err != nil && r.ctx.Err() == nil {
+			w.log.Warn().Err(err).Msg("Failed to list pods")
+		}
+		lock.Lock()
+		for _, pod := range pods {
+			if followed[pod.name] {
+				continue
+			}
+			// The instance a container restarted from was followed up to its
+			// end, unless the container is new to this listing, and is only
+			// ever read the once.
+			if current := strings.TrimSuffix(pod.name, "/previous"); current != pod.name && followed[current] {
+				continue
+			}
+			followed[pod.name] = true
+			containers.Add(1)
+			go func(pod inputFile) {
+				defer containers.Done()
+				r.followContainer(pod, w.id)
+				// A container that can't be read yet, or whose pod went away
+				// and came back under the same name as a StatefulSet's do, is
+				// followed again from its cursor by a later listing.
+				if isFollowedPod(pod) {
+					lock.Lock()
+					delete(followed, pod.name)
+					lock.Unlock()
+				}
+			}(pod)
+		}
+		lock.Unlock()
+		if !waitToFollow(r.ctx) {
+			break
+		}
+	}
+	containers.Wait()
+}
+
+// followContainer crunches a container's logs, starting a new stream of them
+// each -follow-interval after the last ends, until the container can't be
+// read any more or the Runner is stopped.
+func (r *Runner) followContainer(file inputFile, id int) {
+	w := newWorker(id, file)
+	w.log.Info().Msg("Following pod container")
+	var times fileTimes
+	var lines int
+	start := time.Now()
+	defer func() { r.recordTimes(times, lines, time.Since(start)) }()
+	offset, ok := r.crunchFile(file, 0, &times, &lines, w)
+	for ok && isFollowedPod(file) && waitToFollow(r.ctx) {
+		offset, ok = r.crunchFile(file, offset, &times, &lines, w)
+	}
+	r.finishedFile(file, offset, ok, r.ctx.Err() != nil)
+}
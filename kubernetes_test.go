@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKubernetes lists the next of pods each time it is asked, and streams
+// a pod's logs with logs, told which request for them it is.
+type fakeKubernetes struct {
+	lock     sync.Mutex
+	listings int
+	pods     [][]string
+	requests map[string]int
+	logs     func(w http.ResponseWriter, r *http.Request, pod string, request int)
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	if r.URL.Path == "/api/v1/namespaces/mail/pods" {
+		pods := f.pods[len(f.pods)-1]
+		if f.listings < len(f.pods) {
+			pods = f.pods[f.listings]
+		}
+		f.listings++
+		f.lock.Unlock()
+		fmt.Fprint(w, `{"items":[`)
+		for i, pod := range pods {
+			if i > 0 {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprintf(w, `{"metadata":{"name":%q},"status":{"phase":"Running","containerStatuses":[{"name":"exim"}]}}`, pod)
+		}
+		fmt.Fprint(w, `]}`)
+		return
+	}
+	var pod string
+	fmt.Sscanf(r.URL.Path, "/api/v1/namespaces/mail/pods/%s", &pod)
+	pod = pod[:len(pod)-len("/log")]
+	f.requests[pod]++
+	request := f.requests[pod]
+	f.lock.Unlock()
+	f.logs(w, r, pod, request)
+}
+
+func TestFollowPodsReconnectsAndFindsNewPods(t *testing.T) {
+	defer func(saved bool, interval time.Duration, client *kubernetesClient) {
+		following, followInterval, kube = saved, interval, client
+	}(following, followInterval, kube)
+	following, followInterval = true, 10*time.Millisecond
+
+	line := func(stamp, id, sender string) string {
+		return stamp + " 2024-03-10 10:00:01 " + id + " <= " + sender + " H=h [10.0.0.5] P=esmtp S=1 for b@ext.com\n"
+	}
+	first := line("2024-03-10T10:00:00.5Z", "1rA001-0001aB-Cd", "a@corp.com")
+	// The next two share a timestamp, so reconnecting from it must skip the
+	// one read already but not the other.
+	second := line("2024-03-10T10:00:01.25Z", "1rA002-0001aB-Cd", "a@corp.com")
+	third := line("2024-03-10T10:00:01.25Z", "1rA003-0001aB-Cd", "c@corp.com")
+	fourth := line("2024-03-10T10:00:02Z", "1rA004-0001aB-Cd", "d@corp.com")
+
+	fake := &fakeKubernetes{
+		pods:     [][]string{{"exim-0"}, {"exim-0", "exim-1"}},
+		requests: make(map[string]int),
+		logs: func(w http.ResponseWriter, r *http.Request, pod string, request int) {
+			if r.URL.Query().Get("follow") != "true" {
+				t.Errorf("%s was not followed", pod)
+			}
+			since := r.URL.Query().Get("sinceTime")
+			switch {
+			case pod == "exim-0" && request == 1:
+				fmt.Fprint(w, first+second)
+				return
+			case pod == "exim-0" && request == 2:
+				if since != "2024-03-10T10:00:01Z" {
+					t.Errorf("reconnected since %q, want the second of the last line", since)
+				}
+				fmt.Fprint(w, first+second+third)
+				return
+			case pod == "exim-1" && request == 1:
+				fmt.Fprint(w, fourth)
+			}
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	var err error
+	if kube, err = newKubernetesClient(server.URL, "/nonexistent", "/nonexistent"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewRunner(ctx, Config{Email: regexp.MustCompile(".*"), Ignore: regexp.MustCompile("^$"), Threads: 1})
+	input := inputFile{name: "k8s://mail/app=exim", kind: mainLog}
+	done := make(chan bool)
+	go func() {
+		r.followPods(input, newWorker(1, input))
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); r.lines.Load() < 4 && time.Now().Before(deadline); {
+		time.Sleep(followInterval)
+	}
+	// Long enough for any line read twice to be counted as well.
+	time.Sleep(5 * followInterval)
+	cancel()
+	<-done
+
+	if lines := r.lines.Load(); lines != 4 {
+		t.Errorf("crunched %d lines, want the 4 logged", lines)
+	}
+	if senders := r.senders.Load(); senders != 3 {
+		t.Errorf("found %d senders, want 3", senders)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// logType is which of exim's logs a file holds, which decides what is pulled
+// out of its lines.
+type logType string
+
+const (
+	mainLog   logType = "main"
+	rejectLog logType = "reject"
+	panicLog  logType = "panic"
+)
+
+type inputFile struct {
+	name   string
+	kind   logType
+	domain string
+}
+
+// layout describes where a packaging of exim keeps its logs. Its pattern is
+// matched against paths relative to dir and names the log type, rotation
+// suffix (a count or a dateext date) and, for hosting panels that split logs
+// per domain, the domain as a directory or a file prefix.
+type layout struct {
+	dir     string
+	pattern *regexp.Regexp
+}
+
+var layouts = map[string]layout{
+	"debian-exim4": {
+		dir:     "/var/log/exim4",
+		pattern: regexp.MustCompile(`^(?P<kind>main|reject|panic)log(?:\.(?P<rotation>\d+))?(?:\.gz)?$`),
+	},
+	"cpanel": {
+		dir:     "/var/log",
+		pattern: regexp.MustCompile(`^(?:(?P<dir>[^/]+)/)?(?:(?P<prefix>[^/]+\.[^/]+)[-_])?exim_(?P<kind>main|reject|panic)log(?:[.-](?P<rotation>\d+))?(?:\.gz)?$`),
+	},
+	"directadmin": {
+		dir:     "/var/log/exim",
+		pattern: regexp.MustCompile(`^(?:(?P<dir>[^/]+)/)?(?:(?P<prefix>[^/]+\.[^/]+)[-_])?(?P<kind>main|reject|panic)log(?:[.-](?P<rotation>\d+))?(?:\.gz)?$`),
+	},
+}
+
+// find picks up the logs under dir (or the layout's default), going back at
+// most days rotations or days of dateext rotations, or all of them when days
+// is 0. Directories and files under dir that can't be read for want of
+// permission are skipped, as only dir itself being unreadable is fatal.
+func (l layout) find(dir string, days int) ([]inputFile, error) {
+	if dir == "" {
+		dir = l.dir
+	}
+
+	var files []inputFile
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir || !os.IsPermission(err) {
+				return err
+			}
+			log.Warn().Str("path", path).Err(err).Msg("Skipping unreadable log path")
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relative, _ := filepath.Rel(dir, path)
+		if info.IsDir() {
+			if path != dir && filepath.Dir(relative) != "." {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		groups := namedMatches(l.pattern, filepath.ToSlash(relative))
+		if groups == nil || (days > 0 && rotationAge(groups["rotation"]) >= days) {
+			return nil
+		}
+		file := inputFile{name: path, kind: logType(groups["kind"]), domain: groups["dir"]}
+		if file.domain == "" {
+			file.domain = groups["prefix"]
+		}
+		files = append(files, file)
+		return nil
+	})
+	return files, err
+}
+
+// rotationAge turns a rotation suffix into roughly how many days old the file
+// is, from either a logrotate count or a dateext YYYYMMDD date.
+func rotationAge(rotation string) int {
+	if rotation == "" {
+		return 0
+	}
+	if len(rotation) == 8 {
+		if date, err := time.ParseInLocation("20060102", rotation, time.Local); err == nil {
+			return int(time.Since(date) / (24 * time.Hour))
+		}
+	}
+	age, _ := strconv.Atoi(rotation)
+	return age
+}
+
+// namedMatches matches s against pattern, returning its named groups or nil
+// if it did not match.
+func namedMatches(pattern *regexp.Regexp, s string) map[string]string {
+	matches := pattern.FindStringSubmatch(s)
+	if matches == nil {
+		return nil
+	}
+	groups := make(map[string]string)
+	for i, name := range pattern.SubexpNames() {
+		if name != "" {
+			groups[name] = matches[i]
+		}
+	}
+	return groups
+}
+
+// tagDomain fills in each file's domain from domainPattern's domain group
+// matched against its path.
+func tagDomain(files []inputFile, domainPattern *regexp.Regexp) {
+	for i := range files {
+		if groups := namedMatches(domainPattern, filepath.ToSlash(files[i].name)); groups != nil {
+			files[i].domain = groups["domain"]
+		}
+	}
+}
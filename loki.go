@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// lokiSink pushes every mainlog line to Grafana Loki, labelled so LogQL can
+// pick out mail by host, direction and domain without parsing each line.
+type lokiSink struct {
+	url     string
+	tenant  string
+	labels  []string
+	static  map[string]string
+	host    string
+	batch   int
+	lock    sync.Mutex
+	streams map[string]*lokiStream
+	pending int
+	// kept is how many lines the last flush kept to try again, which the
+	// next waits for a whole batch beyond.
+	kept int
+}
+
+// lokiBacklog is how many batches of lines that couldn't be pushed are kept
+// to try again, beyond which the streams with the oldest lines are dropped.
+const lokiBacklog = 10
+
+// lokiStream is a stream of a push. Each value is a timestamp and line,
+// with the record id and any transcript reference as structured metadata.
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][]interface{}   `json:"values"`
+}
+
+// newLokiSink pushes to the Loki at url in batches of batch lines. Labels
+// picks which of host, direction, domain and event to label lines with, and
+// static labels are added to every line as they are.
+func newLokiSink(url, tenant, host string, labels []string, static map[string]string, batch int) (*lokiSink, error) {
+	for _, label := range labels {
+		switch label {
+		case "", "host", "direction", "domain", "event":
+		default:
+			return nil, fmt.Errorf("unknown Loki label %q", label)
+		}
+	}
+	return &lokiSink{
+		url:     strings.TrimSuffix(url, "/") + "/loki/api/v1/push",
+		tenant:  tenant,
+		labels:  labels,
+		static:  static,
+		host:    host,
+		batch:   batch,
+		streams: make(map[string]*lokiStream),
+	}, nil
+}
+
+var eventNames = map[string]string{
+	"<=": "arrival",
+	"(=": "fakereject",
+	"=>": "delivery",
+	"->": "delivery",
+	">>": "cutthrough",
+	"*>": "suppressed",
+	"**": "failure",
+	"==": "deferral",
+}
+
+func (l *lokiSink) send(e event) error {
+	labels := make(map[string]string, len(l.labels)+len(l.static))
+	for name, value := range l.static {
+		labels[name] = value
+	}
+	for _, label := range l.labels {
+		var value string
+		switch label {
+		case "host":
+			value = l.host
+		case "direction":
+			value = eventDirection(e.record)
+		case "domain":
+			value = e.file.domain
+		case "event":
+			value = eventNames[e.record.flag]
+		}
+		if value != "" {
+			labels[label] = value
+		}
+	}
+
+	key := lokiKey(labels)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	stream, ok := l.streams[key]
+	if !ok {
+		stream = &lokiStream{Stream: labels}
+		l.streams[key] = stream
+	}
+	metadata := map[string]string{"record_id": e.id}
+	if e.transcript != "" {
+		metadata["transcript"] = e.transcript
+	}
+	value := []interface{}{strconv.FormatInt(e.record.time.UnixNano(), 10), e.line, metadata}
+	stream.Values = append(stream.Values, value)
+	l.pending++
+	if l.pending-l.kept < l.batch {
+		return nil
+	}
+	return l.flush()
+}
+
+// flush pushes everything batched so far, which is let go once Loki takes
+// it or refuses it as bad. Lines that couldn't be pushed at all are kept to
+// try again on the next flush, up to lokiBacklog batches of them. It must be
+// called with the lock held.
+func (l *lokiSink) flush() error {
+	if l.pending == 0 {
+		return nil
+	}
+	err := l.push()
+	if _, rejected := err.(lokiRejection); err == nil || rejected {
+		l.streams = make(map[string]*lokiStream)
+		l.pending = 0
+	} else {
+		err = errors.Join(append([]error{err}, l.trimBacklog()...)...)
+	}
+	l.kept = l.pending
+	return err
+}
+
+// trimBacklog drops the streams whose lines start earliest until no more
+// than lokiBacklog batches of lines are kept.
+func (l *lokiSink) trimBacklog() []error {
+	keys := make([]string, 0, len(l.streams))
+	for key := range l.streams {
+		keys = append(keys, key)
+	}
+	first := func(key string) int64 {
+		nanos, _ := strconv.ParseInt(l.streams[key].Values[0][0].(string), 10, 64)
+		return nanos
+	}
+	sort.Slice(keys, func(i, j int) bool { return first(keys[i]) < first(keys[j]) })
+	var dropped []error
+	for _, key := range keys {
+		if l.pending <= lokiBacklog*l.batch {
+			break
+		}
+		stream := l.streams[key]
+		delete(l.streams, key)
+		l.pending -= len(stream.Values)
+		dropped = append(dropped, fmt.Errorf("dropped %d lines for Loki stream %v after failing to push them", len(stream.Values), stream.Stream))
+	}
+	return dropped
+}
+
+// lokiRejection is Loki refusing a push as bad, which sending it again
+// would only have refused again.
+type lokiRejection string
+
+func (r lokiRejection) Error() string {
+	return string(r)
+}
+
+// push sends every stream batched so far.
+func (l *lokiSink) push() error {
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, stream := range l.streams {
+		push.Streams = append(push.Streams, stream)
+	}
+
+	body, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, l.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if l.tenant != "" {
+		request.Header.Set("X-Scope-OrgID", l.tenant)
+	}
+
+	response, err := queryClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		err := fmt.Sprintf("loki returned %s: %s", response.Status, bytes.TrimSpace(message))
+		// Loki answers 400 for lines too old or out of order, which never
+		// go in, and 429 when rate limited, which may on the next flush.
+		if response.StatusCode/100 == 4 && response.StatusCode != http.StatusTooManyRequests {
+			return lokiRejection(err)
+		}
+		return errors.New(err)
+	}
+	return nil
+}
+
+func (l *lokiSink) close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.flush()
+}
+
+// lokiKey is a stable key for a label set.
+func lokiKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name)
+		key.WriteByte('=')
+		key.WriteString(labels[name])
+		key.WriteByte(0)
+	}
+	return key.String()
+}
+
+// parseLabels reads a comma separated list of name=value labels.
+func parseLabels(list string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		split := strings.IndexByte(pair, '=')
+		if split < 1 {
+			return nil, fmt.Errorf("label %q is not name=value", pair)
+		}
+		labels[pair[:split]] = pair[split+1:]
+	}
+	return labels, nil
+}
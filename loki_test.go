@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLoki(t *testing.T, respond func() int) *lokiSink {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(respond())
+	}))
+	t.Cleanup(server.Close)
+	l, err := newLokiSink(server.URL, "", "host", []string{"domain"}, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func sendLines(t *testing.T, l *lokiSink, domain string, start time.Time, count int) error {
+	t.Helper()
+	var err error
+	for i := 0; i < count; i++ {
+		e := event{id: fmt.Sprint(domain, i), file: inputFile{domain: domain}, line: "x", record: record{time: start.Add(time.Duration(i) * time.Second)}}
+		err = l.send(e)
+	}
+	return err
+}
+
+func TestLokiKeepsUnpushedLinesForTheNextFlush(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	l := newTestLoki(t, func() int { return status })
+	if err := sendLines(t, l, "a.com", time.Unix(0, 0), 2); err == nil {
+		t.Fatal("push to a Loki that is down succeeded")
+	}
+	if l.pending != 2 || len(l.streams) != 1 {
+		t.Fatalf("after failing kept %d lines in %d streams, want 2 in 1", l.pending, len(l.streams))
+	}
+
+	// A kept line doesn't count towards the next batch.
+	if err := sendLines(t, l, "b.com", time.Unix(0, 0), 1); err != nil || l.pending != 3 {
+		t.Fatalf("sent with %v and %d lines pending, want 3 waiting for a batch", err, l.pending)
+	}
+	status = http.StatusNoContent
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+	if l.pending != 0 || len(l.streams) != 0 {
+		t.Errorf("after pushing kept %d lines in %d streams, want none", l.pending, len(l.streams))
+	}
+}
+
+func TestLokiDropsRejectedPushes(t *testing.T) {
+	l := newTestLoki(t, func() int { return http.StatusBadRequest })
+	if err := sendLines(t, l, "a.com", time.Unix(0, 0), 2); err == nil {
+		t.Fatal("push Loki refused succeeded")
+	}
+	if l.pending != 0 || len(l.streams) != 0 {
+		t.Errorf("kept %d refused lines, want them dropped", l.pending)
+	}
+}
+
+func TestLokiBacklogIsBounded(t *testing.T) {
+	l := newTestLoki(t, func() int { return http.StatusServiceUnavailable })
+	sendLines(t, l, "a.com", time.Unix(9, 0), lokiBacklog*l.batch)
+	err := sendLines(t, l, "b.com", time.Unix(10, 0), l.batch)
+	if err == nil || !strings.Contains(err.Error(), "dropped") {
+		t.Fatalf("flush returned %v, want lines dropped", err)
+	}
+	if l.pending > lokiBacklog*l.batch {
+		t.Errorf("kept %d lines, more than the backlog of %d", l.pending, lokiBacklog*l.batch)
+	}
+	if _, ok := l.streams[lokiKey(map[string]string{"domain": "a.com"})]; ok {
+		t.Error("kept the stream with the oldest lines")
+	}
+}
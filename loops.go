@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loop is a Message-ID seen arriving. Arrivals is the most times it arrived
+// with no more than -loop-window between one and the next, and detected is
+// set when exim itself gave up on it as a mail loop. A loop is only told
+// apart by its Message-ID, as the count of Received headers that would also
+// tell apart loops that rewrite it isn't in exim's mainlog.
+type loop struct {
+	arrivals  int
+	run       int
+	first     time.Time
+	last      time.Time
+	detected  bool
+	addresses map[string]bool
+}
+
+var (
+	loopFile      string
+	loopThreshold = 3
+	loopWindow    = 10 * time.Minute
+	loops         = make(map[string]*loop)
+	// loopsPruned is the log time loops were last pruned at.
+	loopsPruned time.Time
+	// loopMessages is the Message-ID of each message in flight.
+	loopMessages = newInFlight()
+	loopLock     = sync.Mutex{}
+
+	completedMarker = []byte(" Completed")
+	mailLoopMarker  = []byte("mail loop")
+)
+
+// isLoopLine is a quick check for lines that may be arrivals, deliveries,
+// completions or exim's own loop failures, before going to the trouble of
+// parsing them.
+func isLoopLine(line []byte) bool {
+	return isArrivalLine(line) || bytes.Contains(line, deliveryMarker) || bytes.Contains(line, routedMarker) ||
+		bytes.Contains(line, completedMarker) || bytes.Contains(line, mailLoopMarker)
+}
+
+// checkLoop follows each message from its <= line, by the id= Message-ID
+// header it arrived with, noting the addresses it went between.
+func checkLoop(r record) {
+	if r.id == "" {
+		return
+	}
+
+	loopLock.Lock()
+	defer loopLock.Unlock()
+	if r.flag == "<=" {
+		header := r.fields["id"]
+		if header == "" {
+			return
+		}
+		if r.time.Sub(loopsPruned) > loopWindow {
+			pruneLoops(r.time)
+		}
+		l := loops[header]
+		if l == nil {
+			l = &loop{first: r.time, addresses: make(map[string]bool)}
+			loops[header] = l
+		}
+		if r.time.Sub(l.last) > loopWindow {
+			l.run = 0
+		}
+		l.run++
+		if l.run > l.arrivals {
+			l.arrivals = l.run
+		}
+		l.last = r.time
+		l.addresses[strings.ToLower(r.address)] = true
+		loopMessages.track(r.id, header)
+		return
+	}
+
+	header, ok := loopMessages.get(r.id)
+	if !ok {
+		return
+	}
+	switch {
+	case r.flag == "" && r.message == "Completed":
+		loopMessages.complete(r.id)
+	case r.flag == "=>" || r.flag == "->" || r.flag == "**":
+		l := loops[header.(string)]
+		if l == nil {
+			// Pruned while the message was held up in the queue.
+			return
+		}
+		l.addresses[strings.ToLower(r.address)] = true
+		if r.original != "" {
+			l.addresses[strings.ToLower(r.original)] = true
+		}
+		if r.flag == "**" && strings.Contains(r.message, string(mailLoopMarker)) {
+			l.detected = true
+		}
+	}
+}
+
+// pruneLoops drops the Message-IDs that haven't arrived often enough to be a
+// loop, nor been failed as one, and haven't arrived for -loop-window before
+// now, so any arrival of them from here on starts a new run anyway. Without
+// this every Message-ID crunched would be kept to the end. It must be called
+// with the lock held.
+func pruneLoops(now time.Time) {
+	for header, l := range loops {
+		if l.arrivals < loopThreshold && !l.detected && now.Sub(l.last) > loopWindow {
+			delete(loops, header)
+		}
+	}
+	loopsPruned = now
+}
+
+// writeLoops writes a line per Message-ID that arrived at least
+// -loop-threshold times in a row or that exim failed as a loop, with the
+// addresses it went between.
+func writeLoops(fileName string) error {
+	var headers []string
+	for header, l := range loops {
+		if l.arrivals >= loopThreshold || l.detected {
+			headers = append(headers, header)
+		}
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		if loops[headers[i]].arrivals != loops[headers[j]].arrivals {
+			return loops[headers[i]].arrivals > loops[headers[j]].arrivals
+		}
+		return headers[i] < headers[j]
+	})
+
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := csv.NewWriter(outFile)
+	writer.Write([]string{"message_id", "arrivals", "first", "last", "detected", "addresses"})
+	for _, header := range headers {
+		l := loops[header]
+		addresses := make([]string, 0, len(l.addresses))
+		for address := range l.addresses {
+			addresses = append(addresses, address)
+		}
+		sort.Strings(addresses)
+		writer.Write([]string{header, strconv.Itoa(l.arrivals), l.first.Format(time.RFC3339), l.last.Format(time.RFC3339), strconv.FormatBool(l.detected), strings.Join(addresses, " ")})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoopsPruneMessageIDsThatStoppedArriving(t *testing.T) {
+	defer func(saved map[string]*loop, pruned time.Time) { loops, loopsPruned = saved, pruned }(loops, loopsPruned)
+	loops, loopsPruned = make(map[string]*loop), time.Time{}
+
+	for _, line := range []string{
+		"2024-03-10 10:00:00 1rA001-0001aB-Cd <= a@corp.com H=h [10.0.0.5] P=esmtp S=1 id=once@corp.com for b@ext.com",
+		"2024-03-10 10:00:00 1rA002-0001aB-Cd <= a@corp.com H=h [10.0.0.5] P=esmtp S=1 id=loop@corp.com for b@ext.com",
+		"2024-03-10 10:00:05 1rA003-0001aB-Cd <= a@corp.com H=h [10.0.0.5] P=esmtp S=1 id=loop@corp.com for b@ext.com",
+		"2024-03-10 10:00:10 1rA004-0001aB-Cd <= a@corp.com H=h [10.0.0.5] P=esmtp S=1 id=loop@corp.com for b@ext.com",
+		"2024-03-10 11:00:00 1rA005-0001aB-Cd <= a@corp.com H=h [10.0.0.5] P=esmtp S=1 id=later@corp.com for b@ext.com",
+	} {
+		r, err := parseLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLoop(r)
+	}
+
+	for header, want := range map[string]bool{"once@corp.com": false, "loop@corp.com": true, "later@corp.com": true} {
+		if _, kept := loops[header]; kept != want {
+			t.Errorf("kept %s is %v, want %v", header, kept, want)
+		}
+	}
+	if arrivals := loops["loop@corp.com"].arrivals; arrivals != 3 {
+		t.Errorf("loop@corp.com arrived %d times in a row, want 3", arrivals)
+	}
+}
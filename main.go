@@ -3,50 +3,168 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
+	"context"
+	"errors"
 	"flag"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
-	"sync"
+	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"github.com/lachlanmunro/exim/aggregate"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 var (
-	ignoreRegex    *regexp.Regexp
-	emailRegex     *regexp.Regexp
-	emails         = make(map[string]map[string]bool)
-	writeLock      = sync.Mutex{}
-	sem            chan bool
-	lineMatch      = regexp.MustCompile(`.+ <= (?P<from>\S+) .+ for (?P<to>\S+)`)
-	lineCount      = 0
-	matchCount     = 0
-	ignoreCount    = 0
-	fromCount      = 0
-	remainingFiles = 0
-	startTime      = time.Now()
-	logLineCount   = 1
-	logFrequency   = 1
+	lineMatch     = regexp.MustCompile(`.+ <= (?P<from>\S+) .+ for (?P<to>\S+)`)
+	maxLineLength = 65536
 )
 
+// pairSeparator joins a from and to address into one key, and can't appear
+// in either of them.
+const pairSeparator = "\x00"
+
 func main() {
-	email := flag.String("email", ".*", "A regex that determines is an email should be selected to group against")
-	ignore := flag.String("ignore", "^$", "A regex that determines if a to email should be ignored")
+	if runCommand() {
+		return
+	}
+
+	var email, ignore stringList
+	flag.Var(&email, "email", "A regex that determines is an email should be selected to group against, can be given more than once to select emails matching any of them (default .*)")
+	flag.Var(&ignore, "ignore", "A regex that determines if a to email should be ignored, can be given more than once to ignore emails matching any of them (default ^$)")
 	glob := flag.String("files", "*main.log*", "A glob pattern for matching exim logfiles to eat")
-	logFreq := flag.Int("log", 1000000, "The number of lines to read per log message")
-	outFileName := flag.String("out", "emails", "The resulting email file")
+	layoutName := flag.String("layout", "", "Find logs where a packaged exim keeps them instead of by -files, one of debian-exim4, cpanel, directadmin")
+	dir := flag.String("dir", "", "The log directory for -layout, if not the packaged default")
+	days := flag.Int("days", 0, "The number of days of rotated logs to read with -layout, 0 for all of them")
+	responses := flag.String("responses", "", "A CSV file to write remote SMTP response codes per destination domain to, from failed and deferred deliveries")
+	validRecipientsFile := flag.String("valid-recipients", "", "A file of valid mailboxes, one per line, to check the recipients on their domains against")
+	unknownRecipients := flag.String("unknown-recipients", "unknown-recipients.csv", "The CSV file -valid-recipients writes unknown addresses mail was accepted for, and senders probing for them, to")
+	probes := flag.Int("probe-threshold", 5, "The number of unknown addresses a sender must be refused for to be reported as probing")
+	tlsPolicy := flag.String("tls-policy", "", "A file of domain globs, each optionally followed by the lowest TLS version allowed (default 1.2), to check mail to and from them against")
+	tlsViolationsFlag := flag.String("tls-violations", "tls-violations.csv", "The CSV file -tls-policy writes the receipts and deliveries that broke it to")
+	smarthostsFlag := flag.String("smarthosts", "", "A CSV file to write how the deliveries tried at each remote host went to, the share delivered, deferred and failed and how long deliveries took, for choosing between smarthosts")
+	egressFlag := flag.String("egress", "", "A CSV file to write the countries and ASNs each sender domain's outbound deliveries went to, by the remote IPs looked up in -ip2asn")
+	ip2asn := flag.String("ip2asn", "", "An ip2asn TSV file, optionally gzipped, of address ranges with their AS number, country and AS name for -egress and the countries of -auth")
+	authFlag := flag.String("auth", "", "A CSV file to write each SMTP AUTH user's messages, distinct recipients, source IPs, countries and messages by hour of the day to, as a baseline for spotting compromised accounts")
+	typos := flag.String("typos", "", "A CSV file to write recipient domains within -typo-distance edits of -internal-domains or -typo-domains to, with the senders who mailed them")
+	typoDomainsFlag := flag.String("typo-domains", "", "A comma separated list of partner and provider domains to check recipient domains for typos of, besides -internal-domains")
+	typoDistanceFlag := flag.Int("typo-distance", 2, "The most edits, counting a swap of neighbouring letters as one, a recipient domain can be from a watched domain to be reported by -typos")
+	rewriteFile := flag.String("rewrite-rules", "", "A file of rules, each a regex and its replacement, applied in order to the lowercased from and to addresses before grouping, such as old domains to new")
+	srs := flag.Bool("unwrap-srs", false, "Group SRS rewritten senders, SRS0=hash=tt=domain=local@forwarder, under the original local@domain")
+	verp := flag.Bool("unwrap-verp", false, "Group VERP senders, bounces+local=domain@lists, under the recipient local@domain they encode")
+	onlyDirection := flag.String("only-direction", "", "Only group mail going one way, one of inbound, outbound, internal or relay by -internal-domains")
+	spoofing := flag.String("spoofing", "", "A CSV file to write the untrusted IPs that sent unauthenticated mail as -internal-domains senders to")
+	trusted := flag.String("trusted-networks", "127.0.0.0/8,::1", "A comma separated list of the CIDRs allowed to send as -internal-domains senders without authenticating")
+	reputationFlag := flag.String("reputation", "", "A CSV file to write a reputation score for each untrusted source IP to, weighing its volume, rejections, missing reverse DNS, DNSBL hits and odd HELOs")
+	reputationWeightsFlag := flag.String("reputation-weights", "volume=0,reject=1,rdns=1,dnsbl=5,helo=2", "A comma separated list of signal=weight for -reputation, of volume, reject, rdns, dnsbl and helo")
+	reputationDeny := flag.String("reputation-deny", "", "An exim host list file to write the source IPs scoring at least -reputation-threshold to, for an ACL to deny")
+	reputationThresholdFlag := flag.Float64("reputation-threshold", 10, "The -reputation score at which a source IP goes in -reputation-deny")
+	aclDirFlag := flag.String("acl-dir", "", "A directory to write an exim host list file to for each of -acl-findings, with acl.conf to include in the RCPT ACL to deny them, keeping hosts from earlier runs until they expire")
+	aclFindingsFlag := flag.String("acl-findings", "", "A comma separated list of the findings -acl-dir denies, of reputation, spoofing and harvest, each needing its report turned on, or all those that are by default")
+	aclExpiryFlag := flag.Duration("acl-expiry", 30*24*time.Hour, "How long a host stays in an -acl-dir host list after it was last flagged")
+	backscatter := flag.String("backscatter", "", "A CSV file to write likely backscatter to, bounces sent to outside addresses for mail that came from untrusted IPs without authenticating, by the IP that sent it")
+	loopsFlag := flag.String("loops", "", "A CSV file to write probable forwarding loops to, Message-IDs arriving again and again with the addresses involved")
+	loopThresholdFlag := flag.Int("loop-threshold", 3, "The number of times a Message-ID must arrive in a row to be reported as a loop")
+	loopWindowFlag := flag.Duration("loop-window", 10*time.Minute, "The longest gap between arrivals of a Message-ID for them to count as in a row")
+	sample := flag.String("sample", "", "A CSV file to write a balanced random sample of labelled messages to, up to -sample-size each of spam, bounced and clean, for training classifiers")
+	sampleSizeFlag := flag.Int("sample-size", 1000, "The number of messages of each label -sample keeps")
+	groupBy := flag.String("group-by", "domain", "What -responses is grouped by, one of domain or provider")
+	providersFile := flag.String("providers", "", "A file of extra provider mappings, each line a provider name then domain or mx:host glob patterns")
+	approximate := flag.Bool("approximate", false, "Count pairs approximately in fixed memory and write only the -top most frequent as from,to,count lines")
+	sketchWidth := flag.Int("sketch-width", 1<<20, "The counters per row of the -approximate sketch, more is more accurate")
+	sketchDepth := flag.Int("sketch-depth", 4, "The rows of the -approximate sketch, more is more accurate")
+	top := flag.Int("top", 10000, "The number of most frequent pairs to keep exactly with -approximate")
+	minCountFlag := flag.Int("min-count", 1, "The fewest messages a sender must send a recipient for the pair to be written, to leave out one-off misdirected mail and probes")
+	retention := flag.Int("retention-days", 0, "Stamp each pair with the day it was last seen and the day it expires, this many days later, for exim prune to drop; needs a pair format")
+	dedupeFlag := flag.String("dedupe", "pair", "What each row of the output is unique by, one of pair, day for a row per pair per day, hour for a row per pair per hour, or message for a row per message; all but pair need the json format")
+	timezone := flag.String("timezone", "", "The zone, such as Europe/London, to bucket days and hours and date partitions in, with a 23 or 25 hour day and a repeated hour when the clocks change, if not the log's own dates and UTC partitions")
+	logTimezone := flag.String("log-timezone", "Local", "The zone exim wrote timestamps without an offset in")
+	eximVersion := flag.String("exim-version", "", "The exim release, e.g. 4.97, that wrote the logs, to parse them as that release writes them rather than as any release might")
+	examplesFlag := flag.Int("examples", 0, "Keep up to this many of the lines each pair was seen on, the first, the last and a random sample of those between, in json output")
+	separatorFlag := flag.String("separator", ",", "The character separating addresses in the output, addresses holding it are quoted")
+	compare := flag.String("compare", "", "A CSV file to write the pairs kept by only one of the -email and -ignore filters or the -compare-email and -compare-ignore ones to")
+	var compareEmail, compareIgnore stringList
+	flag.Var(&compareEmail, "compare-email", "A regex for -compare in place of -email, can be given more than once (default the -email ones)")
+	flag.Var(&compareIgnore, "compare-ignore", "A regex for -compare in place of -ignore, can be given more than once (default the -ignore ones)")
+	var required stringList
+	flag.Var(&required, "require-substring", "A literal, case sensitive, that lines must hold to be crunched at all, checked before any regex, can be given more than once to keep lines holding any of them")
+	var inputs stringList
+	flag.Var(&inputs, "input", "A docker://container, podman://container, k8s://namespace/labelSelector, loki://host:port?query=logql, es://host:port/index, or an uncompressed cef://path or jsonl://path SIEM export of records, whose output to crunch as a mainlog, can be given more than once")
+	since := flag.String("since", "24h", "The start of the time range to fetch from loki:// and es:// inputs, an RFC 3339 time or a duration ago")
+	until := flag.String("until", "", "The end of the time range to fetch from loki:// and es:// inputs, an RFC 3339 time or a duration ago, empty for now")
+	esQuery := flag.String("es-query", `{"match_all":{}}`, "The Elasticsearch query DSL picking out exim lines for es:// inputs")
+	esTime := flag.String("es-time-field", "@timestamp", "The Elasticsearch field holding each line's time")
+	esField := flag.String("es-field", "message", "The Elasticsearch field holding each exim line")
+	queryTimeout := flag.Duration("query-timeout", time.Minute, "How long to wait for each request to loki:// and es:// inputs and the Loki and BigQuery sinks before giving up on it")
+	kubeAPI := flag.String("kube-api", "", "The Kubernetes API server for k8s:// inputs, if not the cluster this is running in")
+	kubeToken := flag.String("kube-token-file", "", "A file holding the bearer token for the Kubernetes API, if not the pod's service account token")
+	kubeCA := flag.String("kube-ca-file", "", "A file holding the CA certificates for the Kubernetes API, if not the pod's service account CA")
+	internal := flag.String("internal-domains", "", "A comma separated list of our own domains, which decides the direction mail is going")
+	host := flag.String("host", "", "The host the logs are from, for labelling events, if not this one")
+	transcripts := flag.String("transcripts", "", "The URL of a transcript or pcap index service to look up each message at, with {queue} and {message} for its exim id and Message-ID, attaching the url it answers with to the events sent to the sinks")
+	transcriptTimeout := flag.Duration("transcript-timeout", 5*time.Second, "How long to wait for each -transcripts lookup")
+	lokiURL := flag.String("loki", "", "The base URL of a Grafana Loki to push every mainlog line to")
+	lokiTenant := flag.String("loki-tenant", "", "The tenant to push to Loki as")
+	lokiLabels := flag.String("loki-labels", "host,direction,domain", "Which of host, direction, domain and event to label lines pushed to Loki with")
+	lokiStatic := flag.String("loki-static-labels", "job=exim", "Comma separated name=value labels added to every line pushed to Loki")
+	lokiBatch := flag.Int("loki-batch", 1000, "The number of lines to push to Loki at once")
+	bigQueryTable := flag.String("bigquery", "", "A project.dataset.table in BigQuery, day partitioned by ingestion time, to stream every mainlog line into")
+	bigQueryBatch := flag.Int("bigquery-batch", 500, "The number of rows to insert into BigQuery at once")
+	bigQueryColumnPartitioned := flag.Bool("bigquery-column-partitioned", false, "The -bigquery table is partitioned on its time column rather than by ingestion time, so lines of any date can be streamed into it, as backfilling logs more than 31 days old needs")
+	stage := flag.String("stage", "", "A directory, s3://bucket/prefix or gs://bucket/prefix to write every mainlog line to as gzipped CSV, with the SQL to load it into Snowflake or Redshift")
+	stageTable := flag.String("stage-table", "exim_events", "The warehouse table the -stage load SQL creates and loads")
+	stageRows := flag.Int("stage-rows", 1000000, "The number of rows per -stage file")
+	sinkBufferFlag := flag.Int("sink-buffer", 1000, "The number of events each of -loki, -bigquery and -stage can fall behind by before crunching waits for it to catch up")
+	domainFromPath := flag.String("domain-from-path", "", "A regex with a domain group to tag each file's matches with a domain taken from its path")
+	linesBelow := flag.Int("fail-if-lines-below", -1, "Exit with status 2 if fewer lines than this were read, -1 to never")
+	matchedBelow := flag.Int("fail-if-matched-below", -1, "Exit with status 2 if fewer lines than this matched, -1 to never")
+	errorsAbove := flag.Int("fail-if-errors-above", -1, "Exit with status 2 if there were more read and sink errors than this, -1 to never")
+	follow := flag.Bool("follow", false, "Keep reading local, uncompressed logs as they grow, and the logs of the pods of k8s:// inputs as they are written, until interrupted, then write the output")
+	backfillFlag := flag.Bool("backfill", false, "Crunch the rotated logs matched first, oldest first, then -follow the live ones, catching up on any rotated in the meantime")
+	followIntervalFlag := flag.Duration("follow-interval", time.Second, "How often -follow checks the logs for new lines")
+	walFlag := flag.String("wal", "", "A write-ahead log file that -follow appends every line to before crunching it, replayed on start after a run was killed before writing its output")
+	metrics := flag.String("metrics", "", "An address such as :9100 to serve Prometheus metrics on, including delivery latency by provider, and expvars on /debug/vars, while following")
+	maxDuration := flag.Duration("max-duration", 0, "How long to crunch for before stopping where it is and writing what was crunched, marked partial in the -manifest, 0 for no limit")
+	digest := flag.String("digest", "", "A file to write a digest to of the external addresses each internal user corresponded with for the first time, by -internal-domains")
+	digestKnown := flag.String("digest-known", "", "A previous output, in any format, whose pairs the -digest doesn't count as new")
+	autocomplete := flag.String("autocomplete", "", "A directory to write a file to for each sender, or each -internal-domains sender, of the addresses they mailed and how many times, tab separated, to seed mail clients' address autocompletion")
+	trends := flag.String("trends", "", "A JSONL file to append the run's messages, senders, bounce rate and new pairs to, for the trends command to chart across runs")
+	manifestFile := flag.String("manifest", "", "A JSON file to write what the run read and wrote to, including whether it stopped early and how far it got through each file")
+	progressInterval := flag.Duration("progress-interval", 10*time.Second, "How often to log crunching progress, 0 to never")
+	outFileName := flag.String("out", "emails", "The resulting email file, - for stdout")
+	format := flag.String("format", "grouped", "The output format, grouped lines, an arrow IPC stream of from,to rows, json lines, or length prefixed msgpack or protobuf (see pair.proto) records")
 	level := flag.String("level", "info", "Log level is one of debug, info, warn, error, fatal, panic")
 	pretty := flag.Bool("pretty", true, "Use pretty logging (slower)")
+	logJSONFile := flag.String("log-json-file", "", "A file to also write every log event to as a line of JSON, whatever -pretty is")
 	threads := flag.Int("threads", 500, "The number of lines to read per log message")
+	retryFlag := flag.Int("retries", 3, "The number of times to retry a file after a transient read error")
+	maxLine := flag.Int("max-line", 65536, "The longest line in bytes to crunch, anything past this is dropped")
+	detectType := flag.Bool("detect-type", false, "Work out whether each -files match is a mainlog, rejectlog or paniclog from its lines rather than taking them all to be mainlogs, so mixed directories can be globbed at once")
+	minFree := flag.Int("min-free-space", 100, "The megabytes that must be free where outputs and temp files are written for the run to start, 0 to not check")
+	sniff := flag.Int("sniff", 5, "The number of leading lines to check when deciding if a file is an exim log, 0 to crunch every file")
+	retryWaitFlag := flag.Duration("retry-wait", time.Second, "The wait before the first retry of a file, doubled for each further retry")
 	flag.Parse()
 
+	var console io.Writer = os.Stderr
 	if *pretty {
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		console = zerolog.ConsoleWriter{Out: os.Stderr}
+	}
+	if *logJSONFile != "" {
+		logFile, err := os.OpenFile(*logJSONFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal().Str("name", *logJSONFile).Err(err).Msg("Failed to open JSON log file")
+		}
+		defer logFile.Close()
+		console = zerolog.MultiLevelWriter(console, logFile)
 	}
+	log.Logger = log.Output(console)
 
 	loglevel, err := zerolog.ParseLevel(*level)
 	if err != nil {
@@ -54,71 +172,851 @@ func main() {
 	}
 	zerolog.SetGlobalLevel(loglevel)
 	zerolog.TimeFieldFormat = ""
+	if *backfillFlag {
+		*follow = true
+	}
 
 	log.Info().
-		Str("email", *email).
+		Strs("email", email).
 		Str("files", *glob).
-		Int("frequency", *logFreq).
+		Strs("inputs", inputs).
+		Strs("requiresubstring", required).
+		Str("kubeapi", *kubeAPI).
+		Str("since", *since).
+		Str("until", *until).
+		Dur("querytimeout", *queryTimeout).
+		Str("layout", *layoutName).
+		Str("dir", *dir).
+		Int("days", *days).
+		Str("domainfrompath", *domainFromPath).
+		Bool("follow", *follow).
+		Bool("backfill", *backfillFlag).
+		Dur("followinterval", *followIntervalFlag).
+		Str("metrics", *metrics).
+		Str("wal", *walFlag).
+		Dur("maxduration", *maxDuration).
+		Str("manifest", *manifestFile).
+		Str("trends", *trends).
+		Str("digest", *digest).
+		Str("digestknown", *digestKnown).
+		Str("autocomplete", *autocomplete).
+		Dur("progressinterval", *progressInterval).
+		Int("failiflinesbelow", *linesBelow).
+		Int("failifmatchedbelow", *matchedBelow).
+		Int("failiferrorsabove", *errorsAbove).
 		Str("outfile", *outFileName).
+		Str("format", *format).
+		Int("retentiondays", *retention).
+		Int("examples", *examplesFlag).
+		Str("dedupe", *dedupeFlag).
+		Str("timezone", *timezone).
+		Str("logtimezone", *logTimezone).
+		Str("eximversion", *eximVersion).
+		Str("separator", *separatorFlag).
+		Str("responses", *responses).
+		Str("validrecipients", *validRecipientsFile).
+		Str("unknownrecipients", *unknownRecipients).
+		Int("probethreshold", *probes).
+		Str("smarthosts", *smarthostsFlag).
+		Str("auth", *authFlag).
+		Str("egress", *egressFlag).
+		Str("ip2asn", *ip2asn).
+		Str("typos", *typos).
+		Str("typodomains", *typoDomainsFlag).
+		Int("typodistance", *typoDistanceFlag).
+		Str("tlspolicy", *tlsPolicy).
+		Str("tlsviolations", *tlsViolationsFlag).
+		Str("internaldomains", *internal).
+		Str("rewriterules", *rewriteFile).
+		Bool("unwrapsrs", *srs).
+		Bool("unwrapverp", *verp).
+		Str("onlydirection", *onlyDirection).
+		Str("spoofing", *spoofing).
+		Str("trustednetworks", *trusted).
+		Str("backscatter", *backscatter).
+		Str("acldir", *aclDirFlag).
+		Str("aclfindings", *aclFindingsFlag).
+		Dur("aclexpiry", *aclExpiryFlag).
+		Str("reputation", *reputationFlag).
+		Str("reputationweights", *reputationWeightsFlag).
+		Str("reputationdeny", *reputationDeny).
+		Float64("reputationthreshold", *reputationThresholdFlag).
+		Str("loops", *loopsFlag).
+		Int("loopthreshold", *loopThresholdFlag).
+		Dur("loopwindow", *loopWindowFlag).
+		Str("sample", *sample).
+		Int("samplesize", *sampleSizeFlag).
+		Str("transcripts", *transcripts).
+		Dur("transcripttimeout", *transcriptTimeout).
+		Str("loki", *lokiURL).
+		Str("lokilabels", *lokiLabels).
+		Str("bigquery", *bigQueryTable).
+		Bool("bigquerycolumnpartitioned", *bigQueryColumnPartitioned).
+		Str("stage", *stage).
+		Int("sinkbuffer", *sinkBufferFlag).
+		Bool("approximate", *approximate).
+		Int("sketchwidth", *sketchWidth).
+		Int("sketchdepth", *sketchDepth).
+		Int("top", *top).
+		Int("mincount", *minCountFlag).
+		Str("groupby", *groupBy).
+		Str("providers", *providersFile).
 		Str("level", *level).
-		Str("ignore", *ignore).
+		Strs("ignore", ignore).
+		Str("compare", *compare).
+		Strs("compareemail", compareEmail).
+		Strs("compareignore", compareIgnore).
 		Bool("pretty", *pretty).
+		Str("logjsonfile", *logJSONFile).
+		Int("retries", *retryFlag).
+		Dur("retrywait", *retryWaitFlag).
+		Int("maxline", *maxLine).
+		Int("sniff", *sniff).
+		Bool("detecttype", *detectType).
+		Int("minfreespace", *minFree).
 		Msg("Starting exim4 logfile cruncher")
 
-	ignoreRegex, err = regexp.Compile(*ignore)
+	if *groupBy != "domain" && *groupBy != "provider" {
+		log.Fatal().Str("groupby", *groupBy).Msg("Group by must be one of domain or provider")
+	}
+
+	if err := loadProviders(strings.NewReader(builtinProviders)); err != nil {
+		log.Fatal().Err(err).Msg("Built in providers did not load")
+	}
+	var requiredSubstrings [][]byte
+	for _, substring := range required {
+		requiredSubstrings = append(requiredSubstrings, []byte(substring))
+	}
+	unwrapSRS = *srs
+	unwrapVERP = *verp
+	failLinesBelow = *linesBelow
+	failMatchedBelow = *matchedBelow
+	failErrorsAbove = *errorsAbove
+	loopFile = *loopsFlag
+	loopThreshold = *loopThresholdFlag
+	loopWindow = *loopWindowFlag
+	if *sample != "" {
+		if *sampleSizeFlag < 1 {
+			log.Fatal().Int("samplesize", *sampleSizeFlag).Msg("Sample size must be at least one")
+		}
+		sampleFile = *sample
+		sampleSize = *sampleSizeFlag
+	}
+	if *validRecipientsFile != "" {
+		if err := loadValidRecipients(*validRecipientsFile); err != nil {
+			log.Fatal().Str("name", *validRecipientsFile).Err(err).Msg("Failed to load valid recipients file")
+		}
+		recipientFile = *unknownRecipients
+		probeThreshold = *probes
+	}
+	if *rewriteFile != "" {
+		if err := loadRewriteRules(*rewriteFile); err != nil {
+			log.Fatal().Str("name", *rewriteFile).Err(err).Msg("Failed to load rewrite rules")
+		}
+	}
+	if *tlsPolicy != "" {
+		if err := loadTLSPolicy(*tlsPolicy); err != nil {
+			log.Fatal().Str("name", *tlsPolicy).Err(err).Msg("Failed to load TLS policy file")
+		}
+		tlsFile = *tlsViolationsFlag
+	}
+	if *providersFile != "" {
+		if err := loadProvidersFile(*providersFile); err != nil {
+			log.Fatal().Str("name", *providersFile).Err(err).Msg("Failed to load providers file")
+		}
+	}
+
+	if *approximate {
+		if *sketchWidth < 1 || *sketchDepth < 1 {
+			log.Fatal().Int("sketchwidth", *sketchWidth).Int("sketchdepth", *sketchDepth).Msg("Sketch width and depth must be at least one")
+		}
+	}
+
+	if *minCountFlag < 1 {
+		log.Fatal().Int("mincount", *minCountFlag).Msg("Min count must be at least one")
+	}
+	minCount = *minCountFlag
+
+	if *retention > 0 {
+		if pairFormats[*format] == nil || *approximate {
+			log.Fatal().Str("format", *format).Bool("approximate", *approximate).Msg("Retention needs a pair format, arrow, json, msgpack or protobuf, without -approximate")
+		}
+		retentionDays = *retention
+	}
+	if *eximVersion != "" {
+		if err := setEximVersion(*eximVersion); err != nil {
+			log.Fatal().Str("eximversion", *eximVersion).Err(err).Msg("Failed to pick the exim version's log format")
+		}
+	}
+	if logZone, err = time.LoadLocation(*logTimezone); err != nil {
+		log.Fatal().Str("logtimezone", *logTimezone).Err(err).Msg("Failed to load log timezone")
+	}
+	if *timezone != "" {
+		if reportZone, err = time.LoadLocation(*timezone); err != nil {
+			log.Fatal().Str("timezone", *timezone).Err(err).Msg("Failed to load timezone")
+		}
+	}
+	switch *dedupeFlag {
+	case "pair":
+	case "day", "hour", "message":
+		if *format != "json" || *approximate {
+			log.Fatal().Str("format", *format).Bool("approximate", *approximate).Msg("Dedupe by day, hour or message needs the json format without -approximate")
+		}
+		dedupeKey = *dedupeFlag
+	default:
+		log.Fatal().Str("dedupe", *dedupeFlag).Msg("Dedupe must be one of pair, day, hour or message")
+	}
+	if *examplesFlag > 0 {
+		if *format != "json" || *approximate {
+			log.Fatal().Str("format", *format).Bool("approximate", *approximate).Msg("Examples need the json format without -approximate")
+		}
+		examplesPerPair = *examplesFlag
+	}
+	writeOutput, ok := outputFormats[*format]
+	if !ok {
+		log.Fatal().Str("format", *format).Msg("Format must be grouped, arrow, json, msgpack or protobuf")
+	}
+
+	separator, _ = utf8.DecodeRuneInString(*separatorFlag)
+	if utf8.RuneCountInString(*separatorFlag) != 1 || strings.ContainsRune("\"\r\n\uFFFD", separator) {
+		log.Fatal().Str("separator", *separatorFlag).Msg("Separator must be a single character other than a double quote or line break")
+	}
+
+	setInternalDomains(*internal)
+	if *onlyDirection != "" {
+		switch *onlyDirection {
+		case "inbound", "outbound", "internal", "relay":
+		default:
+			log.Fatal().Str("onlydirection", *onlyDirection).Msg("Only direction must be one of inbound, outbound, internal or relay")
+		}
+		if len(internalDomains) == 0 {
+			log.Fatal().Msg("Only direction needs -internal-domains to know which way mail is going")
+		}
+		directionFilter = *onlyDirection
+	}
+	if *egressFlag != "" && *ip2asn == "" {
+		log.Fatal().Msg("Egress needs -ip2asn to look up where remote IPs are")
+	}
+	if *ip2asn != "" {
+		if err := loadASNRanges(*ip2asn); err != nil {
+			log.Fatal().Str("name", *ip2asn).Err(err).Msg("Failed to load ip2asn file")
+		}
+	}
+	egressFile = *egressFlag
+	authFile = *authFlag
+	smarthostFile = *smarthostsFlag
+	if *digest != "" {
+		if len(internalDomains) == 0 {
+			log.Fatal().Msg("Digest needs -internal-domains to know which users are ours")
+		}
+		if *approximate {
+			log.Fatal().Msg("Digest needs the pairs counted exactly, without -approximate")
+		}
+		if *digestKnown != "" {
+			if err := loadKnownPairs(*digestKnown); err != nil {
+				log.Fatal().Str("name", *digestKnown).Err(err).Msg("Failed to load known pairs")
+			}
+		}
+		digestFile = *digest
+	}
+	if *autocomplete != "" {
+		if *approximate {
+			log.Fatal().Msg("Autocomplete needs the pairs counted exactly, without -approximate")
+		}
+		autocompleteDir = *autocomplete
+	}
+	if *trends != "" {
+		if *approximate {
+			log.Fatal().Msg("Trends needs the pairs counted exactly, without -approximate")
+		}
+		trendsFile = *trends
+	}
+	if *typos != "" {
+		setTypoDomains(*typoDomainsFlag)
+		if len(typoWatched) == 0 {
+			log.Fatal().Msg("Typos needs -internal-domains or -typo-domains to check recipient domains against")
+		}
+		if *typoDistanceFlag < 1 {
+			log.Fatal().Int("typodistance", *typoDistanceFlag).Msg("Typo distance must be at least one")
+		}
+		typoFile = *typos
+		typoDistance = *typoDistanceFlag
+	}
+	if *spoofing != "" || *backscatter != "" || *reputationFlag != "" {
+		if err := setTrustedNetworks(*trusted); err != nil {
+			log.Fatal().Str("trustednetworks", *trusted).Err(err).Msg("Failed to parse trusted networks")
+		}
+	}
+	if *spoofing != "" {
+		if len(internalDomains) == 0 {
+			log.Fatal().Msg("Spoofing needs -internal-domains to know which senders are ours")
+		}
+		spoofingFile = *spoofing
+	}
+	if *backscatter != "" {
+		if len(internalDomains) == 0 {
+			log.Fatal().Msg("Backscatter needs -internal-domains to know which recipients are outside")
+		}
+		backscatterFile = *backscatter
+	}
+	if *reputationDeny != "" && *reputationFlag == "" {
+		log.Fatal().Msg("Reputation deny needs -reputation to score source IPs")
+	}
+	if *reputationFlag != "" {
+		if err := setReputationWeights(*reputationWeightsFlag); err != nil {
+			log.Fatal().Str("reputationweights", *reputationWeightsFlag).Err(err).Msg("Failed to parse reputation weights")
+		}
+		reputationFile = *reputationFlag
+		reputationDenyFile = *reputationDeny
+		reputationThreshold = *reputationThresholdFlag
+	}
+	if *aclDirFlag != "" {
+		if *aclExpiryFlag <= 0 {
+			log.Fatal().Dur("aclexpiry", *aclExpiryFlag).Msg("ACL expiry must be positive")
+		}
+		if *aclFindingsFlag == "" {
+			aclSelected = enabledACLFindings()
+		}
+		for _, name := range strings.Split(*aclFindingsFlag, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			finding, ok := aclFindings[name]
+			if !ok {
+				log.Fatal().Str("aclfindings", *aclFindingsFlag).Str("finding", name).Msg("ACL findings must be reputation, spoofing or harvest")
+			}
+			if !finding.enabled() {
+				log.Fatal().Str("finding", name).Msg("ACL finding needs its report, -reputation, -spoofing or -valid-recipients, turned on")
+			}
+			aclSelected = append(aclSelected, name)
+		}
+		if len(aclSelected) == 0 {
+			log.Fatal().Msg("ACL dir needs -reputation, -spoofing or -valid-recipients to find hosts to deny")
+		}
+		aclDir = *aclDirFlag
+		aclExpiry = *aclExpiryFlag
+	}
+
+	if *host == "" {
+		*host, _ = os.Hostname()
+	}
+	var enrichers []enricher
+	if *transcripts != "" {
+		lookup, err := newTranscriptLookup(*transcripts, *transcriptTimeout)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to set up transcript lookup")
+		}
+		enrichers = append(enrichers, lookup)
+		eventColumns = append(eventColumns, "transcript")
+	}
+	var sinks []sink
+	if *lokiURL != "" {
+		static, err := parseLabels(*lokiStatic)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Loki static labels did not parse")
+		}
+		loki, err := newLokiSink(*lokiURL, *lokiTenant, *host, strings.Split(*lokiLabels, ","), static, *lokiBatch)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to set up Loki sink")
+		}
+		sinks = append(sinks, loki)
+	}
+	if *bigQueryTable != "" {
+		bigQuery, err := newBigQuerySink(*bigQueryTable, *host, *bigQueryBatch, *bigQueryColumnPartitioned)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to set up BigQuery sink")
+		}
+		sinks = append(sinks, bigQuery)
+	}
+	if *stage != "" {
+		if *stageRows < 1 {
+			log.Fatal().Int("stagerows", *stageRows).Msg("Stage rows must be at least one")
+		}
+		staged, err := newStageSink(*stage, *stageTable, *host, *stageRows)
+		if err != nil {
+			log.Fatal().Str("stage", *stage).Err(err).Msg("Failed to set up stage")
+		}
+		sinks = append(sinks, staged)
+	}
+	if len(enrichers) > 0 && len(sinks) == 0 {
+		log.Fatal().Msg("Transcripts are attached to events, which needs -loki, -bigquery or -stage to send them to")
+	}
+	if *sinkBufferFlag < 0 {
+		log.Fatal().Int("sinkbuffer", *sinkBufferFlag).Msg("Sink buffer can't be negative")
+	}
+
+	if *maxLine < 1 {
+		log.Fatal().Int("maxline", *maxLine).Msg("Max line length must be at least one byte")
+	}
+
+	if len(ignore) == 0 {
+		ignore = stringList{"^$"}
+	}
+	ignoreRegex, err := compileSet(ignore)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Ignore regex did not compile")
 	}
 
-	emailRegex, err = regexp.Compile(*email)
+	if len(email) == 0 {
+		email = stringList{".*"}
+	}
+	emailRegex, err := compileSet(email)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Email regex did not compile")
 	}
 
-	fileNames, err := filepath.Glob(*glob)
-	if err != nil {
-		log.Fatal().Str("pattern", *glob).Err(err).Msg("Failed to get files by glob")
+	if *compare != "" {
+		if len(compareEmail) == 0 {
+			compareEmail = email
+		}
+		if len(compareIgnore) == 0 {
+			compareIgnore = ignore
+		}
+		if compareEmailRegex, err = compileSet(compareEmail); err != nil {
+			log.Fatal().Err(err).Msg("Compare email regex did not compile")
+		}
+		if compareIgnoreRegex, err = compileSet(compareIgnore); err != nil {
+			log.Fatal().Err(err).Msg("Compare ignore regex did not compile")
+		}
+		compareFile = *compare
 	}
-	remainingFiles = len(fileNames)
 
-	outFile, err := os.Create(*outFileName)
-	defer outFile.Close()
-	if err != nil {
-		log.Fatal().Str("name", *outFileName).Err(err).Msg("Failed to open output file")
+	var files []inputFile
+	if *layoutName != "" {
+		layout, ok := layouts[*layoutName]
+		if !ok {
+			log.Fatal().Str("layout", *layoutName).Msg("Unknown layout")
+		}
+		files, err = layout.find(*dir, *days)
+		if err != nil {
+			log.Fatal().Str("layout", *layoutName).Err(err).Msg("Failed to find files for layout")
+		}
+	} else {
+		fileNames, err := filepath.Glob(*glob)
+		if err != nil {
+			log.Fatal().Str("pattern", *glob).Err(err).Msg("Failed to get files by glob")
+		}
+		for _, fileName := range fileNames {
+			file := inputFile{name: fileName, kind: mainLog}
+			if *detectType {
+				if kind, ok := sniffType(file); ok {
+					file.kind = kind
+				}
+				log.Debug().Str("name", fileName).Str("type", string(file.kind)).Msg("Detected log type")
+			}
+			files = append(files, file)
+		}
+	}
+	now := time.Now()
+	if queryStart, err = parseTimeFlag(*since, now); err != nil {
+		log.Fatal().Str("since", *since).Err(err).Msg("Since must be an RFC 3339 time or a duration")
+	}
+	if queryEnd, err = parseTimeFlag(*until, now); err != nil {
+		log.Fatal().Str("until", *until).Err(err).Msg("Until must be an RFC 3339 time or a duration")
+	}
+	elasticsearchQuery = *esQuery
+	elasticsearchTime = *esTime
+	elasticsearchField = *esField
+	queryClient.Timeout = *queryTimeout
+
+	for _, input := range inputs {
+		switch {
+		case strings.HasPrefix(input, dockerScheme), strings.HasPrefix(input, podmanScheme):
+			files = append(files, inputFile{name: input, kind: mainLog})
+		case isQueryInput(input), isImportInput(input):
+			files = append(files, inputFile{name: input, kind: mainLog})
+		case strings.HasPrefix(input, kubernetesScheme):
+			if kube == nil {
+				if kube, err = newKubernetesClient(*kubeAPI, *kubeToken, *kubeCA); err != nil {
+					log.Fatal().Err(err).Msg("Failed to set up Kubernetes API client")
+				}
+			}
+			if *follow || *backfillFlag {
+				// Its pods are listed as it is followed, so those started
+				// since are found too.
+				files = append(files, inputFile{name: input, kind: mainLog})
+				continue
+			}
+			pods, err := kube.pods(context.Background(), input)
+			if err != nil {
+				log.Fatal().Str("input", input).Err(err).Msg("Failed to find pods")
+			}
+			log.Info().Str("input", input).Int("containers", len(pods)).Msg("Found pods")
+			files = append(files, pods...)
+		default:
+			log.Fatal().Str("input", input).Msg("Input must be a docker://, podman://, k8s://, loki://, es://, cef:// or jsonl:// source")
+		}
+	}
+
+	files = dedupeFiles(files)
+
+	if *domainFromPath != "" {
+		domainRegex, err := regexp.Compile(*domainFromPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Domain from path regex did not compile")
+		}
+		tagDomain(files, domainRegex)
+	}
+
+	if *minFree < 0 {
+		log.Fatal().Int("minfreespace", *minFree).Msg("Min free space can't be negative")
+	}
+	outputs := []string{*outFileName, *manifestFile, *walFlag, *responses, recipientFile, tlsFile, typoFile, sampleFile,
+		loopFile, spoofingFile, backscatterFile, reputationFile, reputationDenyFile, smarthostFile, authFile, egressFile, compareFile, digestFile, trendsFile}
+	if trendsFile != "" {
+		outputs = append(outputs, trendsFile+".pairs")
+	}
+	if autocompleteDir != "" {
+		outputs = append(outputs, filepath.Join(autocompleteDir, "user.tsv"))
+	}
+	if aclDir != "" {
+		outputs = append(outputs, filepath.Join(aclDir, "acl.conf"))
+	}
+	var spills []string
+	if *stage != "" {
+		if strings.Contains(*stage, "://") {
+			// Parts are written to temp files before they are uploaded.
+			spills = append(spills, os.TempDir())
+		} else {
+			spills = append(spills, *stage)
+		}
+	}
+	if problems := preflight(files, outputs, spills, uint64(*minFree)<<20); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Error().Str("problem", problem).Msg("Preflight check failed")
+		}
+		log.Fatal().Int("problems", len(problems)).Msg("Preflight checks failed")
+	}
+
+	outFile := os.Stdout
+	if *outFileName != "-" {
+		var err error
+		outFile, err = os.Create(*outFileName)
+		defer outFile.Close()
+		if err != nil {
+			log.Fatal().Str("name", *outFileName).Err(err).Msg("Failed to open output file")
+		}
+	}
+
+	maxLineLength = *maxLine
+	sniffLineCount = *sniff
+	responseFile = *responses
+	groupByProvider = *groupBy == "provider"
+	if *metrics != "" {
+		if !*follow {
+			log.Fatal().Msg("Metrics need -follow to be scraped while crunching")
+		}
+		metricsAddress = *metrics
+	}
+	if *walFlag != "" && !*follow {
+		log.Fatal().Msg("Write-ahead log needs -follow, as other runs can simply be run again")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *maxDuration)
+		defer cancel()
+	}
+	phases := [][]inputFile{files}
+	if *backfillFlag {
+		following = true
+		backfill = true
+		rotated, live := splitBackfill(files)
+		phases = [][]inputFile{rotated, live}
+		log.Info().Int("rotated", len(rotated)).Int("live", len(live)).Msg("Backfilling rotated logs before following live ones")
+	}
+	if *follow {
+		following = true
+		followInterval = *followIntervalFlag
+		// Every file followed keeps its worker until interrupted.
+		if *threads < len(files) {
+			*threads = len(files)
+		}
+	}
+	runner := NewRunner(ctx, Config{
+		Email:            emailRegex,
+		Ignore:           ignoreRegex,
+		Required:         requiredSubstrings,
+		Threads:          *threads,
+		Retries:          *retryFlag,
+		RetryWait:        *retryWaitFlag,
+		ProgressInterval: *progressInterval,
+		Approximate:      *approximate,
+		SketchWidth:      *sketchWidth,
+		SketchDepth:      *sketchDepth,
+		Top:              *top,
+		Metrics:          aggregate.ExpvarMetrics("aggregate_"),
+		Sinks:            sinks,
+		SinkBuffer:       *sinkBufferFlag,
+		Enrichers:        enrichers,
+	})
+	if metricsAddress != "" {
+		go func() {
+			if err := serveMetrics(metricsAddress, runner); err != nil {
+				log.Fatal().Str("metrics", metricsAddress).Err(err).Msg("Failed to serve metrics")
+			}
+		}()
+	}
+	if *walFlag != "" {
+		replayer := newWorker(0, inputFile{name: *walFlag})
+		var times fileTimes
+		replayed := 0
+		wal, err = openWAL(*walFlag, func(file inputFile, id fileID, offset int64, line []byte) {
+			runner.resumeAt(file.name, id, offset)
+			// The offset is the line's own, as it was when first read, so
+			// its events get the same record ids again.
+			replayer.offset = offset
+			if err := runner.processLine(file, line, &times, replayer); err != nil {
+				// The log is kept, so it is replayed again next time.
+				log.Fatal().Str("name", *walFlag).Err(err).Msg("Failed to send replayed write-ahead log")
+			}
+			replayed++
+		})
+		if err != nil {
+			log.Fatal().Str("name", *walFlag).Err(err).Msg("Failed to open write-ahead log")
+		}
+		log.Info().Str("name", *walFlag).Int("lines", replayed).Int("files", len(runner.resume)).Msg("Replayed write-ahead log")
+	}
+	runner.Run(phases...)
+	stopped := ""
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		stopped = "max-duration"
+		log.Warn().Dur("maxduration", *maxDuration).Msg("Ran out of time, writing what was crunched so far")
+	case ctx.Err() != nil && !following:
+		stopped = "interrupted"
+		log.Warn().Msg("Interrupted, writing what was crunched so far")
+	case runner.Err() != nil:
+		stopped = "sink-failed"
+		log.Error().Err(runner.Err()).Msg("A sink failed, writing what was crunched so far")
+		if wal != nil {
+			// Keep the log, with the events the sink didn't take, to replay
+			// next time.
+			wal.flush()
+			wal = nil
+		}
+	}
+
+	progress := runner.Progress()
+	log.Info().Int64("count", progress.Matched).Msg("Writing emails to file")
+	runner.closeSinks()
+	if err := writeOutput(runner, outFile); err != nil {
+		log.Error().Str("name", *outFileName).Err(err).Msg("Failed to write output file")
+		if wal != nil {
+			// Keep the log, with everything in it, to replay next time.
+			wal.flush()
+			wal = nil
+		}
 	}
 
-	logFrequency = *logFreq
-	logLineCount = logFrequency
-	sem = make(chan bool, *threads)
-	for _, fileName := range fileNames {
-		sem <- true
-		go processFile(fileName)
+	if compareFile != "" {
+		log.Info().Int("count", len(compareOnly)).Msg("Writing compare to file")
+		if err := writeCompare(compareFile); err != nil {
+			log.Error().Str("name", compareFile).Err(err).Msg("Failed to write compare file")
+		}
 	}
-	for i := 0; i < cap(sem); i++ {
-		sem <- true
+
+	if sampleFile != "" {
+		log.Info().Int("labels", len(samples)).Msg("Writing samples to file")
+		if err := writeSamples(sampleFile); err != nil {
+			log.Error().Str("name", sampleFile).Err(err).Msg("Failed to write samples file")
+		}
 	}
 
-	log.Info().Int("count", matchCount).Msg("Writing emails to file")
-	writer := bufio.NewWriter(outFile)
-	for us, theirEmails := range emails {
-		writer.WriteString(us)
-		for them := range theirEmails {
-			writer.WriteByte(',')
-			writer.WriteString(them)
+	if loopFile != "" {
+		log.Info().Int("count", len(loops)).Msg("Writing loops to file")
+		if err := writeLoops(loopFile); err != nil {
+			log.Error().Str("name", loopFile).Err(err).Msg("Failed to write loops file")
 		}
+	}
 
-		writer.WriteByte('\n')
-		writer.Flush()
-		log.Debug().Str("for", us).Msg("Finished emails")
+	if spoofingFile != "" {
+		log.Info().Int("count", len(spoofCounts)).Msg("Writing spoofing to file")
+		if err := writeSpoofing(spoofingFile); err != nil {
+			log.Error().Str("name", spoofingFile).Err(err).Msg("Failed to write spoofing file")
+		}
+	}
+
+	if backscatterFile != "" {
+		log.Info().Int("count", len(scatters)).Msg("Writing backscatter to file")
+		if err := writeBackscatter(backscatterFile); err != nil {
+			log.Error().Str("name", backscatterFile).Err(err).Msg("Failed to write backscatter file")
+		}
+	}
+
+	if smarthostFile != "" {
+		log.Info().Int("count", len(smarthosts)).Msg("Writing smarthosts to file")
+		if err := writeSmarthosts(smarthostFile); err != nil {
+			log.Error().Str("name", smarthostFile).Err(err).Msg("Failed to write smarthosts file")
+		}
+	}
+
+	if authFile != "" {
+		log.Info().Int("count", len(authUsers)).Msg("Writing auth to file")
+		if err := writeAuth(authFile); err != nil {
+			log.Error().Str("name", authFile).Err(err).Msg("Failed to write auth file")
+		}
+	}
+
+	if reputationFile != "" {
+		log.Info().Int("count", len(reputations)).Msg("Writing reputation to file")
+		if err := writeReputation(reputationFile); err != nil {
+			log.Error().Str("name", reputationFile).Err(err).Msg("Failed to write reputation file")
+		}
+	}
+
+	if reputationDenyFile != "" {
+		denied, err := writeReputationDeny(reputationDenyFile)
+		if err != nil {
+			log.Error().Str("name", reputationDenyFile).Err(err).Msg("Failed to write reputation deny file")
+		}
+		log.Info().Int("count", denied).Msg("Wrote reputation deny list")
+	}
+
+	if aclDir != "" {
+		log.Info().Strs("findings", aclSelected).Msg("Writing ACL to directory")
+		hosts, err := writeACL(time.Now())
+		if err != nil {
+			log.Error().Str("name", aclDir).Err(err).Msg("Failed to write ACL")
+		}
+		log.Info().Int("count", hosts).Msg("Wrote ACL host lists")
+	}
+
+	if egressFile != "" {
+		log.Info().Int("count", len(egressCounts)).Msg("Writing egress to file")
+		if err := writeEgress(egressFile); err != nil {
+			log.Error().Str("name", egressFile).Err(err).Msg("Failed to write egress file")
+		}
+	}
+	if digestFile != "" {
+		log.Info().Int("count", len(runner.firstContacts)).Msg("Writing digest to file")
+		if err := writeDigest(digestFile, runner); err != nil {
+			log.Error().Str("name", digestFile).Err(err).Msg("Failed to write digest file")
+		}
+	}
+
+	if autocompleteDir != "" {
+		log.Info().Int("count", len(runner.pairCounts)).Msg("Writing autocomplete to directory")
+		if err := writeAutocomplete(autocompleteDir, runner); err != nil {
+			log.Error().Str("name", autocompleteDir).Err(err).Msg("Failed to write autocomplete")
+		}
+	}
+
+	if typoFile != "" {
+		log.Info().Int("count", len(typoDomains)).Msg("Writing typos to file")
+		if err := writeTypos(typoFile); err != nil {
+			log.Error().Str("name", typoFile).Err(err).Msg("Failed to write typos file")
+		}
+	}
+
+	if tlsFile != "" {
+		log.Info().Int("count", len(tlsViolations)).Msg("Writing TLS violations to file")
+		if err := writeTLSViolations(tlsFile); err != nil {
+			log.Error().Str("name", tlsFile).Err(err).Msg("Failed to write TLS violations file")
+		}
+	}
+
+	if recipientFile != "" {
+		log.Info().Int("leaks", len(leakedRecipients)).Int("probers", len(probedRecipients)).Msg("Writing unknown recipients to file")
+		if err := writeUnknownRecipients(recipientFile); err != nil {
+			log.Error().Str("name", recipientFile).Err(err).Msg("Failed to write unknown recipients file")
+		}
+	}
+
+	if responseFile != "" {
+		log.Info().Int("count", len(responseCounts)).Msg("Writing responses to file")
+		if err := writeResponses(responseFile); err != nil {
+			log.Error().Str("name", responseFile).Err(err).Msg("Failed to write responses file")
+		}
+	}
+
+	if *manifestFile != "" {
+		m := manifest{
+			Started:       runner.start.UTC().Format(time.RFC3339),
+			Stopped:       stopped,
+			Output:        *outFileName,
+			Format:        *format,
+			SchemaVersion: outputSchemaVersion,
+			Lines:         progress.Lines,
+			Matched:       progress.Matched,
+		}
+		if err := runner.writeManifest(*manifestFile, m); err != nil {
+			log.Error().Str("name", *manifestFile).Err(err).Msg("Failed to write manifest")
+		}
+	}
+
+	if trendsFile != "" {
+		t := trend{Started: runner.start.UTC().Format(time.RFC3339), Partial: stopped != "", Lines: progress.Lines, Senders: progress.Senders}
+		if err := appendTrend(trendsFile, t, runner.emails); err != nil {
+			log.Error().Str("name", trendsFile).Err(err).Msg("Failed to append trends")
+		}
+	}
+
+	if wal != nil {
+		if err := wal.remove(); err != nil {
+			log.Error().Err(err).Msg("Failed to remove write-ahead log")
+		}
 	}
 
 	log.Info().
-		Int("lines", lineCount).
-		Int("matched", matchCount).
-		Int("ignored", ignoreCount).
-		Int("from", fromCount).
-		Dur("elapsed", time.Since(startTime)).
+		Int64("lines", progress.Lines).
+		Int64("matched", progress.Matched).
+		Int64("ignored", progress.Ignored).
+		Int64("filtered", runner.filtered.Load()).
+		Int64("from", progress.Senders).
+		Int64("bytes", progress.Bytes).
+		Int("transient", runner.errorCounts[transientError]).
+		Int("permanent", runner.errorCounts[permanentError]).
+		Int64("retries", runner.retried.Load()).
+		Int64("truncated", runner.truncated.Load()).
+		Int64("long", runner.long.Load()).
+		Int64("skipped", runner.skipped.Load()).
+		Int64("rejected", runner.rejected.Load()).
+		Int64("panics", runner.panics.Load()).
+		Int("sinkerrors", runner.sinkErrors).
+		Dur("elapsed", time.Since(runner.start)).
 		Msg("Finished crunching logfiles")
+
+	rates := runner.sortedRates()
+	log.Info().
+		Float64("p50", percentile(rates, 50)).
+		Float64("p90", percentile(rates, 90)).
+		Float64("p99", percentile(rates, 99)).
+		Dur("read", runner.totalTimes.read).
+		Dur("decompress", runner.totalTimes.decompress).
+		Dur("parse", runner.totalTimes.parse).
+		Dur("aggregate", runner.totalTimes.aggregate).
+		Msg("Crunching throughput in lines per second per file")
+
+	if others := otherVersionIDs.Load(); others > 0 {
+		log.Warn().Str("eximversion", *eximVersion).Int64("lines", others).Msg("Lines had exim ids of another release than -exim-version, so were crunched as about no message, check it matches the exim that wrote the logs")
+	}
+
+	for domain, count := range runner.domainCounts {
+		log.Info().Str("domain", domain).Int("matched", count).Msg("Finished domain")
+	}
+
+	if runner.Err() != nil {
+		os.Exit(1)
+	}
+	if broken := brokenThresholds(runner); len(broken) > 0 {
+		log.Error().Strs("broken", broken).Msg("Run broke its thresholds")
+		os.Exit(thresholdExitCode)
+	}
+}
+
+// compileSet compiles patterns into one regex matching whatever any of them
+// would, so a line takes a single pass however many there are.
+func compileSet(patterns []string) (*regexp.Regexp, error) {
+	groups := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+		groups[i] = "(?:" + pattern + ")"
+	}
+	return regexp.Compile(strings.Join(groups, "|"))
 }
 
 const letterDiff = 'A' - 'a'
@@ -130,80 +1028,415 @@ func toLower(r rune) rune {
 	return r
 }
 
-func processFile(fileName string) {
-	defer func() { <-sem }()
-	inFile, err := os.Open(fileName)
-	defer inFile.Close()
+// normalizeAddress lower cases address and applies any -rewrite rules, so
+// the ways one mailbox is written group together.
+func normalizeAddress(address []byte) []byte {
+	address = bytes.Map(toLower, address)
+	if len(rewriteRules) > 0 {
+		address = rewrite(address)
+	}
+	return address
+}
+
+func (r *Runner) processFile(file inputFile, id int) {
+	defer func() { r.workers <- id }()
+	w := newWorker(id, file)
+	w.log.Info().Str("type", string(file.kind)).Str("domain", file.domain).Int64("remaining", r.Progress().Remaining).Msg("Reading file")
+
+	var times fileTimes
+	var lines int
+	fileStart := time.Now()
+	defer func() { r.recordTimes(times, lines, time.Since(fileStart)) }()
+	if following && strings.HasPrefix(file.name, kubernetesScheme) {
+		r.followPods(file, w)
+		r.done.Add(1)
+		return
+	}
+	if info, err := os.Stat(file.name); err == nil && canFollow(file) {
+		w.identity, _ = identify(info)
+	}
+	var offset int64
+	if resume, ok := r.resume[file.name]; ok {
+		offset = resume.offset
+		// The file logged was rotated away since, so it is finished from
+		// where it was logged to and the new one read from the start.
+		if resume.id != w.identity {
+			w.log.Info().Int64("logged", offset).Msg("File was rotated since the write-ahead log was written")
+			r.finishRotated(file, resume.id, offset, &times, &lines, w)
+			offset = 0
+		}
+	}
+	if started, live := liveIdentities[file.name]; live && started != w.identity {
+		r.finishRotated(file, started, offset, &times, &lines, w)
+		offset = 0
+	}
+	offset, ok := r.crunchFile(file, offset, &times, &lines, w)
+	for ok && canFollow(file) && waitToFollow(r.ctx) {
+		if wal != nil {
+			if err := wal.flush(); err != nil {
+				w.log.Error().Err(err).Msg("Failed to write to write-ahead log")
+			}
+		}
+		var there bool
+		before, previous := offset, w.identity
+		if offset, there = refollow(file, offset, &w.identity, w); there {
+			if w.identity != previous {
+				r.finishRotated(file, previous, before, &times, &lines, w)
+			}
+			offset, ok = r.crunchFile(file, offset, &times, &lines, w)
+		}
+	}
+	r.finishedFile(file, offset, ok, r.ctx.Err() != nil)
+
+	r.done.Add(1)
+	w.log.Debug().Dur("elapsed", time.Since(r.start)).Msg("Finished reading file")
+}
+
+// crunchFile reads file on from offset, retrying transient errors, and
+// returns the offset it got to and whether it got to the end.
+func (r *Runner) crunchFile(file inputFile, offset int64, times *fileTimes, lines *int, w *worker) (int64, bool) {
+	fileName := file.name
+	for attempt := 0; ; attempt++ {
+		read, err := r.readFile(file, offset, times, lines, w)
+		offset += read
+		w.offset = offset
+		if err == nil {
+			return offset, true
+		}
+		if r.ctx.Err() != nil && err == r.ctx.Err() {
+			w.log.Info().Msg("Stopped reading file")
+			return offset, false
+		}
+		var failed sinkError
+		if errors.As(err, &failed) {
+			w.log.Error().Err(err).Msg("Stopping as a sink failed")
+			r.stop(err)
+			return offset, false
+		}
+		if err == errNotExim {
+			w.log.Warn().Msg("Skipping file that does not look like an exim log")
+			r.skipped.Add(1)
+			return offset, false
+		}
+
+		class := classifyError(fileName, err)
+		if class == salvageableError {
+			// A gzip cut off mid-rotation still holds everything up to the
+			// cut, all of which has already been crunched, and reads the same
+			// however often it is retried, so keep it.
+			w.log.Warn().Msg("Salvaged truncated gzip file")
+			r.truncated.Add(1)
+			return offset, false
+		}
+		r.recordError(class)
+		if class == permanentError || attempt >= r.config.Retries {
+			w.log.Error().Str("class", string(class)).Int("attempts", attempt+1).Err(err).Msg("Giving up on file")
+			return offset, false
+		}
+
+		wait := r.config.RetryWait << uint(attempt)
+		w.log.Warn().Dur("wait", wait).Err(err).Msg("Transient error reading file, retrying")
+		time.Sleep(wait)
+		r.retried.Add(1)
+	}
+}
+
+// readFile crunches file starting skip bytes into its (decompressed) content
+// and returns how many further bytes of whole lines it consumed. Where the
+// time went is added to times and the lines crunched to lines.
+func (r *Runner) readFile(file inputFile, skip int64, times *fileTimes, lines *int, w *worker) (int64, error) {
+	fileName := file.name
+	inFile, err := openInput(r.ctx, file)
 	if err != nil {
-		log.Error().Str("name", fileName).Err(err).Msg("Could not open file")
+		return 0, err
 	}
+	defer inFile.Close()
+	timedFile := timedReader{reader: inFile, spent: &times.read}
 
 	var reader *bufio.Reader
 	if filepath.Ext(fileName) == ".gz" {
-		gzReader, err := gzip.NewReader(inFile)
-		defer gzReader.Close()
+		gzReader, err := newGzipMembers(timedFile)
 		if err != nil {
-			log.Error().Str("name", fileName).Err(err).Msg("Could not read gzipped file")
+			return 0, err
 		}
-		reader = bufio.NewReader(gzReader)
+		// Reading the decompressed lines reads the file underneath, so the
+		// time that took is taken back out of decompressing.
+		var decompressing time.Duration
+		readBefore := times.read
+		defer func() { times.decompress += decompressing - (times.read - readBefore) }()
+		defer func() {
+			gzReader.Close()
+			w.log.Debug().Int("members", gzReader.members).Msg("Finished gzip members")
+		}()
+		reader = bufio.NewReader(timedReader{reader: gzReader, spent: &decompressing})
 	} else {
-		reader = bufio.NewReader(inFile)
+		reader = bufio.NewReader(timedFile)
 	}
 
-	log.Info().Str("name", fileName).Int("remaining", remainingFiles).Msg("Reading file")
-	for {
-		if logLineCount <= 0 {
-			logLineCount = logFrequency
-			log.Info().
-				Int("lines", lineCount).
-				Int("matched", matchCount).
-				Int("ignored", ignoreCount).
-				Int("from", fromCount).
-				Msg("Crunching progress")
+	// A followed pod's stream has no end to peek ahead to, only lines yet
+	// to be written.
+	if skip == 0 && sniffLineCount > 0 && !isFollowedPod(file) && !looksLikeExim(reader) {
+		return 0, errNotExim
+	}
+
+	if skip > 0 {
+		// A plain local file can be seeked straight to where the last read
+		// got to, rather than read through again, which matters when
+		// following a log that keeps growing.
+		if seeker, ok := inFile.(io.Seeker); ok && filepath.Ext(fileName) != ".gz" {
+			if _, err := seeker.Seek(skip, io.SeekStart); err != nil {
+				return 0, err
+			}
+			reader.Reset(timedFile)
+		} else if _, err := io.CopyN(ioutil.Discard, reader, skip); err != nil {
+			return 0, err
 		}
+	}
 
-		line, err := reader.ReadBytes('\n')
+	w.offset = skip
+	var read int64
+	var line []byte
+	var frames unframer
+	stopped := r.ctx.Done()
+	for {
+		select {
+		case <-stopped:
+			return read, r.ctx.Err()
+		default:
+		}
+		var size int64
+		var long bool
+		line, size, long, err = readLine(reader, line)
+		if err == io.EOF && len(line) > 0 && !canFollow(file) {
+			// A file that is done being written and doesn't end in a newline
+			// still has a whole last line.
+			err = nil
+		}
 		if err != nil {
 			if err == io.EOF {
-				break
-			} else {
-				log.Error().Str("name", fileName).Err(err).Msg("Could not read file")
-				return
+				// The end of a followed log can be a line exim is still part
+				// way through writing. It is left unread, so the next poll
+				// reads it again from its start once it is whole, rather
+				// than crunching the half written so far.
+				if len(line) > 0 {
+					w.log.Debug().Int64("length", size).Msg("Waiting for the rest of the last line")
+				}
+				return read, nil
 			}
+			return read, err
+		}
+		if long {
+			w.log.Debug().Int64("length", size).Msg("Truncated long line")
+			r.long.Add(1)
+		}
+		read += size
+		r.bytes.Add(size)
+		w.offset = skip + read
+		unframed := frames.unframe(line)
+		if unframed == nil {
+			continue
 		}
 
-		matches := lineMatch.FindSubmatch(line)
-		if matches != nil {
-			from := matches[1]
-			if !emailRegex.Match(from) {
-				ignoreCount++
-				continue
+		parseStart := time.Now()
+		aggregateBefore := times.aggregate
+		switch file.kind {
+		case mainLog:
+			if wal != nil && canFollow(file) {
+				if err := wal.append(file.name, w.identity, skip+read, unframed); err != nil {
+					return read, err
+				}
 			}
-
-			to := matches[2]
-			if ignore := ignoreRegex.Match(to); ignore {
-				ignoreCount++
-				continue
+			if err := r.processLine(file, unframed, times, w); err != nil {
+				return read, err
+			}
+		case rejectLog:
+			if eximTimestamp.Match(unframed) {
+				r.rejected.Add(1)
 			}
+		case panicLog:
+			if eximTimestamp.Match(unframed) {
+				w.log.Warn().Bytes("line", bytes.TrimSpace(unframed)).Msg("Exim panicked")
+				r.panics.Add(1)
+			}
+		}
+		times.parse += time.Since(parseStart) - (times.aggregate - aggregateBefore)
+		*lines++
+		r.lines.Add(1)
+	}
+}
+
+// readLine reads through the next newline into line, keeping at most
+// maxLineLength bytes so a binary file without newlines can't grow the buffer
+// without bound. It returns every byte consumed in size, and long is set when
+// some of them were dropped.
+func readLine(reader *bufio.Reader, line []byte) ([]byte, int64, bool, error) {
+	line = line[:0]
+	var size int64
+	long := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		size += int64(len(chunk))
+		if room := maxLineLength - len(line); len(chunk) > room {
+			chunk = chunk[:room]
+			long = true
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return line, size, long, err
+		}
+	}
+}
 
-			fromAsString := string(bytes.Map(toLower, from))
-			toAsString := string(bytes.Map(toLower, to))
-			writeLock.Lock()
-			val, ok := emails[fromAsString]
-			if ok {
-				val[toAsString] = true
-			} else {
-				fromCount++
-				emails[fromAsString] = map[string]bool{toAsString: true}
+// containsAny reports whether line holds any of substrings.
+func containsAny(line []byte, substrings [][]byte) bool {
+	for _, substring := range substrings {
+		if bytes.Contains(line, substring) {
+			return true
+		}
+	}
+	return false
+}
+
+// needsRecord reports whether the Runner's sinks or any of the reports want
+// line parsed.
+func (r *Runner) needsRecord(line []byte) bool {
+	return len(r.streams) > 0 ||
+		(responseFile != "" && isResponseLine(line)) ||
+		(recipientFile != "" && isRecipientLine(line)) ||
+		(spoofingFile != "" && isArrivalLine(line)) ||
+		(backscatterFile != "" && isBackscatterLine(line)) ||
+		(smarthostFile != "" && isSmarthostLine(line)) ||
+		(authFile != "" && isAuthLine(line)) ||
+		(reputationFile != "" && isReputationLine(line)) ||
+		(loopFile != "" && isLoopLine(line)) ||
+		((metricsAddress != "" || egressFile != "") && isMessageLine(line)) ||
+		(sampleFile != "" && isSampleLine(line)) ||
+		(tlsFile != "" && isTLSLine(line)) ||
+		(trendsFile != "" && (isMessageLine(line) || isResponseLine(line)))
+}
+
+// processLine crunches a line of file, returning an error only when the
+// sinks failed to take its event.
+func (r *Runner) processLine(file inputFile, line []byte, times *fileTimes, w *worker) error {
+	if len(r.config.Required) > 0 && !containsAny(line, r.config.Required) {
+		r.filtered.Add(1)
+		return nil
+	}
+
+	if r.needsRecord(line) {
+		if rec, err := parseLine(string(line)); err == nil {
+			rec.time = w.resolve(rec.time)
+			if responseFile != "" {
+				countResponse(rec)
+			}
+			if recipientFile != "" {
+				checkRecipient(rec)
+			}
+			if spoofingFile != "" {
+				checkSpoofing(rec)
+			}
+			if loopFile != "" {
+				checkLoop(rec)
+			}
+			if backscatterFile != "" {
+				checkBackscatter(rec)
+			}
+			if metricsAddress != "" {
+				checkLatency(rec)
+			}
+			if sampleFile != "" {
+				checkSample(rec)
+			}
+			if tlsFile != "" {
+				checkTLSPolicy(rec)
+			}
+			if egressFile != "" {
+				checkEgress(rec)
+			}
+			if smarthostFile != "" {
+				checkSmarthost(rec)
+			}
+			if authFile != "" {
+				checkAuth(rec)
+			}
+			if reputationFile != "" {
+				checkReputation(rec)
+			}
+			if trendsFile != "" {
+				checkTrend(rec)
+			}
+			if len(r.streams) > 0 {
+				e := event{id: recordID(file.name, w.offset, rec.id), file: file, line: strings.TrimRight(string(line), "\r\n"), record: rec}
+				if err := r.sendEvent(e, w); err != nil {
+					return err
+				}
 			}
-			writeLock.Unlock()
-			matchCount++
 		}
+	}
+
+	matches := lineMatch.FindSubmatch(line)
+	if matches == nil {
+		return nil
+	}
+
+	from := matches[1]
+	if unwrapSRS || unwrapVERP {
+		from = []byte(unwrapSender(string(from)))
+	}
+	to := matches[2]
+	if compareFile != "" {
+		compareFilters(from, to, r.config.Email.Match(from) && !r.config.Ignore.Match(to))
+	}
 
-		lineCount++
-		logLineCount--
+	if !r.config.Email.Match(from) {
+		r.ignored.Add(1)
+		return nil
 	}
 
-	remainingFiles--
-	log.Debug().Str("file", fileName).Dur("elapsed", time.Since(startTime)).Msg("Finished reading file")
+	if ignore := r.config.Ignore.Match(to); ignore {
+		r.ignored.Add(1)
+		return nil
+	}
+
+	from, to = normalizeAddress(from), normalizeAddress(to)
+	if directionFilter != "" && direction(string(from), string(to)) != directionFilter {
+		r.ignored.Add(1)
+		return nil
+	}
+	if typoFile != "" {
+		checkTypo(string(from), string(to))
+	}
+	aggregateStart := time.Now()
+	r.lock.Lock()
+	if r.pairSketch != nil {
+		key := append(append(from, pairSeparator...), to...)
+		r.topPairs.offer(key, r.pairSketch.add(key))
+	} else {
+		fromID, toID, first := r.emails.Add(aggregate.Record{From: from, To: to})
+		if first {
+			r.senders.Add(1)
+		}
+		if retentionDays > 0 {
+			r.seen(fromID, toID, line, w)
+		}
+		if examplesPerPair > 0 {
+			r.example(fromID, toID, line)
+		}
+		if dedupeKey != "pair" {
+			r.dedupe(fromID, toID, line, w)
+		}
+		if digestFile != "" {
+			r.firstContact(fromID, toID, from, to, line)
+		}
+		if autocompleteDir != "" || minCount > 1 {
+			r.pairCounts[pairID(fromID, toID)]++
+		}
+	}
+	if file.domain != "" {
+		r.domainCounts[file.domain]++
+	}
+	r.lock.Unlock()
+	times.aggregate += time.Since(aggregateStart)
+	r.matched.Add(1)
+	return nil
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+)
+
+// fileStatus is how far a run got through one of its files: complete when
+// it was read to the end, stopped when the run was cut short part way and
+// unread when it was skipped or given up on.
+type fileStatus struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Status string `json:"status"`
+}
+
+// manifest describes a run and what it wrote, so whatever picks up the
+// output can tell a partial run from a whole one.
+type manifest struct {
+	Started       string       `json:"started"`
+	Finished      string       `json:"finished"`
+	Partial       bool         `json:"partial"`
+	Stopped       string       `json:"stopped,omitempty"`
+	Output        string       `json:"output"`
+	Format        string       `json:"format"`
+	SchemaVersion int          `json:"schema_version"`
+	Lines         int64        `json:"lines"`
+	Matched       int64        `json:"matched"`
+	Files         []fileStatus `json:"files"`
+}
+
+// finishedFile notes how far the run got through file, and whether it was
+// stopped before it got to the end.
+func (r *Runner) finishedFile(file inputFile, offset int64, read, stopped bool) {
+	status := fileStatus{Name: file.name, Offset: offset, Status: "complete"}
+	switch {
+	case read:
+	case stopped:
+		status.Status = "stopped"
+	default:
+		status.Status = "unread"
+	}
+	r.statsLock.Lock()
+	r.fileStatuses = append(r.fileStatuses, status)
+	r.statsLock.Unlock()
+}
+
+// writeManifest writes m, with the Runner's files in name order, as JSON.
+func (r *Runner) writeManifest(fileName string, m manifest) error {
+	sort.Slice(r.fileStatuses, func(i, j int) bool { return r.fileStatuses[i].Name < r.fileStatuses[j].Name })
+	m.Files = r.fileStatuses
+	m.Finished = time.Now().UTC().Format(time.RFC3339)
+	for _, file := range m.Files {
+		if file.Status == "stopped" {
+			m.Partial = true
+		}
+	}
+
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+	encoder := json.NewEncoder(outFile)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(m)
+}
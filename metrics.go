@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// histogram counts observations into cumulative buckets the way a
+// Prometheus histogram does, with counts[i] those no bigger than
+// latencyBuckets[i].
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// quantile estimates the pth percentile of the observations the way
+// Prometheus' histogram_quantile does, interpolating linearly within the
+// bucket it falls in. Those beyond the last bucket are given its bound.
+func (h *histogram) quantile(p float64) float64 {
+	rank := p / 100 * float64(h.count)
+	lower, below := 0.0, uint64(0)
+	for i, bound := range latencyBuckets {
+		if float64(h.counts[i]) >= rank {
+			if h.counts[i] == below {
+				return bound
+			}
+			return lower + (bound-lower)*(rank-float64(below))/float64(h.counts[i]-below)
+		}
+		lower, below = bound, h.counts[i]
+	}
+	return lower
+}
+
+var (
+	metricsAddress = ""
+	// latencyBuckets are the upper bounds in seconds of the delivery latency
+	// buckets, from a second through to a day in the queue.
+	latencyBuckets = []float64{1, 5, 15, 30, 60, 300, 900, 3600, 14400, 86400}
+	// latencies are the delivery latency histograms by destination provider.
+	latencies = make(map[string]*histogram)
+	// arrivals are when each message in flight arrived.
+	arrivals    = newInFlight()
+	latencyLock = sync.Mutex{}
+)
+
+// isMessageLine is a quick check for lines that may be arrivals, deliveries
+// or completions, before going to the trouble of parsing them.
+func isMessageLine(line []byte) bool {
+	return isArrivalLine(line) || bytes.Contains(line, deliveryMarker) || bytes.Contains(line, routedMarker) ||
+		bytes.Contains(line, completedMarker)
+}
+
+// checkLatency notes when each message arrived by its exim id and observes
+// how long each delivery of it took from then, under the provider of the
+// domain it went to.
+func checkLatency(r record) {
+	if r.id == "" {
+		return
+	}
+
+	latencyLock.Lock()
+	defer latencyLock.Unlock()
+	switch {
+	case r.flag == "<=":
+		arrivals.track(r.id, r.time)
+	case r.flag == "=>" || r.flag == "->":
+		arrived, ok := arrivals.get(r.id)
+		if !ok {
+			return
+		}
+		provider := providerOf(domainOf(r.address), r.host())
+		h := latencies[provider]
+		if h == nil {
+			h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+			latencies[provider] = h
+		}
+		h.observe(r.time.Sub(arrived.(time.Time)).Seconds())
+	case r.flag == "" && r.message == "Completed":
+		arrivals.complete(r.id)
+	}
+}
+
+// serveMetrics serves the crunching counters and delivery latencies for
+// Prometheus to scrape from /metrics on address, the same counters and the
+// aggregator's as expvars on /debug/vars, and an OpenAPI description of
+// them on /openapi.json.
+func serveMetrics(address string, runner *Runner) error {
+	expvar.Publish("crunch", expvar.Func(func() interface{} { return runner.Progress() }))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) { writeMetrics(w, runner) })
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/openapi.json", serveOpenAPI)
+	return http.ListenAndServe(address, mux)
+}
+
+// writeMetrics writes the metrics in the Prometheus text exposition format.
+func writeMetrics(w http.ResponseWriter, runner *Runner) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP exim_lines_total Mainlog lines crunched.\n# TYPE exim_lines_total counter\nexim_lines_total %d\n", runner.lines.Load())
+	fmt.Fprintf(w, "# HELP exim_matched_total Lines matched as a sender and recipient pair.\n# TYPE exim_matched_total counter\nexim_matched_total %d\n", runner.matched.Load())
+
+	latencyLock.Lock()
+	defer latencyLock.Unlock()
+	providers := make([]string, 0, len(latencies))
+	for provider := range latencies {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	fmt.Fprintf(w, "# HELP exim_messages_in_flight Messages that have arrived but not completed.\n# TYPE exim_messages_in_flight gauge\nexim_messages_in_flight %d\n", arrivals.len())
+	fmt.Fprintf(w, "# HELP exim_delivery_latency_seconds Time from a message arriving to each delivery of it, by destination provider.\n# TYPE exim_delivery_latency_seconds histogram\n")
+	for _, provider := range providers {
+		h := latencies[provider]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "exim_delivery_latency_seconds_bucket{provider=%q,le=%q} %d\n", provider, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "exim_delivery_latency_seconds_bucket{provider=%q,le=\"+Inf\"} %d\n", provider, h.count)
+		fmt.Fprintf(w, "exim_delivery_latency_seconds_sum{provider=%q} %s\n", provider, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "exim_delivery_latency_seconds_count{provider=%q} %d\n", provider, h.count)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestHistogramQuantileInterpolatesWithinBuckets(t *testing.T) {
+	h := histogram{counts: make([]uint64, len(latencyBuckets))}
+	for _, seconds := range []float64{2, 3, 4, 4, 100000} {
+		h.observe(seconds)
+	}
+	for _, test := range []struct {
+		p    float64
+		want float64
+	}{
+		{0, 1},
+		{40, 3},
+		{80, 5},
+		{100, 86400},
+	} {
+		if got := h.quantile(test.p); got != test.want {
+			t.Errorf("p%v is %v, want %v", test.p, got, test.want)
+		}
+	}
+}
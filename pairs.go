@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+// pair is a record of the formats written a pair at a time. Count is only
+// set for the -approximate top pairs, and lastSeen and expires only with
+// -retention-days, as YYYY-MM-DD dates. Examples are the lines the pair was
+// seen on that -examples kept, and day or message the row's -dedupe key
+// beyond the pair itself.
+type pair struct {
+	from     string
+	to       string
+	count    int64
+	lastSeen string
+	expires  string
+	examples []string
+	day      string
+	start    string
+	end      string
+	message  string
+}
+
+// minCount is the fewest messages a pair must be seen in to be written.
+var minCount = 1
+
+// frequent reports whether the pair was seen in at least -min-count
+// messages.
+func (r *Runner) frequent(from, to uint32) bool {
+	return minCount <= 1 || r.pairCounts[pairID(from, to)] >= minCount
+}
+
+// pairWriter writes pairs in one of the formats written a pair at a time.
+type pairWriter interface {
+	write(p pair) error
+	close() error
+}
+
+// pairFormats make a pairWriter on w, writing the count of each pair when
+// counted and its retention dates when stamped.
+var pairFormats = map[string]func(w io.Writer, counted, stamped bool) (pairWriter, error){
+	"arrow":    newArrowPairWriter,
+	"json":     newJSONPairWriter,
+	"msgpack":  newMessagePackWriter,
+	"protobuf": newProtobufWriter,
+}
+
+// pairReaders read pairs back from each of the pair formats, returning the
+// output schema version they were written with.
+var pairReaders = map[string]func(r *bufio.Reader, fn func(p pair) error) (string, error){
+	"arrow":    readArrowPairs,
+	"json":     readJSON,
+	"msgpack":  readMessagePack,
+	"protobuf": readProtobuf,
+}
+
+// writePairs makes the output function for a pair format, which writes
+// every pair.
+func writePairs(format string) func(r *Runner, w io.Writer) error {
+	return func(r *Runner, w io.Writer) error {
+		writer, err := pairFormats[format](w, r.pairSketch != nil, retentionDays > 0)
+		if err != nil {
+			return err
+		}
+		if err := r.eachPair(writer.write); err != nil {
+			return err
+		}
+		return writer.close()
+	}
+}
+
+// eachPair calls fn with every pair seen at least -min-count times, the
+// -approximate top pairs with their counts first, and stops at the first
+// error.
+func (r *Runner) eachPair(fn func(p pair) error) error {
+	if r.pairSketch != nil {
+		for _, hitter := range r.topPairs.top() {
+			if int(hitter.count) < minCount {
+				continue
+			}
+			from, to := splitPair(hitter.key)
+			if err := fn(pair{from: from, to: to, count: int64(hitter.count)}); err != nil {
+				return err
+			}
+		}
+	}
+	if dedupeKey != "pair" {
+		return r.eachDedupeRow(fn)
+	}
+	var err error
+	r.emails.Each(func(from uint32, recipients []uint32) bool {
+		for _, to := range recipients {
+			if !r.frequent(from, to) {
+				continue
+			}
+			p := pair{from: r.emails.Name(from), to: r.emails.Name(to)}
+			if retentionDays > 0 {
+				p.stamp(r.lastSeen[pairID(from, to)])
+			}
+			if examplesPerPair > 0 {
+				p.examples = r.pairExamples[pairID(from, to)].lines()
+			}
+			if err = fn(p); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	return err
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// record is a mainlog line split into its parts. Fields holds the K=value
+// fields keyed by K, plus "for" with the recipients of <= lines.
+type record struct {
+	time     time.Time
+	id       string
+	flag     string
+	address  string
+	original string
+	fields   map[string]string
+	message  string
+}
+
+const timestampLayout = "2006-01-02 15:04:05"
+
+var (
+	errNoTimestamp = errors.New("line does not start with a timestamp")
+
+	fieldName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*=`)
+	lineFlags = map[string]bool{"<=": true, "(=": true, "=>": true, "->": true, ">>": true, "*>": true, "**": true, "==": true}
+)
+
+// parseLine splits a mainlog line into a record, only failing when the line
+// has no timestamp at all. Lines about no particular message leave id and flag
+// empty with their text in message.
+func parseLine(line string) (record, error) {
+	line = strings.TrimRight(line, "\r\n")
+	timestamp, rest, err := parseTimestamp(line)
+	if err != nil {
+		return record{}, err
+	}
+
+	r := record{time: timestamp, fields: make(map[string]string)}
+	if word, after := nextWord(rest); strings.HasPrefix(word, "[") && strings.HasSuffix(word, "]") && word != "[]" && !strings.Contains(word, ".") && !strings.Contains(word, ":") {
+		rest = after
+	}
+	if word, after := nextWord(rest); isMessageID(word) {
+		r.id = word
+		rest = after
+	}
+	if word, after := nextWord(rest); lineFlags[word] {
+		r.flag = word
+		r.address, rest = nextWord(after)
+		for {
+			word, after := nextWord(rest)
+			if !(strings.HasPrefix(word, "<") && strings.HasSuffix(word, ">")) && !(strings.HasPrefix(word, "(") && strings.HasSuffix(word, ")")) {
+				break
+			}
+			if r.original == "" {
+				r.original = strings.Trim(word, "<>()")
+			}
+			rest = after
+		}
+	}
+
+	r.parseFields(rest)
+	return r, nil
+}
+
+// parseFields pulls the K=value fields out of rest into r. Values may be
+// quoted, H= style host fields soak up the (helo) and [ip] parts after them,
+// and the first word ending in a colon starts the free text message.
+func (r *record) parseFields(rest string) {
+	var text []string
+	for rest != "" {
+		var word string
+		if name := fieldName.FindString(rest); name != "" {
+			key := name[:len(name)-1]
+			var value string
+			value, rest = fieldValue(rest[len(name):])
+			for {
+				next, after := nextWord(rest)
+				if next == "" || !(next[0] == '(' || next[0] == '[') {
+					break
+				}
+				value += " " + next
+				rest = after
+			}
+			if strings.HasSuffix(value, ":") && !strings.HasPrefix(value, `"`) {
+				r.fields[key] = strings.TrimSuffix(value, ":")
+				text = append(text, strings.TrimSpace(rest))
+				break
+			}
+			r.fields[key] = strings.Trim(value, `"`)
+			continue
+		}
+
+		word, rest = nextWord(rest)
+		if word == "for" && r.flag == "<=" {
+			r.fields["for"] = strings.TrimSpace(rest)
+			break
+		}
+		if strings.HasSuffix(word, ":") {
+			text = append(text, word+" "+strings.TrimSpace(rest))
+			break
+		}
+		text = append(text, word)
+	}
+	r.message = strings.TrimSpace(strings.Join(text, " "))
+}
+
+// fieldValue reads a field value from the start of s, keeping quoted values
+// whole, and returns it along with what follows it.
+func fieldValue(s string) (string, string) {
+	if !strings.HasPrefix(s, `"`) {
+		return nextWord(s)
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return s[:i+1], strings.TrimLeft(s[i+1:], " ")
+		}
+	}
+	return s, ""
+}
+
+// nextWord splits off the space separated word at the start of s.
+func nextWord(s string) (string, string) {
+	s = strings.TrimLeft(s, " ")
+	if end := strings.IndexByte(s, ' '); end >= 0 {
+		return s[:end], strings.TrimLeft(s[end:], " ")
+	}
+	return s, ""
+}
+
+// domainOf is the lowercased part of address after its last @.
+func domainOf(address string) string {
+	address = strings.Trim(address, "<>")
+	return strings.ToLower(address[strings.LastIndexByte(address, '@')+1:])
+}
+
+// parseTimestamp reads the timestamp line starts with, with any fraction of
+// a second and the offset exim adds with log_timezone, and returns it and
+// the rest of the line. Without an offset it is taken to be in -log-timezone.
+func parseTimestamp(line string) (time.Time, string, error) {
+	if len(line) < len(timestampLayout) {
+		return time.Time{}, "", errNoTimestamp
+	}
+	timestamp, err := time.ParseInLocation(timestampLayout, line[:len(timestampLayout)], logZone)
+	if err != nil {
+		return time.Time{}, "", errNoTimestamp
+	}
+
+	rest := line[len(timestampLayout):]
+	if strings.HasPrefix(rest, ".") {
+		end := 1
+		for end < len(rest) && '0' <= rest[end] && rest[end] <= '9' {
+			end++
+		}
+		if fraction, err := time.ParseDuration("0" + rest[:end] + "s"); err == nil {
+			timestamp = timestamp.Add(fraction)
+		}
+		rest = rest[end:]
+	}
+	rest = strings.TrimLeft(rest, " ")
+
+	if word, after := nextWord(rest); len(word) == 5 && (word[0] == '+' || word[0] == '-') {
+		if zoned, err := time.Parse(timestampLayout+" -0700", timestamp.Format(timestampLayout)+" "+word); err == nil {
+			timestamp = zoned.Add(time.Duration(timestamp.Nanosecond()))
+			rest = after
+		}
+	}
+	return timestamp, rest, nil
+}
+
+// host is the hostname from an H= style field, without its (helo) or [ip].
+func (r record) host() string {
+	name, _ := nextWord(r.fields["H"])
+	if strings.HasPrefix(name, "(") || strings.HasPrefix(name, "[") {
+		return ""
+	}
+	return strings.ToLower(name)
+}
+
+// ip is the address in brackets from an H= style field.
+func (r record) ip() string {
+	h := r.fields["H"]
+	start := strings.LastIndexByte(h, '[')
+	end := strings.LastIndexByte(h, ']')
+	if start < 0 || end < start {
+		return ""
+	}
+	return h[start+1 : end]
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runParseLine prints everything parsing makes of a pasted mainlog line, and
+// whether it gives a pair to group, for working out why a line isn't
+// matching.
+func runParseLine(args []string) error {
+	flags := flag.NewFlagSet("parse-line", flag.ExitOnError)
+	providersFile := flags.String("providers", "", "A file of extra provider mappings to bucket the destination with")
+	eximVersion := flags.String("exim-version", "", "The exim release, e.g. 4.97, to parse the line as")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("parse-line needs the line to parse, quoted as one argument")
+	}
+	if err := loadProviders(strings.NewReader(builtinProviders)); err != nil {
+		return err
+	}
+	if *providersFile != "" {
+		if err := loadProvidersFile(*providersFile); err != nil {
+			return err
+		}
+	}
+	if *eximVersion != "" {
+		if err := setEximVersion(*eximVersion); err != nil {
+			return err
+		}
+	}
+	line := flags.Arg(0)
+
+	r, err := parseLine(line)
+	if err != nil {
+		fmt.Printf("parsed: no, %s\n", err)
+	} else {
+		fmt.Printf("time: %s\n", r.time.Format(time.RFC3339Nano))
+		fmt.Printf("id: %s\nflag: %s\naddress: %s\noriginal: %s\n", r.id, r.flag, r.address, r.original)
+		names := make([]string, 0, len(r.fields))
+		for name := range r.fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("field %s: %s\n", name, r.fields[name])
+		}
+		if r.flag == "=>" || r.flag == "->" || r.flag == "**" || r.flag == "==" {
+			fmt.Printf("host: %s\nip: %s\nprovider: %s\n", r.host(), r.ip(), providerOf(domainOf(r.address), r.host()))
+		}
+		fmt.Printf("message: %s\n", r.message)
+		if otherVersionIDs.Load() > 0 {
+			fmt.Println("note: the exim id is of another release than -exim-version, so the line was parsed as about no message")
+		}
+	}
+
+	matches := lineMatch.FindStringSubmatch(line)
+	if matches == nil {
+		fmt.Println("pair: no, the line is not a <= arrival with a for list")
+		return nil
+	}
+	fmt.Printf("pair: %s to %s\n", strings.ToLower(matches[1]), strings.ToLower(matches[2]))
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// preflight checks, before anything is crunched, that every local input can
+// be read, that every file the run writes can be created or written over,
+// and that each directory it writes or spills temp files to has at least
+// minFree bytes free. It returns every problem it finds rather than stopping
+// at the first, so they can all be fixed before a run that would otherwise
+// fail an hour in.
+func preflight(inputs []inputFile, outputs []string, spills []string, minFree uint64) []string {
+	var problems []string
+	for _, file := range inputs {
+		if strings.Contains(file.name, "://") {
+			continue
+		}
+		if err := checkReadable(file.name); err != nil {
+			problems = append(problems, fmt.Sprintf("can't read input %s: %s", file.name, err))
+		}
+	}
+
+	dirs := make(map[string]bool)
+	for _, output := range outputs {
+		if output == "" || output == "-" || strings.Contains(output, "://") {
+			continue
+		}
+		if err := checkWritable(output); err != nil {
+			problems = append(problems, fmt.Sprintf("can't write output %s: %s", output, err))
+		}
+		dirs[existingDir(filepath.Dir(output))] = true
+	}
+	for _, spill := range spills {
+		dirs[existingDir(spill)] = true
+	}
+	if minFree == 0 {
+		return problems
+	}
+	for dir := range dirs {
+		if free, ok := freeSpace(dir); ok && free < minFree {
+			problems = append(problems, fmt.Sprintf("only %d MB free in %s, below %d MB", free>>20, dir, minFree>>20))
+		}
+	}
+	return problems
+}
+
+// checkReadable opens name for reading, which is all crunching it needs.
+func checkReadable(name string) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("is a directory")
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// checkWritable opens name for writing without truncating it, when it is
+// there, and otherwise creates and removes a temp file beside where it will
+// be, so a read only mount or directory shows up either way.
+func checkWritable(name string) error {
+	if info, err := os.Stat(name); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("is a directory")
+		}
+		file, err := os.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		return file.Close()
+	}
+	probe, err := ioutil.TempFile(existingDir(filepath.Dir(name)), ".exim-preflight-")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// existingDir is dir or the nearest directory above it that is there, where
+// anything the run makes under it will go.
+func existingDir(dir string) string {
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// builtinProviders maps recipient domains, and with mx: the remote hosts
+// mail for them is handed to, onto the big mailbox providers. Each line is a
+// provider followed by the glob patterns that belong to it.
+//
+//go:embed defaults/providers.txt
+var builtinProviders string
+
+type providerRule struct {
+	provider string
+	pattern  string
+	mx       bool
+}
+
+var providerRules []providerRule
+
+// loadProviders adds the rules in r to those already known. Rules loaded
+// later are checked first so a file can override the built in mapping.
+func loadProviders(r io.Reader) error {
+	var rules []providerRule
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		words := strings.Fields(line)
+		if len(words) < 2 {
+			continue
+		}
+		for _, pattern := range words[1:] {
+			rule := providerRule{provider: words[0], pattern: strings.ToLower(pattern)}
+			if strings.HasPrefix(rule.pattern, "mx:") {
+				rule.mx = true
+				rule.pattern = rule.pattern[len("mx:"):]
+			}
+			if _, err := path.Match(rule.pattern, ""); err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	providerRules = append(rules, providerRules...)
+	return nil
+}
+
+func loadProvidersFile(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return loadProviders(file)
+}
+
+// providerOf buckets a recipient domain, or failing that the host its mail
+// was handed to, into a provider. Anything unknown is "other".
+func providerOf(domain, host string) string {
+	domain = strings.ToLower(domain)
+	host = strings.ToLower(host)
+	for _, rule := range providerRules {
+		name := domain
+		if rule.mx {
+			name = host
+		}
+		if name == "" {
+			continue
+		}
+		if matched, _ := path.Match(rule.pattern, name); matched {
+			return rule.provider
+		}
+	}
+	return "other"
+}
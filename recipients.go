@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// prober is a sender trying recipients that don't exist, by envelope sender
+// and the IP it connected from.
+type prober struct {
+	sender string
+	ip     string
+}
+
+var (
+	validRecipients = make(map[string]bool)
+	validDomains    = make(map[string]bool)
+	recipientFile   string
+	probeThreshold  = 5
+
+	recipientLock = sync.Mutex{}
+	// leakedRecipients counts the messages accepted for each address on a
+	// valid domain that isn't a valid mailbox, as a catch-all would.
+	leakedRecipients = make(map[string]int)
+	// probedRecipients holds the unknown addresses each prober was refused.
+	probedRecipients = make(map[prober]map[string]bool)
+
+	rejectedRecipient = regexp.MustCompile(`rejected RCPT <?([^<>: ]+)>?`)
+	rejectMarker      = []byte("rejected RCPT")
+	deliveryMarker    = []byte(" => ")
+	routedMarker      = []byte(" -> ")
+)
+
+// loadValidRecipients reads the valid mailboxes, one address per line, and
+// takes the domains they are on as the ones to check recipients of.
+func loadValidRecipients(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		address := strings.ToLower(strings.Trim(strings.TrimSpace(line), "<>"))
+		if !strings.Contains(address, "@") {
+			continue
+		}
+		validRecipients[address] = true
+		validDomains[domainOf(address)] = true
+	}
+	return scanner.Err()
+}
+
+// isRecipientLine is a quick check for lines that may name a recipient,
+// before going to the trouble of parsing them.
+func isRecipientLine(line []byte) bool {
+	return bytes.Contains(line, deliveryMarker) || bytes.Contains(line, routedMarker) || bytes.Contains(line, rejectMarker)
+}
+
+// unknownRecipient is address, lowercased, if it is on a valid domain but
+// isn't a valid mailbox, otherwise empty.
+func unknownRecipient(address string) string {
+	address = strings.ToLower(strings.Trim(address, "<>"))
+	if !validDomains[domainOf(address)] || validRecipients[address] {
+		return ""
+	}
+	return address
+}
+
+// checkRecipient counts a delivery to an unknown recipient as a leak and a
+// refused one as a probe by its sender, leaving every other record alone.
+func checkRecipient(r record) {
+	switch {
+	case r.flag == "=>" || r.flag == "->":
+		recipient := r.original
+		if recipient == "" {
+			recipient = r.address
+		}
+		if address := unknownRecipient(recipient); address != "" {
+			recipientLock.Lock()
+			leakedRecipients[address]++
+			recipientLock.Unlock()
+		}
+	case r.flag == "":
+		matches := rejectedRecipient.FindStringSubmatch(r.message)
+		if matches == nil {
+			return
+		}
+		address := unknownRecipient(matches[1])
+		if address == "" {
+			return
+		}
+		key := prober{sender: strings.ToLower(strings.Trim(r.fields["F"], "<>")), ip: r.ip()}
+		recipientLock.Lock()
+		if probedRecipients[key] == nil {
+			probedRecipients[key] = make(map[string]bool)
+		}
+		probedRecipients[key][address] = true
+		recipientLock.Unlock()
+	}
+}
+
+// writeUnknownRecipients writes a leak line per unknown address mail was
+// accepted for, with the number of messages, then a probe line per sender
+// refused for at least -probe-threshold unknown addresses, with how many.
+func writeUnknownRecipients(fileName string) error {
+	leaks := make([]string, 0, len(leakedRecipients))
+	for address := range leakedRecipients {
+		leaks = append(leaks, address)
+	}
+	sort.Slice(leaks, func(i, j int) bool {
+		if leakedRecipients[leaks[i]] != leakedRecipients[leaks[j]] {
+			return leakedRecipients[leaks[i]] > leakedRecipients[leaks[j]]
+		}
+		return leaks[i] < leaks[j]
+	})
+
+	var probers []prober
+	for key, addresses := range probedRecipients {
+		if len(addresses) >= probeThreshold {
+			probers = append(probers, key)
+		}
+	}
+	sort.Slice(probers, func(i, j int) bool {
+		a, b := len(probedRecipients[probers[i]]), len(probedRecipients[probers[j]])
+		if a != b {
+			return a > b
+		}
+		return probers[i].sender+probers[i].ip < probers[j].sender+probers[j].ip
+	})
+
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := csv.NewWriter(outFile)
+	writer.Write([]string{"kind", "address", "ip", "count"})
+	for _, address := range leaks {
+		writer.Write([]string{"leak", address, "", strconv.Itoa(leakedRecipients[address])})
+	}
+	for _, key := range probers {
+		writer.Write([]string{"probe", key.sender, key.ip, strconv.Itoa(len(probedRecipients[key]))})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,21 @@
+#!/bin/sh
+# Builds a static binary for each platform into dist/, everything it needs
+# built in, named exim-<os>-<arch> with .exe on windows.
+set -eu
+
+cd "$(dirname "$0")"
+platforms=${PLATFORMS:-"linux/amd64 linux/arm64 darwin/amd64 darwin/arm64 windows/amd64 freebsd/amd64"}
+# dep vendors the dependencies, so build from GOPATH rather than as a module.
+export GO111MODULE=off
+mkdir -p dist
+
+for platform in $platforms; do
+	os=${platform%/*}
+	arch=${platform#*/}
+	name=dist/exim-$os-$arch
+	if [ "$os" = windows ]; then
+		name=$name.exe
+	fi
+	echo "Building $name"
+	CGO_ENABLED=0 GOOS=$os GOARCH=$arch go build -trimpath -ldflags "-s -w" -o "$name" .
+done
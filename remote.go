@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Loki and Elasticsearch inputs are URLs with these schemes standing in for
+// http, or https with +https on the end.
+const (
+	lokiScheme          = "loki"
+	elasticsearchScheme = "es"
+)
+
+var (
+	queryStart         time.Time
+	queryEnd           time.Time
+	queryPageSize      = 5000
+	elasticsearchQuery = `{"match_all":{}}`
+	elasticsearchTime  = "@timestamp"
+	elasticsearchField = "message"
+	// queryClient sends the requests of loki:// and es:// inputs, the Loki
+	// and BigQuery sinks and the Google token they need, giving up on any that takes longer than its timeout so a
+	// server that stops answering can't hang the run.
+	queryClient = &http.Client{Timeout: time.Minute}
+)
+
+// isQueryInput reports whether input is a loki:// or es:// source.
+func isQueryInput(input string) bool {
+	scheme := strings.TrimSuffix(strings.SplitN(input, "://", 2)[0], "+https")
+	return strings.Contains(input, "://") && (scheme == lokiScheme || scheme == elasticsearchScheme)
+}
+
+// queryLines streams the log lines a loki:// or es:// input's query finds
+// between queryStart and queryEnd, oldest first, one per line.
+func queryLines(input string) (io.ReadCloser, error) {
+	source, err := url.Parse(input)
+	if err != nil {
+		return nil, err
+	}
+	scheme := source.Scheme
+	source.Scheme = "http"
+	if strings.HasSuffix(scheme, "+https") {
+		source.Scheme = "https"
+		scheme = strings.TrimSuffix(scheme, "+https")
+	}
+
+	pages := lokiPages
+	if scheme == elasticsearchScheme {
+		pages = elasticsearchPages
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(pages(source, func(line string) error {
+			_, err := io.WriteString(writer, strings.TrimRight(line, "\n")+"\n")
+			return err
+		}))
+	}()
+	return reader, nil
+}
+
+// lokiPages runs a LogQL query, from the source's query parameter, against
+// Loki's query_range API a page at a time until a page comes back short.
+// Each page starts at the newest line of the one before, not after it, as
+// more lines than it held can share that nanosecond, and the lines already
+// emitted at it are skipped.
+func lokiPages(source *url.URL, emit func(string) error) error {
+	logQL := source.Query().Get("query")
+	if logQL == "" {
+		return fmt.Errorf("no query given for %s", source.Host)
+	}
+	endpoint := *source
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/loki/api/v1/query_range"
+
+	start := queryStart.UnixNano()
+	// emitted counts the lines emitted at start, by their text.
+	emitted := make(map[string]int)
+	for {
+		query := url.Values{
+			"query":     {logQL},
+			"start":     {strconv.FormatInt(start, 10)},
+			"end":       {strconv.FormatInt(queryEnd.UnixNano(), 10)},
+			"limit":     {strconv.Itoa(queryPageSize)},
+			"direction": {"forward"},
+		}
+		endpoint.RawQuery = query.Encode()
+
+		var page struct {
+			Data struct {
+				Result []struct {
+					Values [][2]string `json:"values"`
+				} `json:"result"`
+			} `json:"data"`
+		}
+		if err := sendJSON(http.MethodGet, endpoint.String(), "", nil, &page); err != nil {
+			return err
+		}
+
+		var entries [][2]string
+		for _, stream := range page.Data.Result {
+			entries = append(entries, stream.Values...)
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return lessNumeric(entries[i][0], entries[j][0]) })
+		repeated := make(map[string]int, len(emitted))
+		for line, count := range emitted {
+			repeated[line] = count
+		}
+		from, fresh := start, 0
+		for _, entry := range entries {
+			at, err := strconv.ParseInt(entry[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("loki returned the timestamp %q: %v", entry[0], err)
+			}
+			if at == from && repeated[entry[1]] > 0 {
+				repeated[entry[1]]--
+				continue
+			}
+			if err := emit(entry[1]); err != nil {
+				return err
+			}
+			fresh++
+			if at > start {
+				start = at
+				emitted = make(map[string]int)
+			}
+			if at == start {
+				emitted[entry[1]]++
+			}
+		}
+		if len(entries) < queryPageSize {
+			return nil
+		}
+		if fresh == 0 {
+			// A whole page at one nanosecond, all emitted already, is as far
+			// as paging by time can get there.
+			log.Warn().Str("host", source.Host).Int64("at", start).Int("lines", queryPageSize).Msg("Loki had a whole page of lines at one time, any more at it are skipped")
+			start++
+			emitted = make(map[string]int)
+		}
+	}
+}
+
+// elasticsearchPages runs elasticsearchQuery, limited to the time range on
+// elasticsearchTime, against the index in the source's path using the scroll
+// API, emitting the elasticsearchField of each hit.
+func elasticsearchPages(source *url.URL, emit func(string) error) error {
+	var must json.RawMessage
+	if err := json.Unmarshal([]byte(elasticsearchQuery), &must); err != nil {
+		return fmt.Errorf("elasticsearch query is not JSON: %v", err)
+	}
+	search := map[string]interface{}{
+		"size": queryPageSize,
+		"sort": []interface{}{map[string]string{elasticsearchTime: "asc"}},
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": must,
+				"filter": map[string]interface{}{
+					"range": map[string]interface{}{
+						elasticsearchTime: map[string]string{
+							"gte": queryStart.Format(time.RFC3339Nano),
+							"lte": queryEnd.Format(time.RFC3339Nano),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	endpoint := *source
+	index := strings.Trim(endpoint.Path, "/")
+	endpoint.Path = "/" + index + "/_search"
+	endpoint.RawQuery = "scroll=1m"
+
+	var page struct {
+		ScrollID string `json:"_scroll_id"`
+		Hits     struct {
+			Hits []struct {
+				Source map[string]interface{} `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := sendJSON(http.MethodPost, endpoint.String(), "", search, &page); err != nil {
+		return err
+	}
+
+	endpoint.Path = "/_search/scroll"
+	endpoint.RawQuery = ""
+	defer func() {
+		if page.ScrollID != "" {
+			sendJSON(http.MethodDelete, endpoint.String(), "", map[string]string{"scroll_id": page.ScrollID}, nil)
+		}
+	}()
+	for len(page.Hits.Hits) > 0 {
+		for _, hit := range page.Hits.Hits {
+			if line, ok := fieldAt(hit.Source, elasticsearchField).(string); ok {
+				if err := emit(line); err != nil {
+					return err
+				}
+			}
+		}
+
+		scroll := map[string]string{"scroll": "1m", "scroll_id": page.ScrollID}
+		page.Hits.Hits = nil
+		if err := sendJSON(http.MethodPost, endpoint.String(), "", scroll, &page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldAt looks up a dotted path such as log.original in a document.
+func fieldAt(document map[string]interface{}, path string) interface{} {
+	if value, ok := document[path]; ok {
+		return value
+	}
+	parts := strings.SplitN(path, ".", 2)
+	if inner, ok := document[parts[0]].(map[string]interface{}); ok && len(parts) == 2 {
+		return fieldAt(inner, parts[1])
+	}
+	return nil
+}
+
+// sendJSON sends body, if any, as JSON to address, with token as a bearer
+// token if there is one, and decodes the JSON reply into result, if any.
+func sendJSON(method, address, token string, body, result interface{}) error {
+	var content io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		content = bytes.NewReader(encoded)
+	}
+	request, err := http.NewRequest(method, address, content)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := queryClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return decodeResponse(response, result)
+}
+
+// decodeResponse turns a response that isn't a success into an error, or
+// decodes its JSON body into result if there is one.
+func decodeResponse(response *http.Response, result interface{}) error {
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("%s returned %s: %s", response.Request.URL.Host, response.Status, bytes.TrimSpace(message))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// lessNumeric compares two unsigned integers held as strings.
+func lessNumeric(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// parseTimeFlag reads an RFC 3339 time, or a duration meaning that long ago.
+func parseTimeFlag(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return now, nil
+	}
+	if ago, err := time.ParseDuration(value); err == nil {
+		return now.Add(-ago), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeLoki answers query_range with the first limit of entries, which are in
+// time order, at or after start.
+func fakeLoki(t *testing.T, entries [][2]string) *url.URL {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		var values [][2]string
+		for _, entry := range entries {
+			at, _ := strconv.ParseInt(entry[0], 10, 64)
+			if at >= start && len(values) < limit {
+				values = append(values, entry)
+			}
+		}
+		var page struct {
+			Data struct {
+				Result []map[string]interface{} `json:"result"`
+			} `json:"data"`
+		}
+		page.Data.Result = []map[string]interface{}{{"values": values}}
+		json.NewEncoder(w).Encode(page)
+	}))
+	t.Cleanup(server.Close)
+	source, err := url.Parse(server.URL + "?query=" + url.QueryEscape(`{job="exim"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func TestLokiPagesKeepLinesSharingTheNewestTime(t *testing.T) {
+	defer func(size int, start, end time.Time) {
+		queryPageSize, queryStart, queryEnd = size, start, end
+	}(queryPageSize, queryStart, queryEnd)
+	queryPageSize, queryStart, queryEnd = 3, time.Unix(0, 0), time.Unix(0, 100)
+
+	tests := []struct {
+		name    string
+		entries [][2]string
+		want    []string
+	}{
+		{"page ends part way through a time", [][2]string{{"10", "a"}, {"20", "b"}, {"20", "c"}, {"20", "d"}, {"30", "e"}}, []string{"a", "b", "c", "d", "e"}},
+		{"same line twice at a time", [][2]string{{"10", "a"}, {"10", "a"}, {"20", "b"}, {"20", "b"}, {"20", "b"}}, []string{"a", "a", "b", "b", "b"}},
+		{"whole page at one time", [][2]string{{"20", "a"}, {"20", "b"}, {"20", "c"}, {"30", "d"}}, []string{"a", "b", "c", "d"}},
+	}
+	for _, test := range tests {
+		var got []string
+		err := lokiPages(fakeLoki(t, test.entries), func(line string) error {
+			got = append(got, line)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: emitted %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// reputation is what a source IP did: how much mail it sent, how much of
+// what it tried was rejected and for being on a DNSBL, and how often it had
+// no reverse DNS or gave an odd HELO.
+type reputation struct {
+	volume  int
+	rejects int
+	rdns    int
+	dnsbl   int
+	helo    int
+}
+
+// reputationSignals are the signals -reputation-weights can weigh, in the
+// order they are written.
+var reputationSignals = []string{"volume", "reject", "rdns", "dnsbl", "helo"}
+
+var (
+	reputationFile      = ""
+	reputationDenyFile  = ""
+	reputationThreshold = 10.0
+	reputationWeights   = map[string]float64{"volume": 0, "reject": 1, "rdns": 1, "dnsbl": 5, "helo": 2}
+	reputations         = make(map[string]*reputation)
+	reputationLock      = sync.Mutex{}
+
+	rejectedMarker = []byte("rejected")
+	dnsblMessage   = regexp.MustCompile(`(?i)listed (at|in|on)|blocked using|dnsbl|\brbl\b|spamhaus`)
+)
+
+// setReputationWeights takes a comma separated list of signal=weight, which
+// replace the default weights of those signals.
+func setReputationWeights(list string) error {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		signal, value, ok := strings.Cut(item, "=")
+		if _, known := reputationWeights[signal]; !ok || !known {
+			return fmt.Errorf("%q is not one of %s with a weight", item, strings.Join(reputationSignals, ", "))
+		}
+		weight, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		reputationWeights[signal] = weight
+	}
+	return nil
+}
+
+// score is the weighted sum of the signals.
+func (r *reputation) score() float64 {
+	return reputationWeights["volume"]*float64(r.volume) +
+		reputationWeights["reject"]*float64(r.rejects) +
+		reputationWeights["rdns"]*float64(r.rdns) +
+		reputationWeights["dnsbl"]*float64(r.dnsbl) +
+		reputationWeights["helo"]*float64(r.helo)
+}
+
+// isReputationLine is a quick check for lines that may be arrivals or
+// rejections, before going to the trouble of parsing them.
+func isReputationLine(line []byte) bool {
+	return isArrivalLine(line) || bytes.Contains(line, rejectedMarker)
+}
+
+// helo is the name a host gave in its HELO, from the parentheses of an H=
+// field, or empty when it was the same as the host's verified name.
+func (r record) helo() string {
+	h := r.fields["H"]
+	start := strings.IndexByte(h, '(')
+	end := strings.IndexByte(h, ')')
+	if start < 0 || end < start {
+		return ""
+	}
+	return strings.ToLower(h[start+1 : end])
+}
+
+// oddHELO reports whether helo isn't what a well run mail server from ip
+// would give: a bare word rather than a name, an address literal that
+// isn't ip's, or one of our own domains.
+func oddHELO(helo, ip string) bool {
+	switch {
+	case helo == "":
+		return false
+	case strings.HasPrefix(helo, "["):
+		return strings.Trim(helo, "[]") != ip
+	case !strings.Contains(strings.Trim(helo, "."), "."):
+		return true
+	}
+	return len(internalDomains) > 0 && isInternal("@"+helo)
+}
+
+// checkReputation counts the arrivals and rejections of each untrusted
+// source IP, with how many had no reverse DNS, an odd HELO or were rejected
+// for being on a DNSBL, leaving every other record alone.
+func checkReputation(r record) {
+	arrival := r.flag == "<="
+	rejected := r.flag == "" && strings.Contains(r.message, string(rejectedMarker))
+	if !arrival && !rejected {
+		return
+	}
+	ip := net.ParseIP(r.ip())
+	if ip == nil || isTrusted(ip) {
+		return
+	}
+	address := ip.String()
+
+	reputationLock.Lock()
+	defer reputationLock.Unlock()
+	rep := reputations[address]
+	if rep == nil {
+		rep = &reputation{}
+		reputations[address] = rep
+	}
+	if arrival {
+		rep.volume++
+	} else {
+		rep.rejects++
+		if dnsblMessage.MatchString(r.message) {
+			rep.dnsbl++
+		}
+	}
+	if r.host() == "" {
+		rep.rdns++
+	}
+	if oddHELO(r.helo(), address) {
+		rep.helo++
+	}
+}
+
+// rankedReputations are the IPs seen, highest score first.
+func rankedReputations() []string {
+	ips := make([]string, 0, len(reputations))
+	for ip := range reputations {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		a, b := reputations[ips[i]].score(), reputations[ips[j]].score()
+		if a != b {
+			return a > b
+		}
+		return ips[i] < ips[j]
+	})
+	return ips
+}
+
+// writeReputation writes a line per source IP with its score and each of
+// the signals that went into it, highest score first.
+func writeReputation(fileName string) error {
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := csv.NewWriter(outFile)
+	writer.Write(append([]string{"ip", "score"}, reputationSignals...))
+	for _, ip := range rankedReputations() {
+		r := reputations[ip]
+		writer.Write([]string{
+			ip,
+			strconv.FormatFloat(r.score(), 'f', -1, 64),
+			strconv.Itoa(r.volume),
+			strconv.Itoa(r.rejects),
+			strconv.Itoa(r.rdns),
+			strconv.Itoa(r.dnsbl),
+			strconv.Itoa(r.helo),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// writeReputationDeny writes the IPs scoring at least -reputation-threshold
+// as an exim host list file, an IP a line, for an ACL to deny with
+// hosts = /path/to/file. It returns how many it wrote.
+func writeReputationDeny(fileName string) (int, error) {
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer outFile.Close()
+
+	writer := bufio.NewWriter(outFile)
+	fmt.Fprintf(writer, "# Source IPs scoring at least %s by -reputation-weights\n", strconv.FormatFloat(reputationThreshold, 'f', -1, 64))
+	denied := 0
+	for _, ip := range rankedReputations() {
+		if reputations[ip].score() < reputationThreshold {
+			break
+		}
+		fmt.Fprintln(writer, ip)
+		denied++
+	}
+	return denied, writer.Flush()
+}
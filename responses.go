@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// response is a remote SMTP server's answer to a delivery attempt that
+// failed (**) or was deferred (==). Group is the destination domain or its
+// provider.
+type response struct {
+	group    string
+	result   string
+	code     string
+	enhanced string
+	category string
+}
+
+var (
+	responseCounts  = make(map[response]int)
+	responseLock    = sync.Mutex{}
+	responseFile    string
+	groupByProvider = false
+
+	responseCode   = regexp.MustCompile(`(?:^|: )([245]\d\d)[ -](?:([245]\.\d{1,3}\.\d{1,3})\b)?`)
+	deferMarker    = []byte(" == ")
+	failureMarker  = []byte(" ** ")
+	responseResult = map[string]string{"**": "failed", "==": "deferred"}
+
+	// responseCategories are tried in order against the enhanced status code
+	// and text of a response, so more specific causes come first.
+	responseCategories = []struct {
+		name     string
+		enhanced *regexp.Regexp
+		text     *regexp.Regexp
+	}{
+		{"reputation", nil, regexp.MustCompile(`(?i)reputation|block ?list|black ?list|dnsbl|\brbl\b|spamhaus|barracuda|spamcop|listed (at|in|on)|blocked using`)},
+		{"mailbox-full", regexp.MustCompile(`^[45]\.2\.2$`), regexp.MustCompile(`(?i)mailbox (is )?full|over ?quota|quota exceeded|insufficient (system )?storage`)},
+		{"no-mailbox", regexp.MustCompile(`^[45]\.1\.[0-6]$|^[45]\.1\.10$`), regexp.MustCompile(`(?i)user unknown|no such user|does not exist|unknown recipient|recipient rejected`)},
+		{"rate-limit", regexp.MustCompile(`^4\.7\.28$`), regexp.MustCompile(`(?i)rate limit|too many|server busy|try again later|temporarily (deferred|rate)`)},
+		{"greylist", nil, regexp.MustCompile(`(?i)grey ?list|gray ?list`)},
+		{"policy", regexp.MustCompile(`^[45]\.7\.\d+$`), regexp.MustCompile(`(?i)policy|spf|dkim|dmarc|not authori[sz]ed|relay`)},
+		{"message", regexp.MustCompile(`^[45]\.6\.\d+$|^[45]\.3\.4$`), regexp.MustCompile(`(?i)message (is )?too (big|large)|size limit`)},
+	}
+)
+
+// isResponseLine is a quick check for lines that may be ** or == ones,
+// before going to the trouble of parsing them.
+func isResponseLine(line []byte) bool {
+	return bytes.Contains(line, failureMarker) || bytes.Contains(line, deferMarker)
+}
+
+// countResponse tallies the SMTP response of a ** or == record by destination
+// domain or provider, leaving every other record alone.
+func countResponse(r record) {
+	if responseResult[r.flag] == "" {
+		return
+	}
+
+	key := response{group: domainOf(r.address), result: responseResult[r.flag]}
+	if groupByProvider {
+		key.group = providerOf(key.group, r.host())
+	}
+	if matches := responseCode.FindStringSubmatch(r.message); matches != nil {
+		key.code = matches[1]
+		key.enhanced = matches[2]
+	}
+	key.category = categoriseResponse(key.code, key.enhanced, r.message)
+
+	responseLock.Lock()
+	responseCounts[key]++
+	responseLock.Unlock()
+}
+
+// categoriseResponse puts a response down to its most likely cause. Failing
+// on tainted data is our own configuration's doing rather than the remote
+// server's, so is told apart first.
+func categoriseResponse(code, enhanced, text string) string {
+	if profile.taint != nil && profile.taint.MatchString(text) {
+		return "taint"
+	}
+	for _, category := range responseCategories {
+		if (category.enhanced != nil && category.enhanced.MatchString(enhanced)) || category.text.MatchString(text) {
+			return category.name
+		}
+	}
+	switch {
+	case code == "":
+		return "connection"
+	case code[0] == '4':
+		return "temporary"
+	}
+	return "other"
+}
+
+// writeResponses writes the response tallies as CSV, busiest first within
+// each domain or provider.
+func writeResponses(fileName string) error {
+	keys := make([]response, 0, len(responseCounts))
+	for key := range responseCounts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].group != keys[j].group {
+			return keys[i].group < keys[j].group
+		}
+		return responseCounts[keys[i]] > responseCounts[keys[j]]
+	})
+
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := csv.NewWriter(outFile)
+	group := "domain"
+	if groupByProvider {
+		group = "provider"
+	}
+	writer.Write([]string{group, "result", "code", "enhanced", "category", "count"})
+	for _, key := range keys {
+		writer.Write([]string{key.group, key.result, key.code, key.enhanced, key.category, strconv.Itoa(responseCounts[key])})
+	}
+	writer.Flush()
+	return writer.Error()
+}
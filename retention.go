@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const dateLayout = "2006-01-02"
+
+var (
+	// retentionDays is how long after a pair was last seen it may be kept,
+	// when pairs are stamped with it.
+	retentionDays = 0
+)
+
+func pairID(from, to uint32) uint64 {
+	return uint64(from)<<32 | uint64(to)
+}
+
+// seen notes that from mailed to on the day line was logged.
+func (r *Runner) seen(from, to uint32, line []byte, w *worker) {
+	days := w.lineDay(line)
+	if id := pairID(from, to); days > r.lastSeen[id] {
+		r.lastSeen[id] = days
+	}
+}
+
+// stamp sets the day the pair was last seen on and when it expires.
+func (p *pair) stamp(days int32) {
+	day := time.Unix(int64(days)*86400, 0).UTC()
+	p.lastSeen = day.Format(dateLayout)
+	p.expires = day.AddDate(0, 0, retentionDays).Format(dateLayout)
+}
+
+// runPrune drops what has passed its retention: the expired pairs of stamped
+// output, copied to a new file, or the date partitions of a local -stage
+// directory older than -retention-days.
+func runPrune(args []string) error {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	format := flags.String("format", "", "The format of the output to prune, one of arrow, json, msgpack or protobuf, worked out from its start if not given")
+	stage := flags.String("stage", "", "A local -stage directory to remove the expired date partitions of instead")
+	days := flags.Int("retention-days", 0, "How many days -stage partitions are kept for")
+	nowFlag := flags.String("now", "", "The YYYY-MM-DD date to prune as of, if not today")
+	flags.Parse(args)
+
+	now := time.Now().UTC()
+	if *nowFlag != "" {
+		var err error
+		if now, err = time.Parse(dateLayout, *nowFlag); err != nil {
+			return err
+		}
+	}
+
+	if *stage != "" {
+		if *days < 1 {
+			return errors.New("prune -stage needs -retention-days")
+		}
+		return pruneStage(*stage, now.AddDate(0, 0, -*days).Format(dateLayout))
+	}
+	if flags.NArg() != 2 {
+		return errors.New("prune needs the stamped output to read and the file to write what is kept to")
+	}
+	return pruneOutput(flags.Arg(0), flags.Arg(1), *format, now.Format(dateLayout))
+}
+
+// pruneOutput copies the pairs of in that expire on or after today to out,
+// in the same format.
+func pruneOutput(in, out, format, today string) error {
+	inFile, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+	reader := bufio.NewReader(inFile)
+	if format == "" {
+		format = detectFormat(reader)
+	}
+	read, ok := pairReaders[format]
+	if !ok {
+		return fmt.Errorf("can't prune %s output, only arrow, json, msgpack or protobuf", format)
+	}
+
+	outFile, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	var writer pairWriter
+	kept, pruned := 0, 0
+	_, err = read(reader, func(p pair) error {
+		if p.expires == "" {
+			return errors.New("output is not stamped with -retention-days")
+		}
+		if writer == nil {
+			var err error
+			if writer, err = pairFormats[format](outFile, p.count > 0, true); err != nil {
+				return err
+			}
+		}
+		if p.expires < today {
+			pruned++
+			return nil
+		}
+		kept++
+		return writer.write(p)
+	})
+	if err != nil {
+		return err
+	}
+	if writer == nil {
+		if writer, err = pairFormats[format](outFile, false, true); err != nil {
+			return err
+		}
+	}
+	log.Info().Str("name", out).Int("kept", kept).Int("pruned", pruned).Msg("Pruned expired pairs")
+	return writer.close()
+}
+
+// pruneStage removes the date=YYYY-MM-DD partitions of a local stage
+// directory from before cutoff.
+func pruneStage(dir, cutoff string) error {
+	if strings.Contains(dir, "://") {
+		return errors.New("prune can only remove partitions from a local -stage directory")
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		date := strings.TrimPrefix(entry.Name(), "date=")
+		if !entry.IsDir() || date == entry.Name() {
+			continue
+		}
+		if _, err := time.Parse(dateLayout, date); err != nil || date >= cutoff {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+		log.Info().Str("name", entry.Name()).Msg("Pruned stage partition")
+	}
+	return nil
+}
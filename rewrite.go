@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// rewriteRule replaces what pattern matches in an address with replacement,
+// which can refer to pattern's groups as $1 or ${name}.
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement []byte
+}
+
+var rewriteRules []rewriteRule
+
+// loadRewriteRules reads a rule per line, a regex then its replacement
+// separated by whitespace, skipping blank lines and those starting with #.
+func loadRewriteRules(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d of %s is not a regex and a replacement", number, fileName)
+		}
+		pattern, err := regexp.Compile(fields[0])
+		if err != nil {
+			return fmt.Errorf("line %d of %s: %s", number, fileName, err)
+		}
+		rewriteRules = append(rewriteRules, rewriteRule{pattern: pattern, replacement: []byte(fields[1])})
+	}
+	return scanner.Err()
+}
+
+// rewrite runs address through every rule in order, each rewriting what the
+// one before left.
+func rewrite(address []byte) []byte {
+	for _, rule := range rewriteRules {
+		address = rule.pattern.ReplaceAll(address, rule.replacement)
+	}
+	return address
+}
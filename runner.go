@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lachlanmunro/exim/aggregate"
+	"github.com/rs/zerolog/log"
+)
+
+// Config is what a crunch is set up with: which addresses it keeps, how it
+// reads files and how it groups pairs. main fills it in from the flags.
+type Config struct {
+	// Email is what a sender must match to be kept.
+	Email *regexp.Regexp
+	// Ignore drops the recipients it matches.
+	Ignore *regexp.Regexp
+	// Required are literals any of which a line must hold to be crunched at
+	// all, when there are some.
+	Required [][]byte
+	// Threads is how many files are crunched at once.
+	Threads int
+	// Retries is how many times a file is retried after a transient error,
+	// waiting RetryWait the first time and twice as long each time after.
+	Retries   int
+	RetryWait time.Duration
+	// ProgressInterval is how often progress is logged, 0 for never.
+	ProgressInterval time.Duration
+	// Approximate counts pairs in a sketch SketchWidth by SketchDepth,
+	// keeping the Top most frequent, rather than grouping them exactly.
+	Approximate bool
+	SketchWidth int
+	SketchDepth int
+	Top         int
+	// Metrics are where the aggregator reports to.
+	Metrics aggregate.Metrics
+	// Sinks are sent an event for every mainlog line, through a stream of
+	// up to SinkBuffer events each, once the Enrichers have added to it.
+	Sinks      []sink
+	SinkBuffer int
+	Enrichers  []enricher
+}
+
+// Runner is a crunch of a set of files, with the pairs it grouped, what it
+// kept about each pair, the sinks it sends to, where it resumes from and
+// what it counted on the way, so more than one can be run in a process
+// without mixing any of them. The reports, and the messages in flight they
+// follow, are still the package's, turned on by main's flags and shared by
+// every Runner, as is the state of -follow and its write-ahead log; a Runner
+// run alongside others should leave them off. The counts are atomic, so
+// Progress can be taken from anywhere while the workers run.
+type Runner struct {
+	config  Config
+	ctx     context.Context
+	stop    context.CancelCauseFunc
+	start   time.Time
+	workers chan int
+	files   int
+
+	// lock guards the pairs and everything kept about them by pairID, which
+	// only means anything with the ids of this Runner's emails.
+	lock         sync.Mutex
+	emails       *aggregate.Aggregator
+	pairSketch   *countMinSketch
+	topPairs     *heavyHitters
+	domainCounts map[string]int
+	// pairCounts are how many messages each sender sent each recipient,
+	// counted for -min-count and -autocomplete.
+	pairCounts map[uint64]int
+	// lastSeen is the latest day each pair was seen on, as days since the
+	// epoch, for -retention-days.
+	lastSeen map[uint64]int32
+	// pairExamples are the lines kept for each pair for -examples.
+	pairExamples map[uint64]*examples
+	// dedupeRows are the rows of the finer -dedupe keys, and dedupeSlots
+	// the days or hours each pair already has one for.
+	dedupeRows  []dedupeRow
+	dedupeSlots map[uint64]map[int64]bool
+	// firstContacts are when each pair between an internal user and an
+	// external address was first seen, for -digest.
+	firstContacts map[uint64]string
+
+	streams []*sinkStream
+	// resume is where the file of each name was crunched to by the run the
+	// write-ahead log was replayed from, which only holds while the file of
+	// that name is still the same one.
+	resume map[string]resumeOffset
+
+	// statsLock guards the errors the Runner hit and what it noted about
+	// each file it finished.
+	statsLock    sync.Mutex
+	errorCounts  map[errorClass]int
+	sinkErrors   int
+	fileStatuses []fileStatus
+	totalTimes   fileTimes
+	fileRates    []float64
+
+	done      atomic.Int64
+	lines     atomic.Int64
+	bytes     atomic.Int64
+	matched   atomic.Int64
+	ignored   atomic.Int64
+	filtered  atomic.Int64
+	senders   atomic.Int64
+	retried   atomic.Int64
+	truncated atomic.Int64
+	long      atomic.Int64
+	rejected  atomic.Int64
+	panics    atomic.Int64
+	skipped   atomic.Int64
+}
+
+// Progress is a snapshot of how far a Runner has got.
+type Progress struct {
+	FilesDone  int64 `json:"files_done"`
+	FilesTotal int64 `json:"files_total"`
+	Remaining  int64 `json:"remaining"`
+	Lines      int64 `json:"lines"`
+	Bytes      int64 `json:"bytes"`
+	Matched    int64 `json:"matched"`
+	Ignored    int64 `json:"ignored"`
+	Senders    int64 `json:"from"`
+	// LinesPerSecond is the rate lines have been crunched at since the
+	// Runner started.
+	LinesPerSecond float64       `json:"lines_per_second"`
+	Elapsed        time.Duration `json:"elapsed_ns"`
+}
+
+// NewRunner sets up a crunch with config, starting its sinks' streams, and
+// stops it where it has got to once ctx is done or a sink fails. The sinks
+// are closed by closeSinks once it is finished with.
+func NewRunner(ctx context.Context, config Config) *Runner {
+	ctx, stop := context.WithCancelCause(ctx)
+	r := &Runner{
+		config:        config,
+		ctx:           ctx,
+		stop:          stop,
+		start:         time.Now(),
+		emails:        aggregate.NewWithMetrics(config.Metrics),
+		domainCounts:  make(map[string]int),
+		pairCounts:    make(map[uint64]int),
+		lastSeen:      make(map[uint64]int32),
+		pairExamples:  make(map[uint64]*examples),
+		dedupeSlots:   make(map[uint64]map[int64]bool),
+		firstContacts: make(map[uint64]string),
+		resume:        make(map[string]resumeOffset),
+		errorCounts:   make(map[errorClass]int),
+	}
+	if config.Approximate {
+		r.pairSketch = newCountMinSketch(config.SketchWidth, config.SketchDepth)
+		r.topPairs = newHeavyHitters(config.Top)
+	}
+	r.startSinks()
+	return r
+}
+
+// resumeAt notes that the file of name, which was the file id, had been
+// crunched to offset by the run a write-ahead log is replayed from. A file of
+// the name logged later was rotated in after the one before it, so takes its
+// place.
+func (r *Runner) resumeAt(name string, id fileID, offset int64) {
+	if resume, ok := r.resume[name]; !ok || resume.id != id || offset > resume.offset {
+		r.resume[name] = resumeOffset{id: id, offset: offset}
+	}
+}
+
+// Run crunches each phase of files in turn, all of a phase's files before
+// any of the next, and returns once they are done or the Runner is stopped.
+func (r *Runner) Run(phases ...[]inputFile) {
+	files := 0
+	for _, phase := range phases {
+		files += len(phase)
+	}
+	r.files = files
+	crunched := make(chan bool)
+	if r.config.ProgressInterval > 0 {
+		go r.logProgress(r.config.ProgressInterval, crunched)
+	}
+	r.workers = make(chan int, r.config.Threads)
+	for _, phase := range phases {
+		for id := 1; id <= r.config.Threads; id++ {
+			r.workers <- id
+		}
+		for _, file := range phase {
+			go r.processFile(file, <-r.workers)
+		}
+		for i := 0; i < cap(r.workers); i++ {
+			<-r.workers
+		}
+	}
+	close(crunched)
+}
+
+// Err is the sink failure that stopped the Runner, or nil if none did.
+func (r *Runner) Err() error {
+	var failed sinkError
+	if errors.As(context.Cause(r.ctx), &failed) {
+		return failed
+	}
+	return nil
+}
+
+// Progress is how far the Runner has got. It is safe to call from any
+// goroutine while the Runner runs, each count being read atomically, though
+// they are read one after another rather than all at one instant.
+func (r *Runner) Progress() Progress {
+	elapsed := time.Since(r.start)
+	p := Progress{
+		FilesDone:  r.done.Load(),
+		FilesTotal: int64(r.files),
+		Lines:      r.lines.Load(),
+		Bytes:      r.bytes.Load(),
+		Matched:    r.matched.Load(),
+		Ignored:    r.ignored.Load(),
+		Senders:    r.senders.Load(),
+		Elapsed:    elapsed,
+	}
+	p.Remaining = p.FilesTotal - p.FilesDone
+	if elapsed > 0 {
+		p.LinesPerSecond = float64(p.Lines) / elapsed.Seconds()
+	}
+	return p
+}
+
+// logProgress logs how far the crunching has got every interval, however
+// fast or slow the lines are coming, until done is closed.
+func (r *Runner) logProgress(interval time.Duration, done chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var previous int64
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			p := r.Progress()
+			log.Info().
+				Int64("lines", p.Lines).
+				Int64("bytes", p.Bytes).
+				Int64("matched", p.Matched).
+				Int64("ignored", p.Ignored).
+				Int64("from", p.Senders).
+				Int64("remaining", p.Remaining).
+				Float64("linespersecond", float64(p.Lines-previous)/interval.Seconds()).
+				Msg("Crunching progress")
+			previous = p.Lines
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// crunchLines runs lines through a new Runner's processLine as a mainlog.
+func crunchLines(t *testing.T, lines ...string) *Runner {
+	t.Helper()
+	r := NewRunner(context.Background(), Config{Email: regexp.MustCompile(".*"), Ignore: regexp.MustCompile("^$"), Threads: 1})
+	file := inputFile{name: "main.log", kind: mainLog}
+	w := newWorker(1, file)
+	var times fileTimes
+	for _, line := range lines {
+		if err := r.processLine(file, []byte(line+"\n"), &times, w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+func grouped(t *testing.T, r *Runner) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := r.writeGrouped(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestRunnersKeepTheirPairsApart(t *testing.T) {
+	defer func(saved int) { minCount = saved }(minCount)
+	minCount = 2
+
+	// Both Runners number their first pair 0 to 0, so counting it in a map
+	// they shared would take the second over -min-count too.
+	first := crunchLines(t,
+		"2024-03-10 10:00:00 1rA001-0001aB-Cd <= a@corp.com H=h [10.0.0.5] P=esmtp S=1 for b@ext.com",
+		"2024-03-10 10:00:01 1rA002-0001aB-Cd <= a@corp.com H=h [10.0.0.5] P=esmtp S=1 for b@ext.com",
+	)
+	second := crunchLines(t,
+		"2024-03-10 10:00:02 1rA003-0001aB-Cd <= c@corp.com H=h [10.0.0.5] P=esmtp S=1 for d@ext.com",
+	)
+
+	if got, want := grouped(t, first), "a@corp.com,b@ext.com\n"; got != want {
+		t.Errorf("first Runner wrote %q, want %q", got, want)
+	}
+	if got := grouped(t, second); got != "" {
+		t.Errorf("second Runner wrote %q for a pair seen once, want nothing", got)
+	}
+}
+
+// recordingSink keeps the lines of the events it is sent.
+type recordingSink struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (s *recordingSink) send(e event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lines = append(s.lines, e.line)
+	return nil
+}
+
+func (s *recordingSink) close() error { return nil }
+
+func TestRunnersRunConcurrentlyWithoutMixing(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, lines ...string) inputFile {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return inputFile{name: path, kind: mainLog}
+	}
+	firstLine := "2024-03-10 10:00:00 1rA001-0001aB-Cd <= a@corp.com H=h [10.0.0.5] P=esmtp S=1 for b@ext.com"
+	secondLine := "2024-03-10 10:00:00 1rA002-0001aB-Cd <= c@corp.com H=h [10.0.0.5] P=esmtp S=1 for d@ext.com"
+	firstFiles := []inputFile{write("first.log", firstLine, firstLine), {name: filepath.Join(dir, "missing.log"), kind: mainLog}}
+	secondFiles := []inputFile{write("second.log", secondLine)}
+
+	var firstSink, secondSink recordingSink
+	config := func(s sink) Config {
+		return Config{Email: regexp.MustCompile(".*"), Ignore: regexp.MustCompile("^$"), Threads: 2, Sinks: []sink{s}, SinkBuffer: 1}
+	}
+	first := NewRunner(context.Background(), config(&firstSink))
+	second := NewRunner(context.Background(), config(&secondSink))
+	var wg sync.WaitGroup
+	for _, run := range []struct {
+		r     *Runner
+		files []inputFile
+	}{{first, firstFiles}, {second, secondFiles}} {
+		wg.Add(1)
+		go func(r *Runner, files []inputFile) {
+			defer wg.Done()
+			r.Run(files)
+			r.closeSinks()
+		}(run.r, run.files)
+	}
+	wg.Wait()
+
+	for _, test := range []struct {
+		name     string
+		r        *Runner
+		sink     *recordingSink
+		grouped  string
+		lines    []string
+		errors   int
+		statuses int
+	}{
+		{"first", first, &firstSink, "a@corp.com,b@ext.com\n", []string{firstLine, firstLine}, 1, 2},
+		{"second", second, &secondSink, "c@corp.com,d@ext.com\n", []string{secondLine}, 0, 1},
+	} {
+		if got := grouped(t, test.r); got != test.grouped {
+			t.Errorf("%s Runner grouped %q, want %q", test.name, got, test.grouped)
+		}
+		if !reflect.DeepEqual(test.sink.lines, test.lines) {
+			t.Errorf("%s Runner's sink was sent %q, want %q", test.name, test.sink.lines, test.lines)
+		}
+		if got := test.r.runErrors(); got != test.errors {
+			t.Errorf("%s Runner counted %d errors, want %d", test.name, got, test.errors)
+		}
+		if got := len(test.r.fileStatuses); got != test.statuses {
+			t.Errorf("%s Runner noted %d files, want %d", test.name, got, test.statuses)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sampleLabels are the labels -sample balances, in the order they are
+// written. A message is spam if any line about it mentions spam, bounced if
+// any delivery of it failed, and otherwise clean once it completed.
+var sampleLabels = []string{"spam", "bounced", "clean"}
+
+// sampledMessage is what is known of a message in flight, from its arrival.
+type sampledMessage struct {
+	values  []string
+	spam    bool
+	bounced bool
+}
+
+// reservoir keeps a uniform random sample of up to size of the rows offered
+// to it.
+type reservoir struct {
+	rows    [][]string
+	offered int
+}
+
+func (s *reservoir) offer(row []string) {
+	s.offered++
+	if len(s.rows) < sampleSize {
+		s.rows = append(s.rows, row)
+	} else if i := rand.Intn(s.offered); i < sampleSize {
+		s.rows[i] = row
+	}
+}
+
+var (
+	sampleFile = ""
+	sampleSize = 1000
+	// sampledMessages are the messages in flight, until their Completed line
+	// or their rejection.
+	sampledMessages = newInFlight()
+	samples         = make(map[string]*reservoir)
+	sampleLock      = sync.Mutex{}
+
+	sampleColumns = []string{"label", "time", "id", "sender", "recipients", "remote_host", "remote_ip", "protocol", "tls", "authenticated", "size", "message_id"}
+	spamPattern   = regexp.MustCompile(`(?i)spam`)
+)
+
+// isSampleLine is a quick check for lines that may be arrivals, deliveries,
+// failures, completions or about spam, before going to the trouble of
+// parsing them.
+func isSampleLine(line []byte) bool {
+	return isLoopLine(line) || bytes.Contains(line, failureMarker) || spamPattern.Match(line)
+}
+
+// checkSample follows each message from its arrival to its Completed line,
+// or its rejection after data, and then offers it to the sample of its
+// label.
+func checkSample(r record) {
+	if r.id == "" {
+		return
+	}
+
+	sampleLock.Lock()
+	defer sampleLock.Unlock()
+	if r.flag == "<=" {
+		sampledMessages.track(r.id, &sampledMessage{values: sampleValues(r, r.address)})
+		return
+	}
+
+	tracked, ok := sampledMessages.get(r.id)
+	if !ok {
+		// Spam refused after its data never arrived, so is sampled from the
+		// rejection itself.
+		if r.flag == "" && strings.HasPrefix(r.message, "rejected") && spamPattern.MatchString(r.message) {
+			offerSample("spam", sampleValues(r, strings.Trim(r.fields["F"], "<>")))
+		}
+		return
+	}
+	m := tracked.(*sampledMessage)
+	if spamPattern.MatchString(r.message) || spamPattern.MatchString(r.fields["C"]) {
+		m.spam = true
+	}
+	switch {
+	case r.flag == "**":
+		m.bounced = true
+	case r.flag == "" && (r.message == "Completed" || strings.HasPrefix(r.message, "rejected")):
+		label := "clean"
+		switch {
+		case m.spam:
+			label = "spam"
+		case m.bounced:
+			label = "bounced"
+		case r.message != "Completed":
+			sampledMessages.complete(r.id)
+			return
+		}
+		offerSample(label, m.values)
+		sampledMessages.complete(r.id)
+	}
+}
+
+// sampleValues are the sampleColumns after the label for the message r is
+// the arrival or rejection of.
+func sampleValues(r record, sender string) []string {
+	return []string{
+		r.time.UTC().Format(time.RFC3339),
+		r.id,
+		sender,
+		r.fields["for"],
+		r.host(),
+		r.ip(),
+		r.fields["P"],
+		r.fields["X"],
+		strconv.FormatBool(r.fields["A"] != ""),
+		r.fields["S"],
+		r.fields["id"],
+	}
+}
+
+func offerSample(label string, values []string) {
+	s := samples[label]
+	if s == nil {
+		s = &reservoir{}
+		samples[label] = s
+	}
+	s.offer(append([]string{label}, values...))
+}
+
+// writeSamples writes the sample of each label as CSV, oldest first within
+// each label.
+func writeSamples(fileName string) error {
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := csv.NewWriter(outFile)
+	writer.Write(sampleColumns)
+	for _, label := range sampleLabels {
+		s := samples[label]
+		if s == nil {
+			continue
+		}
+		sort.Slice(s.rows, func(i, j int) bool { return s.rows[i][1] < s.rows[j][1] })
+		for _, row := range s.rows {
+			writer.Write(row)
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// jsonSchemaDialect is the JSON Schema draft the schemas are written in.
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// jsonOutput is one of the JSON files crunching writes, with the type each
+// of its records is encoded from, so its schema can't drift from what is
+// written.
+type jsonOutput struct {
+	record      interface{}
+	description string
+}
+
+// jsonOutputs are the JSON outputs a schema is published for, by name.
+var jsonOutputs = map[string]jsonOutput{
+	"json":     {jsonPair{}, "A line of the json -format, a sender and a recipient they mailed with whichever of the -dedupe key, -approximate count, -retention-days dates and -examples lines the run was asked for, and on the first line the schema_version."},
+	"manifest": {manifest{}, "The -manifest of a run, describing what it crunched and wrote and whether it finished."},
+	"trend":    {trend{}, "A line of the -trends file, a run's top level figures."},
+	"progress": {Progress{}, "How far a run has got, served as the crunch expvar on /debug/vars."},
+}
+
+// jsonSchema is the schema of the JSON encoding/json makes of a value of
+// type t. Fields tagged omitempty may be left out, the rest are required.
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Ptr:
+		return jsonSchema(t.Elem())
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if !field.IsExported() || tag == "-" {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = jsonSchema(field.Type)
+			if !strings.Contains(","+options+",", ",omitempty,") {
+				required = append(required, name)
+			}
+		}
+		sort.Strings(required)
+		return map[string]interface{}{"type": "object", "properties": properties, "required": required, "additionalProperties": false}
+	}
+	return map[string]interface{}{}
+}
+
+// outputSchema is the schema of the JSON output name, standing alone.
+func outputSchema(name string) map[string]interface{} {
+	output := jsonOutputs[name]
+	schema := jsonSchema(reflect.TypeOf(output.record))
+	schema["$schema"] = jsonSchemaDialect
+	schema["$id"] = fmt.Sprintf("https://github.com/lachlanmunro/exim/schema/v%d/%s.json", outputSchemaVersion, name)
+	schema["title"] = "exim " + name
+	schema["description"] = output.description
+	return schema
+}
+
+// openAPI describes what serveMetrics serves, with the JSON outputs' schemas
+// as components for clients to share.
+func openAPI() map[string]interface{} {
+	schemas := make(map[string]interface{})
+	for name, output := range jsonOutputs {
+		schema := jsonSchema(reflect.TypeOf(output.record))
+		schema["description"] = output.description
+		schemas[name] = schema
+	}
+	jsonContent := func(schema interface{}) map[string]interface{} {
+		return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+	}
+	return map[string]interface{}{
+		"openapi":           "3.1.0",
+		"jsonSchemaDialect": jsonSchemaDialect,
+		"info": map[string]interface{}{
+			"title":       "exim logfile cruncher",
+			"description": "What the cruncher serves on -metrics while it runs.",
+			"version":     fmt.Sprint(outputSchemaVersion),
+		},
+		"paths": map[string]interface{}{
+			"/metrics": map[string]interface{}{"get": map[string]interface{}{
+				"operationId": "getMetrics",
+				"summary":     "The crunching counters and delivery latencies by provider, in the Prometheus text exposition format",
+				"responses": map[string]interface{}{"200": map[string]interface{}{
+					"description": "The metrics",
+					"content":     map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}},
+				}},
+			}},
+			"/debug/vars": map[string]interface{}{"get": map[string]interface{}{
+				"operationId": "getVars",
+				"summary":     "The expvars, the run's progress as crunch among the runtime's own",
+				"responses": map[string]interface{}{"200": map[string]interface{}{
+					"description": "The expvars",
+					"content": jsonContent(map[string]interface{}{
+						"type":       "object",
+						"properties": map[string]interface{}{"crunch": map[string]interface{}{"$ref": "#/components/schemas/progress"}},
+						"required":   []string{"crunch"},
+					}),
+				}},
+			}},
+			"/openapi.json": map[string]interface{}{"get": map[string]interface{}{
+				"operationId": "getOpenAPI",
+				"summary":     "This description",
+				"responses": map[string]interface{}{"200": map[string]interface{}{
+					"description": "The OpenAPI description",
+					"content":     jsonContent(map[string]interface{}{"type": "object"}),
+				}},
+			}},
+		},
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+// serveOpenAPI serves the OpenAPI description.
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(openAPI())
+}
+
+// runSchema prints the JSON Schema of one of the JSON outputs, or with
+// openapi the OpenAPI description of what -metrics serves, for generating
+// clients and validating what is written.
+func runSchema(args []string) error {
+	flags := flag.NewFlagSet("schema", flag.ExitOnError)
+	flags.Parse(args)
+	names := make([]string, 0, len(jsonOutputs))
+	for name := range jsonOutputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if flags.NArg() != 1 {
+		return errors.New("schema needs one of " + strings.Join(names, ", ") + " or openapi")
+	}
+
+	var document map[string]interface{}
+	switch name := flags.Arg(0); {
+	case name == "openapi":
+		document = openAPI()
+	case jsonOutputs[name].record != nil:
+		document = outputSchema(name)
+	default:
+		return fmt.Errorf("%q is not one of %s or openapi", name, strings.Join(names, ", "))
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(document)
+}
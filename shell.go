@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// relations is grouped output loaded for the shell to explore, indexed both
+// ways.
+type relations struct {
+	recipients map[string][]string
+	senders    map[string][]string
+	names      []string
+}
+
+var shellCommands = []string{"recipients", "senders", "top", "help", "quit"}
+
+// runShell loads grouped output and answers questions about it at a prompt,
+// with tab completion over the commands and addresses when run in a terminal.
+func runShell(args []string) error {
+	flags := flag.NewFlagSet("shell", flag.ExitOnError)
+	db := flags.String("db", "emails", "The grouped output to explore")
+	separatorFlag := flags.String("separator", ",", "The character separating addresses in -db")
+	flags.Parse(args)
+
+	separator, _ = utf8.DecodeRuneInString(*separatorFlag)
+	file, err := os.Open(*db)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	rel := relations{recipients: make(map[string][]string), senders: make(map[string][]string)}
+	err = readGrouped(file, func(from string, to []string) {
+		rel.recipients[from] = append(rel.recipients[from], to...)
+		for _, address := range to {
+			rel.senders[address] = append(rel.senders[address], from)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for address := range rel.recipients {
+		rel.names = append(rel.names, address)
+	}
+	for address := range rel.senders {
+		if rel.recipients[address] == nil {
+			rel.names = append(rel.names, address)
+		}
+	}
+	sort.Strings(rel.names)
+
+	fmt.Printf("%d senders and %d recipients in %s, type help for the commands\n", len(rel.recipients), len(rel.senders), *db)
+	input := newPrompt(rel.complete)
+	defer input.close()
+	for {
+		line, err := input.readLine("exim> ")
+		if err == io.EOF {
+			fmt.Println()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+		if words[0] == "quit" || words[0] == "exit" {
+			return nil
+		}
+		if err := rel.run(os.Stdout, words); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func (rel relations) run(w io.Writer, words []string) error {
+	prefix := ""
+	if len(words) > 1 {
+		prefix = strings.ToLower(words[1])
+	}
+	switch words[0] {
+	case "recipients":
+		return rel.list(w, rel.recipients, prefix)
+	case "senders":
+		return rel.list(w, rel.senders, prefix)
+	case "top":
+		limit := 10
+		if len(words) > 2 {
+			var err error
+			if limit, err = strconv.Atoi(words[2]); err != nil {
+				return fmt.Errorf("%s is not a number", words[2])
+			}
+		}
+		return rel.top(w, prefix, limit)
+	case "help":
+		fmt.Fprint(w, `recipients PREFIX        who the senders starting with PREFIX mailed
+senders PREFIX           who mailed the recipients starting with PREFIX
+top domains [N]          the N recipient domains in the most pairs
+top senders [N]          the N senders who mailed the most recipients
+top recipients [N]       the N recipients mailed by the most senders
+quit                     leave the shell
+`)
+		return nil
+	}
+	return fmt.Errorf("unknown command %s, type help for the commands", words[0])
+}
+
+// list prints everyone each address starting with prefix is related to.
+func (rel relations) list(w io.Writer, related map[string][]string, prefix string) error {
+	if prefix == "" {
+		return errors.New("give the start of an address")
+	}
+	var matches []string
+	for address := range related {
+		if strings.HasPrefix(address, prefix) {
+			matches = append(matches, address)
+		}
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("nothing starts with %s", prefix)
+	}
+	sort.Strings(matches)
+	for _, address := range matches {
+		others := append([]string(nil), related[address]...)
+		sort.Strings(others)
+		fmt.Fprintf(w, "%s (%d)\n", address, len(others))
+		for _, other := range others {
+			fmt.Fprintf(w, "  %s\n", other)
+		}
+	}
+	return nil
+}
+
+// top prints the limit domains, senders or recipients with the most
+// addresses related to them.
+func (rel relations) top(w io.Writer, what string, limit int) error {
+	counts := make(map[string]int)
+	switch what {
+	case "domains":
+		for address, senders := range rel.senders {
+			counts[domainOf(address)] += len(senders)
+		}
+	case "senders":
+		for address, recipients := range rel.recipients {
+			counts[address] = len(recipients)
+		}
+	case "recipients":
+		for address, senders := range rel.senders {
+			counts[address] = len(senders)
+		}
+	default:
+		return errors.New("top what, domains, senders or recipients?")
+	}
+
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	for _, key := range keys {
+		fmt.Fprintf(w, "%8d  %s\n", counts[key], key)
+	}
+	return nil
+}
+
+// complete is what the last word of line could be: a command, what to take
+// the top of, or an address.
+func (rel relations) complete(line string) []string {
+	split := strings.LastIndexByte(line, ' ') + 1
+	words, word := strings.Fields(line[:split]), line[split:]
+
+	var candidates []string
+	switch {
+	case len(words) == 0:
+		candidates = shellCommands
+	case words[0] == "top" && len(words) == 1:
+		candidates = []string{"domains", "senders", "recipients"}
+	case len(words) == 1:
+		start := sort.SearchStrings(rel.names, word)
+		for _, name := range rel.names[start:] {
+			if !strings.HasPrefix(name, word) {
+				break
+			}
+			candidates = append(candidates, name)
+		}
+		return candidates
+	}
+
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, word) {
+			matches = append(matches, candidate)
+		}
+	}
+	return matches
+}
+
+// prompt reads the commands typed at the shell.
+type prompt interface {
+	readLine(prompt string) (string, error)
+	close()
+}
+
+// lineReader reads plain lines, for when the shell isn't run in a terminal.
+type lineReader struct {
+	reader *bufio.Reader
+}
+
+func (l lineReader) readLine(prompt string) (string, error) {
+	fmt.Print(prompt)
+	line, err := l.reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func (l lineReader) close() {}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// event is a parsed mainlog line on its way to the sinks.
+type event struct {
+	// id is the record's id, the same each time the line is crunched.
+	id     string
+	file   inputFile
+	line   string
+	record record
+	// transcript is where the SMTP transcript of the event's message is
+	// kept, if there is a -transcripts service to look it up with.
+	transcript string
+}
+
+// sink is somewhere events are sent as they are crunched. Each sink is sent
+// to from its own stream, one event at a time, and closed by the Runner
+// once the streams are done.
+type sink interface {
+	send(e event) error
+	close() error
+}
+
+// sinkStream feeds a sink the events sent to it from a channel of at most
+// Config.SinkBuffer events, on a goroutine of its own. A sink slower than the
+// workers fills the channel and then holds up every worker sending to it, so
+// crunching goes at the pace of the slowest sink rather than queueing up
+// events without bound. Errors the sink hits are handed back to the workers
+// sending after them, which stop the run.
+type sinkStream struct {
+	sink   sink
+	events chan event
+	done   chan bool
+	lock   sync.Mutex
+	failed []error
+}
+
+// startSinks starts a stream for each of the Runner's sinks, before
+// anything is sent.
+func (r *Runner) startSinks() {
+	for _, s := range r.config.Sinks {
+		stream := &sinkStream{sink: s, events: make(chan event, r.config.SinkBuffer), done: make(chan bool)}
+		go stream.run()
+		r.streams = append(r.streams, stream)
+	}
+}
+
+func (s *sinkStream) run() {
+	defer close(s.done)
+	for e := range s.events {
+		if err := s.sink.send(e); err != nil {
+			s.lock.Lock()
+			s.failed = append(s.failed, err)
+			s.lock.Unlock()
+		}
+	}
+}
+
+// errors takes the errors the sink has hit since they were last taken.
+func (s *sinkStream) errors() []error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	failed := s.failed
+	s.failed = nil
+	return failed
+}
+
+// sinkError is a sink failing to take events, which stops the run rather
+// than crunching on with the events going nowhere.
+type sinkError struct {
+	err error
+}
+
+func (e sinkError) Error() string {
+	return e.err.Error()
+}
+
+func (e sinkError) Unwrap() error {
+	return e.err
+}
+
+// sendEvent hands e to every sink's stream, waiting on any that is full
+// until the Runner is stopped. It returns the errors the sinks hit since they
+// were last sent to, as a sinkError.
+func (r *Runner) sendEvent(e event, w *worker) error {
+	for _, en := range r.config.Enrichers {
+		if err := en.enrich(&e); err != nil {
+			w.log.Error().Err(err).Msg("Failed to enrich event")
+			r.statsLock.Lock()
+			r.sinkErrors++
+			r.statsLock.Unlock()
+		}
+	}
+	var failed []error
+	for _, s := range r.streams {
+		for _, err := range s.errors() {
+			w.log.Error().Err(err).Msg("Failed to send event")
+			r.statsLock.Lock()
+			r.sinkErrors++
+			r.statsLock.Unlock()
+			failed = append(failed, err)
+		}
+		select {
+		case s.events <- e:
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+	if len(failed) > 0 {
+		return sinkError{errors.Join(failed...)}
+	}
+	return nil
+}
+
+// recordID is the id of the record on the line of file ending at offset,
+// from the exim id of its message. It is a hash of them rather than anything
+// random, so crunching the same logs again gives the same ids and whatever
+// the records end up in can upsert rather than duplicate them. A rotated
+// file's records take new ids under its new name.
+func recordID(file string, offset int64, queue string) string {
+	hash := fnv.New128a()
+	hash.Write([]byte(file))
+	hash.Write([]byte{0})
+	hash.Write([]byte(strconv.FormatInt(offset, 10)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(queue))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// closeSinks waits for each stream to send what is left in it and closes
+// its sink.
+func (r *Runner) closeSinks() {
+	for _, s := range r.streams {
+		close(s.events)
+		<-s.done
+		for _, err := range s.errors() {
+			log.Error().Err(err).Msg("Failed to send event")
+			r.sinkErrors++
+		}
+		if err := s.sink.close(); err != nil {
+			log.Error().Err(err).Msg("Failed to close sink")
+			r.sinkErrors++
+		}
+	}
+}
+
+// eventColumns are the columns the tabular sinks write events as, in the
+// order eventValues returns them. A transcript column is added on the end
+// when there is a -transcripts service.
+var eventColumns = []string{"record_id", "time", "host", "source", "id", "event", "address", "direction", "remote_host", "remote_ip", "message", "line"}
+
+// eventValues flattens e, from host, into the values of eventColumns.
+func eventValues(e event, host string) []string {
+	values := []string{
+		e.id,
+		e.record.time.UTC().Format(time.RFC3339Nano),
+		host,
+		e.file.name,
+		e.record.id,
+		eventNames[e.record.flag],
+		e.record.address,
+		eventDirection(e.record),
+		e.record.host(),
+		e.record.ip(),
+		e.record.message,
+		e.line,
+	}
+	if len(values) < len(eventColumns) {
+		values = append(values, e.transcript)
+	}
+	return values
+}
+
+// eventDirection is the direction of the mail an event is about: from the
+// sender to the recipients on arrivals, and by the recipient alone for
+// deliveries, where the sender isn't on the line. Anything else has none.
+func eventDirection(r record) string {
+	switch r.flag {
+	case "<=":
+		recipients := r.fields["for"]
+		if recipients == "" {
+			return ""
+		}
+		way := ""
+		for _, to := range strings.Fields(recipients) {
+			if way = direction(r.address, to); way == "outbound" || way == "relay" {
+				break
+			}
+		}
+		return way
+	case "=>", "->", "**", "==":
+		if isInternal(r.address) {
+			return "inbound"
+		}
+		return "outbound"
+	}
+	return ""
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+// failingSink fails every event it is sent.
+type failingSink struct{}
+
+func (failingSink) send(event) error { return errors.New("sink is down") }
+func (failingSink) close() error     { return nil }
+
+func TestSendEventGivesUpOnAFullSinkOnceStopped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewRunner(ctx, Config{Email: regexp.MustCompile(".*"), Ignore: regexp.MustCompile("^$"), Threads: 1})
+	// Nothing reads the stream, as a sink that has hung wouldn't.
+	r.streams = []*sinkStream{{sink: failingSink{}, events: make(chan event)}}
+	cancel()
+	if err := r.sendEvent(event{}, newWorker(1, inputFile{})); err != context.Canceled {
+		t.Errorf("sending to a full sink returned %v, want it to give up once stopped", err)
+	}
+}
+
+func TestSinkFailureStopsTheRunner(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "mainlog")
+	lines := "2024-03-10 10:00:00 1rA001-0001aB-Cd <= a@corp.com H=h [10.0.0.5] P=esmtp S=1 for b@ext.com\n" +
+		"2024-03-10 10:00:01 1rA002-0001aB-Cd <= a@corp.com H=h [10.0.0.5] P=esmtp S=1 for c@ext.com\n"
+	if err := os.WriteFile(name, []byte(lines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRunner(context.Background(), Config{Email: regexp.MustCompile(".*"), Ignore: regexp.MustCompile("^$"), Threads: 1, Sinks: []sink{failingSink{}}})
+	defer r.closeSinks()
+	// The sink has already failed an event by the time the file is read.
+	r.streams[0].failed = []error{errors.New("sink is down")}
+
+	r.Run([]inputFile{{name: name, kind: mainLog}})
+	if r.Err() == nil {
+		t.Fatal("the run went on after a sink failed")
+	}
+	if matched := r.Progress().Matched; matched != 0 {
+		t.Errorf("matched %d lines after the sink failed, want the run stopped at the first", matched)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// countMinSketch estimates how often each key has been seen in fixed memory,
+// never under counting and over counting only on hash collisions.
+type countMinSketch struct {
+	width  uint64
+	counts [][]uint32
+}
+
+func newCountMinSketch(width, depth int) *countMinSketch {
+	counts := make([][]uint32, depth)
+	for i := range counts {
+		counts[i] = make([]uint32, width)
+	}
+	return &countMinSketch{width: uint64(width), counts: counts}
+}
+
+// add counts another sighting of key and returns its estimated count. Only the
+// rows already at the minimum are bumped (a conservative update), which keeps
+// collisions from inflating estimates as quickly. It is called for every
+// matched line, so finds the minimum and then bumps in two passes over the
+// rows rather than allocating to remember the cells in between.
+func (s *countMinSketch) add(key []byte) uint32 {
+	// FNV-1a, as hash/fnv does, without a hasher to allocate.
+	sum := uint64(14695981039346656037)
+	for _, b := range key {
+		sum ^= uint64(b)
+		sum *= 1099511628211
+	}
+	low, high := sum&0xffffffff, sum>>32
+
+	estimate := ^uint32(0)
+	for i, row := range s.counts {
+		if count := row[(low+uint64(i)*high)%s.width]; count < estimate {
+			estimate = count
+		}
+	}
+	for i, row := range s.counts {
+		if cell := &row[(low+uint64(i)*high)%s.width]; *cell == estimate {
+			*cell++
+		}
+	}
+	return estimate + 1
+}
+
+// heavyHitter is a pair being tracked exactly because it is among the most
+// frequent seen so far.
+type heavyHitter struct {
+	key   string
+	count uint32
+	index int
+}
+
+// heavyHitters keeps the limit most frequent keys offered to it, as a min
+// heap so the least frequent is the one to evict.
+type heavyHitters struct {
+	limit int
+	byKey map[string]*heavyHitter
+	heap  []*heavyHitter
+}
+
+func newHeavyHitters(limit int) *heavyHitters {
+	return &heavyHitters{limit: limit, byKey: make(map[string]*heavyHitter)}
+}
+
+func (h *heavyHitters) Len() int           { return len(h.heap) }
+func (h *heavyHitters) Less(i, j int) bool { return h.heap[i].count < h.heap[j].count }
+func (h *heavyHitters) Swap(i, j int) {
+	h.heap[i], h.heap[j] = h.heap[j], h.heap[i]
+	h.heap[i].index = i
+	h.heap[j].index = j
+}
+func (h *heavyHitters) Push(x interface{}) {
+	hitter := x.(*heavyHitter)
+	hitter.index = len(h.heap)
+	h.heap = append(h.heap, hitter)
+}
+func (h *heavyHitters) Pop() interface{} {
+	hitter := h.heap[len(h.heap)-1]
+	h.heap = h.heap[:len(h.heap)-1]
+	return hitter
+}
+
+// offer updates key's count if it is tracked, or starts tracking it if it
+// beats the least frequent key tracked.
+func (h *heavyHitters) offer(key []byte, count uint32) {
+	if hitter, ok := h.byKey[string(key)]; ok {
+		hitter.count = count
+		heap.Fix(h, hitter.index)
+		return
+	}
+	if len(h.heap) >= h.limit {
+		if h.limit == 0 || count <= h.heap[0].count {
+			return
+		}
+		delete(h.byKey, heap.Pop(h).(*heavyHitter).key)
+	}
+	hitter := &heavyHitter{key: string(key), count: count}
+	h.byKey[hitter.key] = hitter
+	heap.Push(h, hitter)
+}
+
+// top returns the tracked keys, most frequent first.
+func (h *heavyHitters) top() []*heavyHitter {
+	hitters := append([]*heavyHitter(nil), h.heap...)
+	sort.Slice(hitters, func(i, j int) bool { return hitters[i].count > hitters[j].count })
+	return hitters
+}
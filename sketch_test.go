@@ -0,0 +1,42 @@
+package main
+
+import (
+	"hash/fnv"
+	"testing"
+)
+
+func TestCountMinSketchCounts(t *testing.T) {
+	s := newCountMinSketch(1024, 4)
+	for i := uint32(1); i <= 5; i++ {
+		if got := s.add([]byte("a@corp.com\x00b@ext.com")); got != i {
+			t.Fatalf("estimated %d after %d sightings", got, i)
+		}
+	}
+	if got := s.add([]byte("c@corp.com\x00d@ext.com")); got != 1 {
+		t.Errorf("estimated %d for a new key", got)
+	}
+}
+
+func TestCountMinSketchHashesAsFNV(t *testing.T) {
+	// add hashes inline rather than through hash/fnv, so check they agree.
+	key := []byte("a@corp.com\x00b@ext.com")
+	hasher := fnv.New64a()
+	hasher.Write(key)
+	sum := hasher.Sum64()
+	s := newCountMinSketch(1024, 2)
+	s.add(key)
+	low, high := sum&0xffffffff, sum>>32
+	for i, row := range s.counts {
+		if row[(low+uint64(i)*high)%s.width] != 1 {
+			t.Errorf("row %d did not count the key where hash/fnv puts it", i)
+		}
+	}
+}
+
+func TestCountMinSketchAddDoesNotAllocate(t *testing.T) {
+	s := newCountMinSketch(1024, 8)
+	key := []byte("a@corp.com\x00b@ext.com")
+	if allocs := testing.AllocsPerRun(100, func() { s.add(key) }); allocs != 0 {
+		t.Errorf("add allocated %v times per call", allocs)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// smarthostKey is a remote host deliveries were tried at, by the name and
+// IP of its H= field.
+type smarthostKey struct {
+	host string
+	ip   string
+}
+
+// smarthost is how the deliveries tried at a remote host went, with the
+// histogram of the seconds each successful one took from its message
+// arriving.
+type smarthost struct {
+	deliveries int
+	defers     int
+	failures   int
+	latencies  histogram
+}
+
+var (
+	smarthostFile = ""
+	smarthosts    = make(map[smarthostKey]*smarthost)
+	// smarthostArrivals are when each message in flight arrived.
+	smarthostArrivals = newInFlight()
+	smarthostLock     = sync.Mutex{}
+)
+
+// isSmarthostLine is a quick check for lines that may be arrivals, delivery
+// attempts or completions, before going to the trouble of parsing them.
+func isSmarthostLine(line []byte) bool {
+	return isMessageLine(line) || bytes.Contains(line, deferMarker) || bytes.Contains(line, failureMarker)
+}
+
+// checkSmarthost counts each delivery attempt at a remote host as delivered,
+// deferred or failed under the host it was tried at, noting how long each
+// delivery took from its message arriving. Attempts that never got as far
+// as a host, such as those waiting on their retry time, aren't counted.
+func checkSmarthost(r record) {
+	if r.id == "" {
+		return
+	}
+
+	smarthostLock.Lock()
+	defer smarthostLock.Unlock()
+	switch r.flag {
+	case "<=":
+		smarthostArrivals.track(r.id, r.time)
+		return
+	case "":
+		if r.message == "Completed" {
+			smarthostArrivals.complete(r.id)
+		}
+		return
+	case "=>", "->", "==", "**":
+	default:
+		return
+	}
+
+	key := smarthostKey{host: r.host(), ip: r.ip()}
+	if key.ip == "" {
+		return
+	}
+	s := smarthosts[key]
+	if s == nil {
+		s = &smarthost{latencies: histogram{counts: make([]uint64, len(latencyBuckets))}}
+		smarthosts[key] = s
+	}
+	switch r.flag {
+	case "==":
+		s.defers++
+	case "**":
+		s.failures++
+	default:
+		s.deliveries++
+		if arrived, ok := smarthostArrivals.get(r.id); ok {
+			s.latencies.observe(r.time.Sub(arrived.(time.Time)).Seconds())
+		}
+	}
+}
+
+// writeSmarthosts writes a line per remote host with how many deliveries
+// tried there succeeded, deferred and failed, the share that succeeded and
+// the percentiles of how long the successful ones took, estimated from
+// their latency histogram, busiest first.
+func writeSmarthosts(fileName string) error {
+	keys := make([]smarthostKey, 0, len(smarthosts))
+	for key := range smarthosts {
+		keys = append(keys, key)
+	}
+	attempts := func(s *smarthost) int { return s.deliveries + s.defers + s.failures }
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := attempts(smarthosts[keys[i]]), attempts(smarthosts[keys[j]])
+		if a != b {
+			return a > b
+		}
+		return keys[i].host+keys[i].ip < keys[j].host+keys[j].ip
+	})
+
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := csv.NewWriter(outFile)
+	writer.Write([]string{"host", "ip", "attempts", "delivered", "deferred", "failed", "success_rate", "latency_p50", "latency_p90", "latency_p99"})
+	for _, key := range keys {
+		s := smarthosts[key]
+		// Latencies are left empty for hosts none of whose deliveries had
+		// their arrival in the logs crunched.
+		seconds := func(p float64) string {
+			if s.latencies.count == 0 {
+				return ""
+			}
+			return strconv.FormatFloat(s.latencies.quantile(p), 'f', 0, 64)
+		}
+		writer.Write([]string{
+			key.host,
+			key.ip,
+			strconv.Itoa(attempts(s)),
+			strconv.Itoa(s.deliveries),
+			strconv.Itoa(s.defers),
+			strconv.Itoa(s.failures),
+			strconv.FormatFloat(float64(s.deliveries)/float64(attempts(s)), 'f', 4, 64),
+			seconds(50),
+			seconds(90),
+			seconds(99),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
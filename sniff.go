@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var (
+	errNotExim     = errors.New("file does not look like an exim log")
+	eximTimestamp  = regexp.MustCompile(`^\d{4}-\d\d-\d\d \d\d:\d\d:\d\d`)
+	sniffLineCount = 5
+)
+
+// looksLikeExim peeks at the first few lines of reader, without consuming
+// them, and reports whether any of them starts like an exim log line.
+func looksLikeExim(reader *bufio.Reader) bool {
+	head, _ := reader.Peek(reader.Size())
+	if len(head) == 0 {
+		return true
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+
+	var frames unframer
+	for i := 0; i < sniffLineCount && len(head) > 0; i++ {
+		end := bytes.IndexByte(head, '\n')
+		if end < 0 {
+			end = len(head)
+		}
+		if eximTimestamp.Match(frames.unframe(head[:end])) {
+			return true
+		}
+		head = head[end:]
+		if len(head) > 0 {
+			head = head[1:]
+		}
+	}
+	return false
+}
+
+var (
+	// rejectHeader starts the lines a rejectlog follows a rejection with: the
+	// envelope and the message's headers, flagged as exim flags them in
+	// spool files.
+	rejectHeader = regexp.MustCompile(`^(?:Envelope-(?:from|to): |[A-Z* ] [A-Za-z][A-Za-z0-9-]*: )`)
+	// mainMarkers only turn up in a mainlog.
+	mainMarkers = [][]byte{[]byte("Start queue run"), []byte("End queue run"), []byte("SMTP connection from"), completedMarker}
+)
+
+// sniffType reads the start of file to tell which of exim's logs it is,
+// going by its lines rather than its name: a mainlog has message lines and
+// queue runs, a rejectlog has only rejections and the headers logged with
+// them, and a paniclog has neither. It reports false when there is nothing
+// to tell by.
+func sniffType(file inputFile) (logType, bool) {
+	in, err := os.Open(file.name)
+	if err != nil {
+		return "", false
+	}
+	defer in.Close()
+	var reader io.Reader = in
+	if filepath.Ext(file.name) == ".gz" {
+		gz, err := newGzipMembers(in)
+		if err != nil {
+			return "", false
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	head := make([]byte, 64<<10)
+	n, _ := io.ReadFull(reader, head)
+	return classifyLog(head[:n])
+}
+
+func classifyLog(head []byte) (logType, bool) {
+	var main, reject, other int
+	var frames unframer
+	for len(head) > 0 {
+		end := bytes.IndexByte(head, '\n')
+		if end < 0 {
+			end = len(head)
+		}
+		line := frames.unframe(head[:end])
+		head = head[min(end+1, len(head)):]
+
+		switch {
+		case line == nil:
+		case !eximTimestamp.Match(line):
+			if rejectHeader.Match(line) {
+				reject++
+			}
+		case containsAny(line, mainMarkers):
+			main++
+		case bytes.Contains(line, []byte("rejected")):
+			reject++
+		default:
+			if r, err := parseLine(string(line)); err == nil && r.flag != "" {
+				main++
+			} else {
+				other++
+			}
+		}
+	}
+	switch {
+	case main > 0:
+		return mainLog, true
+	case reject > 0:
+		return rejectLog, true
+	case other > 0:
+		return panicLog, true
+	}
+	return "", false
+}
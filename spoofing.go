@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// spoof is mail arriving from outside with one of our domains as its
+// envelope sender, by the IP and host it came from.
+type spoof struct {
+	ip     string
+	host   string
+	domain string
+}
+
+var (
+	spoofingFile    string
+	trustedNetworks []*net.IPNet
+	spoofCounts     = make(map[spoof]int)
+	spoofSenders    = make(map[spoof]map[string]bool)
+	spoofLock       = sync.Mutex{}
+
+	arrivalMarker = []byte(" <= ")
+)
+
+// setTrustedNetworks takes a comma separated list of the CIDRs or IPs mail
+// from our domains is expected to come from.
+func setTrustedNetworks(list string) error {
+	for _, network := range strings.Split(list, ",") {
+		if network = strings.TrimSpace(network); network == "" {
+			continue
+		}
+		if !strings.Contains(network, "/") {
+			if strings.Contains(network, ":") {
+				network += "/128"
+			} else {
+				network += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return err
+		}
+		trustedNetworks = append(trustedNetworks, ipNet)
+	}
+	return nil
+}
+
+func isTrusted(ip net.IP) bool {
+	for _, network := range trustedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isArrivalLine is a quick check for lines that may be <= ones, before going
+// to the trouble of parsing them.
+func isArrivalLine(line []byte) bool {
+	return bytes.Contains(line, arrivalMarker)
+}
+
+// checkSpoofing counts a <= record as spoofed when its envelope sender is at
+// one of our domains but it came over SMTP from an untrusted IP without
+// authenticating, leaving every other record alone.
+func checkSpoofing(r record) {
+	if r.flag != "<=" || r.fields["A"] != "" || !isInternal(r.address) {
+		return
+	}
+	ip := net.ParseIP(r.ip())
+	if ip == nil || isTrusted(ip) {
+		return
+	}
+
+	key := spoof{ip: ip.String(), host: r.host(), domain: domainOf(r.address)}
+	spoofLock.Lock()
+	spoofCounts[key]++
+	if spoofSenders[key] == nil {
+		spoofSenders[key] = make(map[string]bool)
+	}
+	spoofSenders[key][strings.ToLower(r.address)] = true
+	spoofLock.Unlock()
+}
+
+// writeSpoofing writes a line per IP and our domain it sent as, with the
+// number of messages and the senders it used, most messages first.
+func writeSpoofing(fileName string) error {
+	keys := make([]spoof, 0, len(spoofCounts))
+	for key := range spoofCounts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if spoofCounts[keys[i]] != spoofCounts[keys[j]] {
+			return spoofCounts[keys[i]] > spoofCounts[keys[j]]
+		}
+		return keys[i].ip+keys[i].domain < keys[j].ip+keys[j].domain
+	})
+
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := csv.NewWriter(outFile)
+	writer.Write([]string{"ip", "host", "domain", "count", "senders"})
+	for _, key := range keys {
+		senders := make([]string, 0, len(spoofSenders[key]))
+		for sender := range spoofSenders[key] {
+			senders = append(senders, sender)
+		}
+		sort.Strings(senders)
+		writer.Write([]string{key.ip, key.host, key.domain, strconv.Itoa(spoofCounts[key]), strings.Join(senders, " ")})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stageSink writes events as gzipped CSV files laid out for a warehouse to
+// bulk load: prefix/date=YYYY-MM-DD/part-NNNNN.csv.gz, split every so many
+// rows. The target is a local directory, s3://bucket/prefix or
+// gs://bucket/prefix. When it closes it adds the Snowflake COPY INTO and
+// Redshift COPY statements to load what was written.
+type stageSink struct {
+	target  string
+	table   string
+	host    string
+	maxRows int
+	lock    sync.Mutex
+	parts   map[string]*stagePart
+	count   int
+	written int
+}
+
+type stagePart struct {
+	name string
+	key  string
+	file *os.File
+	gzip *gzip.Writer
+	csv  *csv.Writer
+	rows int
+}
+
+func newStageSink(target, table, host string, maxRows int) (*stageSink, error) {
+	if !strings.HasPrefix(target, "s3://") && !strings.HasPrefix(target, "gs://") {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &stageSink{
+		target:  strings.TrimSuffix(target, "/"),
+		table:   table,
+		host:    host,
+		maxRows: maxRows,
+		parts:   make(map[string]*stagePart),
+	}, nil
+}
+
+func (s *stageSink) local() bool {
+	return !strings.HasPrefix(s.target, "s3://") && !strings.HasPrefix(s.target, "gs://")
+}
+
+func (s *stageSink) send(e event) error {
+	date := reportTime(e.record.time).Format("2006-01-02")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	part, ok := s.parts[date]
+	if !ok {
+		var err error
+		if part, err = s.newPart(date); err != nil {
+			return err
+		}
+		s.parts[date] = part
+	}
+
+	if err := part.csv.Write(eventValues(e, s.host)); err != nil {
+		return err
+	}
+	part.rows++
+	if part.rows < s.maxRows {
+		return nil
+	}
+	delete(s.parts, date)
+	return s.finish(part)
+}
+
+// newPart starts the next file for date, on disk where it is going or in a
+// temporary file to upload from.
+func (s *stageSink) newPart(date string) (*stagePart, error) {
+	part := &stagePart{key: fmt.Sprintf("date=%s/part-%05d.csv.gz", date, s.count)}
+	s.count++
+
+	var err error
+	if s.local() {
+		part.name = filepath.Join(s.target, filepath.FromSlash(part.key))
+		if err = os.MkdirAll(filepath.Dir(part.name), 0755); err != nil {
+			return nil, err
+		}
+		part.file, err = os.Create(part.name)
+	} else {
+		part.file, err = ioutil.TempFile("", "exim-stage-")
+	}
+	if err != nil {
+		return nil, err
+	}
+	part.name = part.file.Name()
+	part.gzip = gzip.NewWriter(part.file)
+	part.csv = csv.NewWriter(part.gzip)
+	return part, part.csv.Write(eventColumns)
+}
+
+// finish closes off part and uploads it if the target isn't local.
+func (s *stageSink) finish(part *stagePart) error {
+	part.csv.Flush()
+	err := part.csv.Error()
+	if closeErr := part.gzip.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := part.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || s.local() {
+		s.written++
+		return err
+	}
+
+	defer os.Remove(part.name)
+	file, err := os.Open(part.name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := upload(s.target+"/"+part.key, file); err != nil {
+		return err
+	}
+	s.written++
+	return nil
+}
+
+func (s *stageSink) close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var err error
+	for date, part := range s.parts {
+		if finishErr := s.finish(part); err == nil {
+			err = finishErr
+		}
+		delete(s.parts, date)
+	}
+	if err != nil {
+		return err
+	}
+	return s.writeLoadSQL()
+}
+
+// writeLoadSQL writes load.sql next to the staged files, with the table they
+// fit and the statements to load them into Snowflake or Redshift.
+func (s *stageSink) writeLoadSQL() error {
+	var columns []string
+	for _, column := range eventColumns {
+		kind := "VARCHAR(65535)"
+		if column == "time" {
+			kind = "TIMESTAMPTZ"
+		}
+		columns = append(columns, fmt.Sprintf("  %s %s", column, kind))
+	}
+	location := s.target + "/"
+	var sql strings.Builder
+	fmt.Fprintf(&sql, "-- %d gzipped CSV files with a header row, one directory per log date.\n", s.written)
+	if s.local() {
+		location = "s3://your-bucket/your-prefix/"
+		fmt.Fprintf(&sql, "-- Copy %s to %s first.\n", s.target, location)
+	}
+	sql.WriteString("\n")
+	fmt.Fprintf(&sql, "CREATE TABLE IF NOT EXISTS %s (\n%s\n);\n\n", s.table, strings.Join(columns, ",\n"))
+	fmt.Fprintf(&sql, "-- Snowflake, through an external stage on %s\n", location)
+	fmt.Fprintf(&sql, "COPY INTO %s FROM @%s_stage\n  PATTERN = '.*[.]csv[.]gz'\n  FILE_FORMAT = (TYPE = CSV COMPRESSION = GZIP SKIP_HEADER = 1 FIELD_OPTIONALLY_ENCLOSED_BY = '\"');\n\n", s.table, s.table)
+	fmt.Fprintf(&sql, "-- Redshift, from S3\n")
+	fmt.Fprintf(&sql, "COPY %s FROM '%s'\n  IAM_ROLE 'arn:aws:iam::account:role/your-role'\n  CSV GZIP IGNOREHEADER 1 TIMEFORMAT 'auto';\n", s.table, location)
+
+	if s.local() {
+		return ioutil.WriteFile(filepath.Join(s.target, "load.sql"), []byte(sql.String()), 0644)
+	}
+	return upload(s.target+"/load.sql", strings.NewReader(sql.String()))
+}
+
+// upload puts content at an s3:// or gs:// location.
+func upload(location string, content io.ReadSeeker) error {
+	target, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	key := strings.TrimPrefix(target.Path, "/")
+
+	var request *http.Request
+	switch target.Scheme {
+	case "s3":
+		request, err = signedS3Put(target.Host, key, content)
+	case "gs":
+		var token string
+		if token, err = googleToken(); err != nil {
+			return err
+		}
+		address := "https://storage.googleapis.com/upload/storage/v1/b/" + url.PathEscape(target.Host) + "/o?uploadType=media&name=" + url.QueryEscape(key)
+		if request, err = http.NewRequest(http.MethodPost, address, content); err == nil {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+	default:
+		err = fmt.Errorf("can't upload to %s", location)
+	}
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return decodeResponse(response, nil)
+}
+
+// signedS3Put builds a PUT of content to bucket/key signed with AWS
+// Signature Version 4, using the credentials and region from the usual AWS_
+// environment variables.
+func signedS3Put(bucket, key string, content io.ReadSeeker) (*http.Request, error) {
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to upload to S3")
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, content)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	payload := hex.EncodeToString(hash.Sum(nil))
+
+	host := bucket + ".s3." + region + ".amazonaws.com"
+	escapedKey := "/" + awsEscape(key)
+	request, err := http.NewRequest(http.MethodPut, "https://"+host+escapedKey, content)
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = size
+
+	now := time.Now().UTC()
+	day := now.Format("20060102")
+	headers := map[string]string{
+		"host":                 host,
+		"x-amz-content-sha256": payload,
+		"x-amz-date":           now.Format("20060102T150405Z"),
+	}
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		headers["x-amz-security-token"] = token
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+		if name != "host" {
+			request.Header.Set(name, headers[name])
+		}
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{http.MethodPut, escapedKey, "", canonicalHeaders.String(), signedHeaders, payload}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := day + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + headers["x-amz-date"] + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	signingKey := []byte("AWS4" + secretKey)
+	for _, part := range []string{day, region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(signingKey, toSign)))
+	return request, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape URI encodes a key the way AWS signatures expect, leaving only
+// unreserved characters and slashes alone.
+func awsEscape(key string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(key) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', strings.IndexByte("-._~/", b) >= 0:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
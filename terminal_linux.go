@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// terminal edits lines in raw mode so tab can complete them. It knows
+// printable characters, backspace, tab, enter, ctrl-c and ctrl-d, and ignores
+// escape sequences such as the arrow keys.
+type terminal struct {
+	saved    syscall.Termios
+	reader   *bufio.Reader
+	complete func(line string) []string
+}
+
+// newPrompt edits lines in the terminal when stdin is one, otherwise reads
+// them plainly.
+func newPrompt(complete func(line string) []string) prompt {
+	t := &terminal{reader: bufio.NewReader(os.Stdin), complete: complete}
+	if ioctl(syscall.TCGETS, &t.saved) != nil {
+		return lineReader{reader: t.reader}
+	}
+	raw := t.saved
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Iflag &^= syscall.ICRNL | syscall.IXON
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if ioctl(syscall.TCSETS, &raw) != nil {
+		return lineReader{reader: t.reader}
+	}
+	return t
+}
+
+func ioctl(request uintptr, termios *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdin.Fd(), request, uintptr(unsafe.Pointer(termios))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (t *terminal) close() {
+	ioctl(syscall.TCSETS, &t.saved)
+}
+
+func (t *terminal) readLine(prompt string) (string, error) {
+	fmt.Print(prompt)
+	var line []byte
+	for {
+		b, err := t.reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case b == '\r' || b == '\n':
+			fmt.Print("\r\n")
+			return string(line), nil
+		case b == 3:
+			fmt.Print("^C\r\n" + prompt)
+			line = line[:0]
+		case b == 4:
+			if len(line) == 0 {
+				return "", io.EOF
+			}
+		case b == 127 || b == 8:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				fmt.Print("\b \b")
+			}
+		case b == '\t':
+			line = t.tab(prompt, line)
+		case b == 27:
+			// Skip an escape sequence up to its final letter or tilde.
+			for {
+				next, err := t.reader.ReadByte()
+				if err != nil || ('@' <= next && next <= '~' && next != '[' && next != 'O') {
+					break
+				}
+			}
+		case b >= ' ':
+			line = append(line, b)
+			os.Stdout.Write([]byte{b})
+		}
+	}
+}
+
+// tab extends the last word of line as far as its completions agree, listing
+// them when there is more than one.
+func (t *terminal) tab(prompt string, line []byte) []byte {
+	matches := t.complete(string(line))
+	if len(matches) == 0 {
+		return line
+	}
+	word := string(line[strings.LastIndexByte(string(line), ' ')+1:])
+	common := matches[0]
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(matches) == 1 {
+		common += " "
+	}
+	if len(common) > len(word) {
+		extra := common[len(word):]
+		fmt.Print(extra)
+		return append(line, extra...)
+	}
+
+	shown := matches
+	if len(shown) > 50 {
+		shown = shown[:50]
+	}
+	fmt.Print("\r\n" + strings.Join(shown, "  "))
+	if len(matches) > len(shown) {
+		fmt.Printf("  and %d more", len(matches)-len(shown))
+	}
+	fmt.Print("\r\n" + prompt + string(line))
+	return line
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+)
+
+// newPrompt reads plain lines, as editing them in the terminal is only done
+// on linux.
+func newPrompt(complete func(line string) []string) prompt {
+	return lineReader{reader: bufio.NewReader(os.Stdin)}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "fmt"
+
+// thresholdExitCode is the exit status of a run that crunched fine but broke
+// one of the -fail-if thresholds, the one Nagios takes as critical.
+const thresholdExitCode = 2
+
+var (
+	failLinesBelow   = -1
+	failMatchedBelow = -1
+	failErrorsAbove  = -1
+)
+
+// runErrors is everything that went wrong reading or sending: read errors,
+// including those retried, and events the sinks failed to take.
+func (r *Runner) runErrors() int {
+	r.statsLock.Lock()
+	defer r.statsLock.Unlock()
+	return r.errorCounts[transientError] + r.errorCounts[permanentError] + r.sinkErrors
+}
+
+// brokenThresholds describes each -fail-if threshold the run broke, with -1
+// leaving a threshold unchecked.
+func brokenThresholds(r *Runner) []string {
+	var broken []string
+	p := r.Progress()
+	if failLinesBelow >= 0 && p.Lines < int64(failLinesBelow) {
+		broken = append(broken, fmt.Sprintf("read %d lines, below %d", p.Lines, failLinesBelow))
+	}
+	if failMatchedBelow >= 0 && p.Matched < int64(failMatchedBelow) {
+		broken = append(broken, fmt.Sprintf("matched %d lines, below %d", p.Matched, failMatchedBelow))
+	}
+	if errors := r.runErrors(); failErrorsAbove >= 0 && errors > failErrorsAbove {
+		broken = append(broken, fmt.Sprintf("had %d errors, above %d", errors, failErrorsAbove))
+	}
+	return broken
+}
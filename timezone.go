@@ -0,0 +1,94 @@
+package main
+
+import "time"
+
+var (
+	// logZone is the zone exim wrote the timestamps without an offset in.
+	logZone = time.Local
+	// reportZone is the zone -timezone buckets days and hours in. Without it
+	// days are the dates the lines were logged on, as written.
+	reportZone *time.Location
+)
+
+// resolveTime picks the second of the two times t could be when its wall
+// clock falls in the hour repeated as the clocks go back, which parsing
+// always takes to be the first. Logs only run forwards, so once the file has
+// got well past t the line must be from the repeat. Anything else is kept as
+// parsed.
+func resolveTime(t, latest time.Time) time.Time {
+	if t.Location() != logZone || latest.Sub(t) <= 30*time.Minute {
+		return t
+	}
+	later := t.Add(time.Hour)
+	if later.Format(timestampLayout) != t.Format(timestampLayout) {
+		return t
+	}
+	return later
+}
+
+// lineTime is when line was logged, following on from the latest time the
+// worker has read in its file, or false if it has no timestamp.
+func (w *worker) lineTime(line []byte) (time.Time, bool) {
+	t, _, err := parseTimestamp(string(line))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return w.resolve(t), true
+}
+
+// resolve settles which of a repeated hour t is in and notes it as the
+// latest time read, if it is.
+func (w *worker) resolve(t time.Time) time.Time {
+	t = resolveTime(t, w.latest)
+	if t.After(w.latest) {
+		w.latest = t
+	}
+	return t
+}
+
+// bucket is an hour or a day in the reporting zone, from start up to end. A
+// day the clocks change on is 23 or 25 hours long, and the hour repeated as
+// they go back is two buckets, told apart by their offsets.
+type bucket struct {
+	start time.Time
+	end   time.Time
+}
+
+// bucketZone is the zone buckets are in, -timezone or else the log's own.
+func bucketZone() *time.Location {
+	if reportZone != nil {
+		return reportZone
+	}
+	return logZone
+}
+
+// dayOf is the day t falls in, by the calendar of the bucket zone.
+func dayOf(t time.Time) bucket {
+	y, m, d := t.In(bucketZone()).Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, bucketZone())
+	return bucket{start: start, end: time.Date(y, m, d+1, 0, 0, 0, 0, bucketZone())}
+}
+
+// hourOf is the hour t falls in. Its start is found by going back from t
+// rather than by its wall clock, which in the repeated hour is ambiguous.
+func hourOf(t time.Time) bucket {
+	local := t.In(bucketZone())
+	start := local.Add(-time.Duration(local.Minute())*time.Minute - time.Duration(local.Second())*time.Second - time.Duration(local.Nanosecond()))
+	return bucket{start: start, end: start.Add(time.Hour)}
+}
+
+// dayNumber is the calendar day of b as days since the epoch, the way days
+// are kept for retention and -dedupe day.
+func (b bucket) dayNumber() int32 {
+	y, m, d := b.start.Date()
+	return int32(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400)
+}
+
+// reportTime is t as it is partitioned by date, in -timezone if set and
+// otherwise UTC.
+func reportTime(t time.Time) time.Time {
+	if reportZone != nil {
+		return t.In(reportZone)
+	}
+	return t.UTC()
+}
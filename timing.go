@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// fileTimes is where the time crunching a file went: reading it from disk,
+// decompressing it, parsing its lines and adding matches to the results
+// (including waiting on the lock to do so).
+type fileTimes struct {
+	read       time.Duration
+	decompress time.Duration
+	parse      time.Duration
+	aggregate  time.Duration
+}
+
+// timedReader adds the time spent in each Read to spent.
+type timedReader struct {
+	reader io.Reader
+	spent  *time.Duration
+}
+
+func (t timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.reader.Read(p)
+	*t.spent += time.Since(start)
+	return n, err
+}
+
+// recordTimes adds a finished file's times and its lines per second to the
+// run's totals.
+func (r *Runner) recordTimes(times fileTimes, lines int, elapsed time.Duration) {
+	r.statsLock.Lock()
+	defer r.statsLock.Unlock()
+	r.totalTimes.read += times.read
+	r.totalTimes.decompress += times.decompress
+	r.totalTimes.parse += times.parse
+	r.totalTimes.aggregate += times.aggregate
+	if elapsed > 0 {
+		r.fileRates = append(r.fileRates, float64(lines)/elapsed.Seconds())
+	}
+}
+
+// percentile is the nearest rank pth percentile of sorted.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+func (r *Runner) sortedRates() []float64 {
+	rates := append([]float64(nil), r.fileRates...)
+	sort.Float64s(rates)
+	return rates
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestPercentileIsNearestRank(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5, 6}
+	for _, test := range []struct {
+		p    float64
+		want float64
+	}{
+		{0, 1},
+		{10, 1},
+		{50, 3},
+		{51, 4},
+		{90, 6},
+		{99, 6},
+		{100, 6},
+	} {
+		if got := percentile(sorted, test.p); got != test.want {
+			t.Errorf("p%v of %v is %v, want %v", test.p, sorted, got, test.want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("p50 of nothing is %v, want 0", got)
+	}
+}
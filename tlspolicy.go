@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsRule is a line of the -tls-policy file, a domain glob and the lowest
+// TLS version mail to or from it may use, as 10 times the minor version of
+// TLS 1.x, so 12 for TLS 1.2.
+type tlsRule struct {
+	pattern string
+	minimum int
+}
+
+// tlsViolation is a receipt or delivery that broke the TLS policy.
+type tlsViolation struct {
+	time     time.Time
+	id       string
+	kind     string
+	domain   string
+	address  string
+	host     string
+	ip       string
+	tls      string
+	required string
+}
+
+var (
+	tlsRules      []tlsRule
+	tlsFile       = ""
+	tlsViolations []tlsViolation
+	tlsLock       = sync.Mutex{}
+
+	// tlsVersion finds the protocol in an X= field, TLS1.2 from GnuTLS or
+	// TLSv1.2 from OpenSSL, with SSLv3 and older taken as version 0.
+	tlsVersion     = regexp.MustCompile(`^(?:TLSv?1(?:\.(\d))?|SSLv\d)`)
+	tlsPolicyValue = regexp.MustCompile(`^(?:TLSv?)?1\.(\d)$`)
+)
+
+// loadTLSPolicy reads the policy file, each line a domain glob and
+// optionally the lowest TLS version allowed, 1.2 if not given. The first
+// line matching a domain is the one that applies.
+func loadTLSPolicy(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+		rule := tlsRule{pattern: strings.ToLower(words[0]), minimum: 12}
+		if _, err := path.Match(rule.pattern, ""); err != nil {
+			return err
+		}
+		if len(words) > 1 {
+			matches := tlsPolicyValue.FindStringSubmatch(words[1])
+			if matches == nil {
+				return fmt.Errorf("TLS version %q for %s is not 1.0 to 1.3", words[1], words[0])
+			}
+			rule.minimum = 10 + int(matches[1][0]-'0')
+		}
+		tlsRules = append(tlsRules, rule)
+	}
+	return scanner.Err()
+}
+
+// tlsMinimum is the lowest TLS version mail to or from domain may use, or 0
+// if the policy doesn't cover it.
+func tlsMinimum(domain string) int {
+	for _, rule := range tlsRules {
+		if matched, _ := path.Match(rule.pattern, domain); matched {
+			return rule.minimum
+		}
+	}
+	return 0
+}
+
+// tlsOf is the TLS version an X= field shows, in the form of tlsRule, or -1
+// without TLS at all.
+func tlsOf(field string) int {
+	matches := tlsVersion.FindStringSubmatch(field)
+	switch {
+	case matches == nil:
+		return -1
+	case strings.HasPrefix(matches[0], "SSL"):
+		return 0
+	case matches[1] == "":
+		return 10
+	}
+	return 10 + int(matches[1][0]-'0')
+}
+
+// isTLSLine is a quick check for lines that may be receipts or deliveries,
+// before going to the trouble of parsing them.
+func isTLSLine(line []byte) bool {
+	return isArrivalLine(line) || bytes.Contains(line, deliveryMarker) || bytes.Contains(line, routedMarker)
+}
+
+// checkTLSPolicy notes receipts from, and deliveries to, domains under the
+// policy that used no TLS or too old a version of it.
+func checkTLSPolicy(r record) {
+	kind := ""
+	switch r.flag {
+	case "<=":
+		kind = "receipt"
+	case "=>", "->":
+		kind = "delivery"
+	default:
+		return
+	}
+	// Local deliveries and submissions never crossed the network.
+	if r.ip() == "" {
+		return
+	}
+	domain := domainOf(r.address)
+	minimum := tlsMinimum(domain)
+	if minimum == 0 || tlsOf(r.fields["X"]) >= minimum {
+		return
+	}
+
+	tlsLock.Lock()
+	tlsViolations = append(tlsViolations, tlsViolation{
+		time:     r.time,
+		id:       r.id,
+		kind:     kind,
+		domain:   domain,
+		address:  strings.ToLower(r.address),
+		host:     r.host(),
+		ip:       r.ip(),
+		tls:      r.fields["X"],
+		required: fmt.Sprintf("TLS1.%d", minimum-10),
+	})
+	tlsLock.Unlock()
+}
+
+// writeTLSViolations writes every receipt and delivery that broke the TLS
+// policy as CSV, oldest first.
+func writeTLSViolations(fileName string) error {
+	sort.SliceStable(tlsViolations, func(i, j int) bool { return tlsViolations[i].time.Before(tlsViolations[j].time) })
+
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := csv.NewWriter(outFile)
+	writer.Write([]string{"time", "id", "kind", "domain", "address", "remote_host", "remote_ip", "tls", "required"})
+	for _, v := range tlsViolations {
+		writer.Write([]string{v.time.Format(time.RFC3339), v.id, v.kind, v.domain, v.address, v.host, v.ip, v.tls, v.required})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/lachlanmunro/exim/aggregate"
+)
+
+// trend is a run's line of the -trends file, its top level figures kept
+// across runs to show slow drifts in how mail behaves.
+type trend struct {
+	Started    string  `json:"started"`
+	Partial    bool    `json:"partial,omitempty"`
+	Lines      int64   `json:"lines"`
+	Messages   int     `json:"messages"`
+	Senders    int64   `json:"senders"`
+	Deliveries int     `json:"deliveries"`
+	Bounces    int     `json:"bounces"`
+	BounceRate float64 `json:"bounce_rate"`
+	Pairs      int     `json:"pairs"`
+	NewPairs   int     `json:"new_pairs"`
+}
+
+// trendColumns are the figures the trends report charts, in order.
+var trendColumns = []struct {
+	name  string
+	value func(t trend) float64
+}{
+	{"messages", func(t trend) float64 { return float64(t.Messages) }},
+	{"senders", func(t trend) float64 { return float64(t.Senders) }},
+	{"bounce_rate", func(t trend) float64 { return t.BounceRate }},
+	{"new_pairs", func(t trend) float64 { return float64(t.NewPairs) }},
+	{"pairs", func(t trend) float64 { return float64(t.Pairs) }},
+}
+
+var (
+	trendsFile = ""
+	// trendMessages, trendDeliveries and trendBounces count arrivals,
+	// deliveries and permanent failures for the run's -trends line.
+	trendMessages   = 0
+	trendDeliveries = 0
+	trendBounces    = 0
+	trendLock       = sync.Mutex{}
+)
+
+// checkTrend counts the arrivals, deliveries and bounces of the run.
+func checkTrend(r record) {
+	trendLock.Lock()
+	defer trendLock.Unlock()
+	switch r.flag {
+	case "<=":
+		trendMessages++
+	case "=>", "->":
+		trendDeliveries++
+	case "**":
+		trendBounces++
+	}
+}
+
+// appendTrend adds the run's figures to the -trends file. New pairs are those
+// no earlier run saw, going by the hashes of every pair seen so far, kept
+// sorted beside the trends file.
+func appendTrend(fileName string, t trend, emails *aggregate.Aggregator) error {
+	t.Messages, t.Deliveries, t.Bounces = trendMessages, trendDeliveries, trendBounces
+	if t.Deliveries+t.Bounces > 0 {
+		t.BounceRate = float64(t.Bounces) / float64(t.Deliveries+t.Bounces)
+	}
+
+	known, err := readKnownPairs(fileName + ".pairs")
+	if err != nil {
+		return err
+	}
+	var added []uint64
+	emails.Each(func(from uint32, recipients []uint32) bool {
+		for _, to := range recipients {
+			t.Pairs++
+			hash := fnv.New64a()
+			hash.Write([]byte(emails.Name(from)))
+			hash.Write([]byte{0})
+			hash.Write([]byte(emails.Name(to)))
+			if _, found := slices.BinarySearch(known, hash.Sum64()); !found {
+				added = append(added, hash.Sum64())
+			}
+		}
+		return true
+	})
+	t.NewPairs = len(added)
+	if len(added) > 0 {
+		if err := writeKnownPairs(fileName+".pairs", append(known, added...)); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(file).Encode(t); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func readKnownPairs(fileName string) ([]uint64, error) {
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(data)%8 != 0 {
+		return nil, fmt.Errorf("%s is not a whole number of pair hashes", fileName)
+	}
+	known := make([]uint64, 0, len(data)/8)
+	for i := 0; i < len(data); i += 8 {
+		known = append(known, binary.BigEndian.Uint64(data[i:]))
+	}
+	return known, nil
+}
+
+// writeKnownPairs replaces the known pair hashes with known, sorted, by way
+// of a temporary file so a run dying part way leaves the old ones.
+func writeKnownPairs(fileName string, known []uint64) error {
+	slices.Sort(known)
+	data := make([]byte, 0, len(known)*8)
+	for _, hash := range slices.Compact(known) {
+		data = binary.BigEndian.AppendUint64(data, hash)
+	}
+	if err := os.WriteFile(fileName+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// runTrends charts each figure in a -trends file across the last runs, with
+// how far the latest run is from the average of the ones before it.
+func runTrends(args []string) error {
+	flags := flag.NewFlagSet("trends", flag.ExitOnError)
+	runs := flags.Int("runs", 30, "How many of the latest runs to chart")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("trends needs the -trends file to chart")
+	}
+
+	trends, err := readTrends(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(trends) == 0 {
+		return errors.New("no runs in " + flags.Arg(0))
+	}
+	if len(trends) > *runs {
+		trends = trends[len(trends)-*runs:]
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(out, "%d runs from %s to %s\n", len(trends), trends[0].Started, trends[len(trends)-1].Started)
+	for _, column := range trendColumns {
+		values := make([]float64, len(trends))
+		for i, t := range trends {
+			values[i] = column.value(t)
+		}
+		latest := values[len(values)-1]
+		drift := ""
+		if len(values) > 1 {
+			mean := 0.0
+			for _, value := range values[:len(values)-1] {
+				mean += value
+			}
+			mean /= float64(len(values) - 1)
+			if mean != 0 {
+				drift = fmt.Sprintf("%+.1f%%", (latest-mean)/mean*100)
+			}
+		}
+		fmt.Fprintf(out, "%-12s %s %12s %8s\n", column.name, sparkline(values), strconv.FormatFloat(latest, 'g', 6, 64), drift)
+	}
+	for _, t := range trends {
+		if t.Partial {
+			fmt.Fprintln(out, "Runs stopped early are included as they were, partial")
+			break
+		}
+	}
+	return out.Flush()
+}
+
+func readTrends(fileName string) ([]trend, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var trends []trend
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for {
+		var t trend
+		if err := decoder.Decode(&t); err == io.EOF {
+			return trends, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("run %d of %s: %s", len(trends)+1, fileName, err)
+		}
+		trends = append(trends, t)
+	}
+}
+
+// sparkline draws values as a line of block characters scaled between the
+// smallest and largest of them.
+func sparkline(values []float64) string {
+	blocks := []rune("▁▂▃▄▅▆▇█")
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, value := range values {
+		low, high = min(low, value), max(high, value)
+	}
+	line := make([]rune, len(values))
+	for i, value := range values {
+		level := 0
+		if high > low {
+			level = int((value - low) / (high - low) * float64(len(blocks)-1))
+		}
+		line[i] = blocks[level]
+	}
+	return string(line)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// typoMatch is the watched domain a recipient domain is a likely typo of,
+// or nothing when it isn't close to any.
+type typoMatch struct {
+	near     string
+	distance int
+}
+
+// typoHits are the senders who mailed a typo domain and how many times.
+type typoHits struct {
+	match   typoMatch
+	count   int
+	senders map[string]bool
+}
+
+var (
+	typoFile     = ""
+	typoDistance = 2
+	// typoWatched are the domains recipients are checked for typos of, ours
+	// from -internal-domains and any from -typo-domains.
+	typoWatched []string
+	// typoChecked caches what each recipient domain seen is close to.
+	typoChecked = make(map[string]typoMatch)
+	typoDomains = make(map[string]*typoHits)
+	typoLock    = sync.Mutex{}
+)
+
+// setTypoDomains watches the internal domains and a comma separated list of
+// others, such as partners and the big mailbox providers.
+func setTypoDomains(list string) {
+	watched := make(map[string]bool)
+	for domain := range internalDomains {
+		watched[domain] = true
+	}
+	for _, domain := range strings.Split(list, ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			watched[domain] = true
+		}
+	}
+	for domain := range watched {
+		typoWatched = append(typoWatched, domain)
+	}
+	sort.Strings(typoWatched)
+}
+
+// checkTypo counts mail from sender to a recipient whose domain is within
+// -typo-distance edits of a watched domain without being it.
+func checkTypo(from, to string) {
+	domain := domainOf(to)
+	typoLock.Lock()
+	defer typoLock.Unlock()
+	match, ok := typoChecked[domain]
+	if !ok {
+		match = nearestWatched(domain)
+		typoChecked[domain] = match
+	}
+	if match.near == "" {
+		return
+	}
+	hits := typoDomains[domain]
+	if hits == nil {
+		hits = &typoHits{match: match, senders: make(map[string]bool)}
+		typoDomains[domain] = hits
+	}
+	hits.count++
+	hits.senders[from] = true
+}
+
+// nearestWatched is the closest watched domain to domain within
+// -typo-distance, if domain isn't itself watched or a subdomain of one.
+func nearestWatched(domain string) typoMatch {
+	best := typoMatch{distance: typoDistance + 1}
+	for _, watched := range typoWatched {
+		if domain == watched || strings.HasSuffix(domain, "."+watched) {
+			return typoMatch{}
+		}
+		if d := editDistance(domain, watched, best.distance); d < best.distance {
+			best = typoMatch{near: watched, distance: d}
+		}
+	}
+	if best.near == "" {
+		return typoMatch{}
+	}
+	return best
+}
+
+// editDistance is the optimal string alignment distance between a and b,
+// counting swapped neighbours as one edit as gmial for gmail is, or limit
+// once it is clear it's at least that.
+func editDistance(a, b string, limit int) int {
+	if d := len(a) - len(b); d >= limit || -d >= limit {
+		return limit
+	}
+	before := make([]int, len(b)+1)
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		lowest := i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				current[j] = min(current[j], before[j-2]+1)
+			}
+			lowest = min(lowest, current[j])
+		}
+		if lowest >= limit {
+			return limit
+		}
+		before, previous, current = previous, current, before
+	}
+	return min(previous[len(b)], limit)
+}
+
+// writeTypos writes each recipient domain that looks like a typo of a
+// watched one, with the senders who mailed it, busiest first.
+func writeTypos(fileName string) error {
+	domains := make([]string, 0, len(typoDomains))
+	for domain := range typoDomains {
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if typoDomains[domains[i]].count != typoDomains[domains[j]].count {
+			return typoDomains[domains[i]].count > typoDomains[domains[j]].count
+		}
+		return domains[i] < domains[j]
+	})
+
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	writer := csv.NewWriter(outFile)
+	writer.Write([]string{"domain", "near", "distance", "count", "senders"})
+	for _, domain := range domains {
+		hits := typoDomains[domain]
+		senders := make([]string, 0, len(hits.senders))
+		for sender := range hits.senders {
+			senders = append(senders, sender)
+		}
+		sort.Strings(senders)
+		writer.Write([]string{domain, hits.match.near, strconv.Itoa(hits.match.distance), strconv.Itoa(hits.count), strings.Join(senders, " ")})
+	}
+	writer.Flush()
+	return writer.Error()
+}
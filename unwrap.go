@@ -0,0 +1,82 @@
+package main
+
+import "strings"
+
+// unwrapSRS and unwrapVERP turn rewritten bounce addresses back into the
+// senders behind them, so forwarded and list mail groups under them.
+var (
+	unwrapSRS  = false
+	unwrapVERP = false
+)
+
+// unwrapSender undoes whichever rewriting of address is turned on, leaving
+// addresses that don't look rewritten alone.
+func unwrapSender(address string) string {
+	if unwrapSRS {
+		if original, ok := unSRS(address); ok {
+			return original
+		}
+	}
+	if unwrapVERP {
+		if original, ok := unVERP(address); ok {
+			return original
+		}
+	}
+	return address
+}
+
+// unSRS decodes SRS0=hash=tt=domain=local@forwarder and
+// SRS1=hash=forwarder==hash=tt=domain=local@forwarder back to local@domain.
+func unSRS(address string) (string, bool) {
+	at := strings.LastIndexByte(address, '@')
+	if at < 0 {
+		return "", false
+	}
+	local := address[:at]
+	switch {
+	case len(local) > 5 && strings.EqualFold(local[:5], "srs1="):
+		inner := strings.Index(local, "==")
+		if inner < 0 {
+			return "", false
+		}
+		local = local[inner+2:]
+	case len(local) > 5 && strings.EqualFold(local[:5], "srs0="):
+		local = local[5:]
+	default:
+		return "", false
+	}
+
+	// hash=tt=domain=local, where local may itself hold an =.
+	parts := strings.SplitN(local, "=", 4)
+	if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+		return "", false
+	}
+	return parts[3] + "@" + parts[2], true
+}
+
+// unVERP decodes prefix+local=domain@lists or prefix-local=domain@lists back
+// to local@domain. Where there is no +, the recipient is taken to start after
+// the last - before the =, which a local part with a - in it would confuse.
+func unVERP(address string) (string, bool) {
+	at := strings.LastIndexByte(address, '@')
+	if at < 0 {
+		return "", false
+	}
+	local := address[:at]
+	equals := strings.LastIndexByte(local, '=')
+	if equals < 0 {
+		return "", false
+	}
+	domain := local[equals+1:]
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", false
+	}
+	start := strings.IndexByte(local[:equals], '+')
+	if start < 0 {
+		start = strings.LastIndexByte(local[:equals], '-')
+	}
+	if start < 0 || start == equals-1 {
+		return "", false
+	}
+	return local[start+1:equals] + "@" + domain, true
+}
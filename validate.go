@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxProblems is how many problems of each kind validate-output lists before
+// only counting them.
+const maxProblems = 10
+
+// validation is what validate-output found in an output file.
+type validation struct {
+	format     string
+	version    string
+	records    int
+	senders    map[string]bool
+	pairs      map[string]bool
+	last       string
+	duplicates int
+	invalid    int
+	problems   []string
+}
+
+// runValidateOutput checks output from any format reads back whole, without
+// senders split across records, pairs written twice or invalid addresses, and
+// with the schema version this build writes where the format records one.
+func runValidateOutput(args []string) error {
+	flags := flag.NewFlagSet("validate-output", flag.ExitOnError)
+	format := flags.String("format", "", "The format of the file, one of grouped, arrow, json, msgpack or protobuf, worked out from its start if not given")
+	separatorFlag := flags.String("separator", ",", "The character separating addresses in grouped output")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("validate-output needs the output file to check")
+	}
+	separator, _ = utf8.DecodeRuneInString(*separatorFlag)
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	v := &validation{format: *format, senders: make(map[string]bool), pairs: make(map[string]bool)}
+	if v.format == "" {
+		v.format = detectFormat(reader)
+	}
+
+	switch v.format {
+	case "grouped":
+		err = readGrouped(reader, func(from string, to []string) {
+			if len(to) == 2 && !strings.Contains(to[1], "@") {
+				if count, countErr := strconv.ParseInt(to[1], 10, 64); countErr == nil {
+					v.pair(pair{from: from, to: to[0], count: count})
+					return
+				}
+			}
+			if len(to) == 0 {
+				v.problem("line %d for %s has no recipients", v.records+1, from)
+			}
+			v.sender(from)
+			for _, address := range to {
+				v.address(address)
+			}
+			v.records++
+		})
+	case "arrow", "json", "msgpack", "protobuf":
+		v.version, err = pairReaders[v.format](reader, v.pair)
+		// Only empty json and protobuf output has no record to carry the
+		// version.
+		if v.version != strconv.Itoa(outputSchemaVersion) && (v.version != "" || v.records > 0) {
+			v.problem("schema version is %q, not %d", v.version, outputSchemaVersion)
+		}
+	default:
+		return fmt.Errorf("unknown format %s", v.format)
+	}
+	if err != nil {
+		v.problem("record %d does not read back: %s", v.records+1, err)
+	}
+
+	fmt.Printf("format: %s\n", v.format)
+	if v.version != "" {
+		fmt.Printf("schema version: %s\n", v.version)
+	}
+	fmt.Printf("records: %d\nsenders: %d\nduplicates: %d\ninvalid addresses: %d\n", v.records, len(v.senders), v.duplicates, v.invalid)
+	for _, problem := range v.problems {
+		fmt.Println(problem)
+	}
+	if len(v.problems) > 0 {
+		return fmt.Errorf("%s is not valid output", flags.Arg(0))
+	}
+	return nil
+}
+
+// detectFormat works out which format output is in from how it starts: the
+// arrow continuation marker, a JSON object, or a varint length then what
+// starts a msgpack map or array or a protobuf Pair, and otherwise grouped
+// lines.
+func detectFormat(reader *bufio.Reader) string {
+	start, _ := reader.Peek(16)
+	if len(start) >= 4 && binary.LittleEndian.Uint32(start) == arrowContinuing {
+		return "arrow"
+	}
+	if len(start) > 0 && start[0] == '{' {
+		return "json"
+	}
+	if _, n := binary.Uvarint(start); n > 0 && n < len(start) {
+		switch {
+		case start[n]&0xf0 == 0x80, start[n]&0xf0 == 0x90:
+			return "msgpack"
+		case start[n] == 0x0a:
+			return "protobuf"
+		}
+	}
+	return "grouped"
+}
+
+// pair checks a from, to record. Counted pairs, from -approximate, are in
+// count order so are only checked for repeats, while the others come a
+// sender at a time.
+func (v *validation) pair(p pair) error {
+	from, to := p.from, p.to
+	v.records++
+	if p.expires != "" && p.expires < p.lastSeen {
+		v.problem("pair %s to %s expires before it was last seen", from, to)
+	}
+	if p.count > 0 {
+		key := from + pairSeparator + to
+		if v.pairs[key] {
+			v.duplicates++
+			v.problem("pair %s to %s is repeated", from, to)
+		}
+		v.pairs[key] = true
+		v.senders[from] = true
+		v.address(from)
+	} else if from != v.last {
+		v.sender(from)
+	}
+	v.last = from
+	v.address(to)
+	return nil
+}
+
+// sender checks the records for a sender haven't been seen before.
+func (v *validation) sender(from string) {
+	if v.senders[from] {
+		v.duplicates++
+		v.problem("sender %s is repeated", from)
+	}
+	v.senders[from] = true
+	v.address(from)
+}
+
+func (v *validation) address(address string) {
+	if !validAddress(address) {
+		v.invalid++
+		v.problem("address %q is invalid", address)
+	}
+}
+
+// problem notes something wrong, keeping only the first few of each kind.
+func (v *validation) problem(format string, args ...interface{}) {
+	kind := format[:strings.IndexByte(format+" ", ' ')]
+	seen := 0
+	for _, problem := range v.problems {
+		if strings.HasPrefix(problem, kind+" ") {
+			seen++
+		}
+	}
+	if seen < maxProblems {
+		v.problems = append(v.problems, fmt.Sprintf(format, args...))
+	}
+}
+
+// validAddress is a loose check that address has a local part and a dotted
+// domain without spaces or control characters.
+func validAddress(address string) bool {
+	at := strings.LastIndexByte(address, '@')
+	if at < 1 || at == len(address)-1 {
+		return false
+	}
+	for _, r := range address {
+		if r <= ' ' || r == 0x7f || r == utf8.RuneError {
+			return false
+		}
+	}
+	for _, label := range strings.Split(address[at+1:], ".") {
+		if label == "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeOutput(t *testing.T, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateOutputChecksTheSchemaVersionOfEachFormat(t *testing.T) {
+	for _, format := range []string{"arrow", "json", "msgpack", "protobuf"} {
+		var out bytes.Buffer
+		writer, err := pairFormats[format](&out, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []pair{{from: "a@corp.com", to: "b@ext.com"}, {from: "c@corp.com", to: "d@ext.com"}} {
+			if err := writer.write(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := runValidateOutput([]string{writeOutput(t, "out."+format, out.Bytes())}); err != nil {
+			t.Errorf("%s output written by this build failed validation: %v", format, err)
+		}
+	}
+
+	framed := func(record []byte) []byte {
+		return append(binary.AppendUvarint(nil, uint64(len(record))), record...)
+	}
+	pair := protobufString(protobufString(nil, 1, "a@corp.com"), 2, "b@ext.com")
+	newer := binary.AppendUvarint(append(pair[:len(pair):len(pair)], 6<<3), 2)
+	tests := []struct {
+		name, format string
+		content      []byte
+	}{
+		{"newer json", "json", []byte(`{"schema_version":2,"from":"a@corp.com","to":"b@ext.com"}` + "\n")},
+		{"newer protobuf", "protobuf", framed(newer)},
+		{"unversioned protobuf", "protobuf", framed(pair)},
+		{"unversioned msgpack", "msgpack", framed(msgpackString(msgpackString([]byte{0x92}, "a@corp.com"), "b@ext.com"))},
+	}
+	for _, test := range tests {
+		if err := runValidateOutput([]string{"-format", test.format, writeOutput(t, "out", test.content)}); err == nil {
+			t.Errorf("%s output passed validation", test.name)
+		}
+	}
+}
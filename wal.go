@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// The write-ahead log holds every line crunched while following, written
+// before the line is aggregated, so a run killed before writing its output
+// can be picked up again without losing any. Records are framed like the
+// binary formats, a varint length first. A file record gives the next file
+// number to a file's device and inode, as varints, and name, and a line
+// record has the file's number, the offset just past the line and the line
+// itself. Lines only buffered when the run died are read
+// again from their files, as the run picks up from the last offset logged.
+const (
+	walFileRecord = 'f'
+	walLineRecord = 'l'
+)
+
+type writeAheadLog struct {
+	lock     sync.Mutex
+	file     *os.File
+	buffered *bufio.Writer
+	numbers  map[walFile]uint64
+	files    []walFile
+	record   []byte
+	length   []byte
+}
+
+// walFile is a file lines were logged from, by name and by identity, so a
+// file rotated into its name is told apart from the one logged.
+type walFile struct {
+	name string
+	id   fileID
+}
+
+// resumeOffset is where a file was crunched to, and which file it was.
+type resumeOffset struct {
+	id     fileID
+	offset int64
+}
+
+var wal *writeAheadLog
+
+// openWAL replays the write-ahead log at fileName, if there is one, calling
+// replay with each line in it, the id of the file it was read from and the
+// offset just past it, then carries on appending to it.
+func openWAL(fileName string, replay func(file inputFile, id fileID, offset int64, line []byte)) (*writeAheadLog, error) {
+	w := &writeAheadLog{numbers: make(map[walFile]uint64)}
+	if in, err := os.Open(fileName); err == nil {
+		good, err := w.replay(bufio.NewReader(in), replay)
+		in.Close()
+		if err != nil {
+			return nil, fmt.Errorf("replaying %s: %s", fileName, err)
+		}
+		// Cut off any record the run died part way through writing, so
+		// what is appended follows on from the last whole one.
+		if err := os.Truncate(fileName, good); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w.file = file
+	w.buffered = bufio.NewWriter(file)
+	return w, nil
+}
+
+// replay reads back each line record, calling fn with it, and returns how
+// many bytes of whole records there were. A record cut short by the run
+// dying is taken as the end of the log.
+func (w *writeAheadLog) replay(r *bufio.Reader, fn func(file inputFile, id fileID, offset int64, line []byte)) (int64, error) {
+	var good int64
+	var record []byte
+	for {
+		length, err := binary.ReadUvarint(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return good, nil
+		}
+		if err != nil {
+			return good, err
+		}
+		if length > 1<<24 {
+			return good, fmt.Errorf("record of %d bytes is too big", length)
+		}
+		if uint64(cap(record)) < length {
+			record = make([]byte, length)
+		}
+		record = record[:length]
+		if _, err := io.ReadFull(r, record); err != nil {
+			return good, nil
+		}
+		if len(record) == 0 {
+			return good, errors.New("empty record")
+		}
+
+		switch record[0] {
+		case walFileRecord:
+			dev, n := binary.Uvarint(record[1:])
+			if n <= 0 {
+				return good, errors.New("file record has a bad device")
+			}
+			rest := record[1+n:]
+			ino, n := binary.Uvarint(rest)
+			if n <= 0 {
+				return good, errors.New("file record has a bad inode")
+			}
+			file := walFile{name: string(rest[n:]), id: fileID{dev: dev, ino: ino}}
+			w.numbers[file] = uint64(len(w.files))
+			w.files = append(w.files, file)
+		case walLineRecord:
+			number, n := binary.Uvarint(record[1:])
+			if n <= 0 || number >= uint64(len(w.files)) {
+				return good, errors.New("line record for an unknown file")
+			}
+			rest := record[1+n:]
+			offset, n := binary.Uvarint(rest)
+			if n <= 0 {
+				return good, errors.New("line record has a bad offset")
+			}
+			file := w.files[number]
+			fn(inputFile{name: file.name, kind: mainLog}, file.id, int64(offset), rest[n:])
+		default:
+			return good, fmt.Errorf("unknown record type %q", record[0])
+		}
+		w.length = binary.AppendUvarint(w.length[:0], length)
+		good += int64(len(w.length)) + int64(length)
+	}
+}
+
+// append logs line, which ends offset bytes into the file name, which is
+// the file id.
+func (w *writeAheadLog) append(name string, id fileID, offset int64, line []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	file := walFile{name: name, id: id}
+	number, ok := w.numbers[file]
+	if !ok {
+		number = uint64(len(w.files))
+		w.numbers[file] = number
+		w.files = append(w.files, file)
+		w.record = append(w.record[:0], walFileRecord)
+		w.record = binary.AppendUvarint(w.record, id.dev)
+		w.record = binary.AppendUvarint(w.record, id.ino)
+		w.record = append(w.record, name...)
+		if err := w.write(); err != nil {
+			return err
+		}
+	}
+	w.record = append(w.record[:0], walLineRecord)
+	w.record = binary.AppendUvarint(w.record, number)
+	w.record = binary.AppendUvarint(w.record, uint64(offset))
+	w.record = append(w.record, line...)
+	return w.write()
+}
+
+func (w *writeAheadLog) write() error {
+	w.length = binary.AppendUvarint(w.length[:0], uint64(len(w.record)))
+	w.buffered.Write(w.length)
+	_, err := w.buffered.Write(w.record)
+	return err
+}
+
+// flush hands what is buffered to the operating system, where it survives
+// the run being killed.
+func (w *writeAheadLog) flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buffered.Flush()
+}
+
+// remove drops the log once everything in it has been written out.
+func (w *writeAheadLog) remove() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
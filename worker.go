@@ -0,0 +1,33 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// worker is a goroutine crunching a file. Everything it logs carries its id,
+// the file's name and the offset it has read the file to, so the interleaved
+// logs of many workers can be pulled apart afterwards.
+type worker struct {
+	id     int
+	offset int64
+	log    zerolog.Logger
+	// latest is the latest time logged in the file so far, which tells the
+	// hour repeated as the clocks go back from the first time through it.
+	latest time.Time
+	// identity is the device and inode of the local file being followed.
+	identity fileID
+}
+
+func newWorker(id int, file inputFile) *worker {
+	w := &worker{id: id}
+	w.log = log.With().Int("worker", id).Str("name", file.name).Logger().Hook(w)
+	return w
+}
+
+// Run adds the current offset to each event the worker logs.
+func (w *worker) Run(e *zerolog.Event, level zerolog.Level, message string) {
+	e.Int64("offset", w.offset)
+}